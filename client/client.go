@@ -2,16 +2,13 @@ package spaclient
 
 import (
 	"fmt"
-	"github.com/1uLang/libnet"
-	"github.com/1uLang/libnet/options"
 	"github.com/1uLang/libspa"
 	"github.com/1uLang/libspa/encrypt"
 	"github.com/pkg/errors"
+	"net"
+	"strconv"
 	"strings"
-)
-
-const (
-	magicKey = "f1c8eafb543f03023e97b7be864a4e9b"
+	"time"
 )
 
 var (
@@ -23,6 +20,17 @@ var (
 	encryptMethodGMSM2ECC     = "gm-sm2-ecc"
 	encryptMethodGMSM3SUM     = "gm-sm3-sum"
 	encryptMethodGMSM4CBC     = "gm-sm4-cbc"
+	SPAEncryptMethodAES128CTR = "aes-128-ctr"
+	SPAEncryptMethodAES192CTR = "aes-192-ctr"
+	SPAEncryptMethodAES256CTR = "aes-256-ctr"
+	SPAEncryptMethodAES128OFB = "aes-128-ofb"
+	SPAEncryptMethodAES192OFB = "aes-192-ofb"
+	SPAEncryptMethodAES256OFB = "aes-256-ofb"
+	SPAEncryptMethodGMSM4CTR  = "gm-sm4-ctr"
+	SPAEncryptMethodGMSM4CFB  = "gm-sm4-cfb"
+	SPAEncryptMethodGMSM4OFB  = "gm-sm4-ofb"
+	SPAEncryptMethodChaCha20  = "chacha20"
+	SPAEncryptMethodXChaCha20 = "xchacha20"
 )
 
 type Client struct {
@@ -30,6 +38,10 @@ type Client struct {
 	KEY string
 	//加密iv
 	IV string
+	//密钥来源，为空时使用KEY/IV作为ID为0的密钥
+	KeyProvider encrypt.KeyProvider
+	//密钥集合，为空时从KeyProvider加载，发送时总是使用最新的有效密钥
+	Keys *encrypt.KeySet
 	//加密方式
 	Method string
 	//协议
@@ -39,15 +51,15 @@ type Client struct {
 	//服务器地址
 	Addr string
 	//测试模式
-	Test   bool
-	method encrypt.MethodInterface
+	Test bool
+	//连接超时时间
+	Timeout time.Duration
 }
 
 func New() *Client {
 	return &Client{
-		KEY:    magicKey,
-		IV:     magicKey[:16],
-		Method: SPAEncryptMethodAES256CFB,
+		Method:  SPAEncryptMethodAES256CFB,
+		Timeout: 5 * time.Second,
 	}
 }
 func (c *Client) Send(body *libspa.Body) (err error) {
@@ -55,15 +67,12 @@ func (c *Client) Send(body *libspa.Body) (err error) {
 	if err := c.check(); err != nil {
 		return errors.New("config error:" + err.Error())
 	}
-	//初始化加密通用key,iv
-
-	switch c.Protocol {
-	case "tcp":
-		return c.connectTCP(body)
-	case "udp":
-		return c.connectUDP(body)
+	bytes, err := c.packet(body)
+	if err != nil {
+		c.print("new spa packet,err", err)
+		return err
 	}
-	return nil
+	return c.connect(bytes)
 }
 
 // 检测配置是否正确
@@ -78,75 +87,51 @@ func (c *Client) check() (err error) {
 	if c.Addr == "" {
 		return errors.New("please set spa server addr")
 	}
-	if c.Method != "" {
-		c.method, err = encrypt.NewMethodInstance(c.Method, c.KEY, c.IV)
+	if c.Keys == nil {
+		provider := c.KeyProvider
+		if provider == nil {
+			provider = encrypt.NewKeyProvider(c.KEY, c.IV, c.Test)
+		}
+		c.Keys, err = encrypt.LoadKeySet(provider, c.Test)
 		if err != nil {
-			return err
+			return errors.New("load keys error:" + err.Error())
 		}
 	}
 	return nil
 }
 
-// 打印调试信息
-func (c *Client) print(a ...interface{}) {
-	if c.Test {
-		fmt.Println(a...)
-	}
-}
-
-// 连接tcp服务
-func (c *Client) connectTCP(body *libspa.Body) error {
-	opts := []options.Option{}
-	if c.method != nil {
-		opts = append(opts, options.WithEncryptMethod(c.method),
-			options.WithPrivateKey([]byte(c.KEY)),
-			options.WithPublicKey([]byte(c.IV)))
-	}
-	conn, err := libnet.NewClient(fmt.Sprintf("%s:%d", c.Addr, c.Port), nil, opts...)
+// 使用最新的有效密钥生成spa报，密钥ID为0时生成不含密钥ID的 0x01 版本报文，兼容未升级的服务端
+func (c *Client) packet(body *libspa.Body) ([]byte, error) {
+	key, err := c.Keys.Newest(time.Now())
 	if err != nil {
-		c.print("connect tcp server,err", err)
-		return err
+		return nil, err
 	}
-	bytes, err := libspa.NewPacket(body, c.method)
-	if err != nil {
-		c.print("new spa packet,err", err)
-		return err
-	}
-	err = conn.DialTCP()
-	if err != nil {
-		c.print("connect tcp server,err", err)
-		return err
+	var method encrypt.MethodInterface
+	if c.Method != "" {
+		method, err = encrypt.NewMethodInstance(c.Method, string(key.Key), string(key.IV))
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer conn.Close()
-	_, err = conn.Write(bytes)
-	if err != nil {
-		c.print("send spa packet,err", err)
-		return err
+	if key.ID == 0 {
+		return libspa.NewPacket(body, method)
 	}
-	return nil
+	return libspa.NewKeyedPacket(body, key.ID, method)
 }
 
-// 连接udp服务
-func (c *Client) connectUDP(body *libspa.Body) error {
-	opts := []options.Option{}
-	if c.method != nil {
-		opts = append(opts, options.WithEncryptMethod(c.method),
-			options.WithPrivateKey([]byte(c.KEY)),
-			options.WithPublicKey([]byte(c.IV)))
-	}
-	conn, err := libnet.NewClient(fmt.Sprintf("%s:%d", c.Addr, c.Port), nil, opts...)
-	if err != nil {
-		c.print("connect udp server,err", err)
-		return err
-	}
-	bytes, err := libspa.NewPacket(body, c.method)
-	if err != nil {
-		c.print("new spa packet,err", err)
-		return err
+// 打印调试信息
+func (c *Client) print(a ...interface{}) {
+	if c.Test {
+		fmt.Println(a...)
 	}
-	err = conn.DialUDP()
+}
+
+// 连接tcp/udp服务并发送spa报
+// 报文头部需明文传输以便服务端读取密钥ID，因此直接写入连接而不再做传输层加密
+func (c *Client) connect(bytes []byte) error {
+	conn, err := net.DialTimeout(c.Protocol, net.JoinHostPort(c.Addr, strconv.Itoa(c.Port)), c.Timeout)
 	if err != nil {
-		c.print("connect udp server,err", err)
+		c.print("connect "+c.Protocol+" server,err", err)
 		return err
 	}
 	defer conn.Close()
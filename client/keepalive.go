@@ -0,0 +1,97 @@
+package spaclient
+
+import (
+	"context"
+	"github.com/1uLang/libspa"
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/process"
+	"time"
+)
+
+// DefaultKeepAliveInterval 默认重新发送间隔，为服务端默认放行时间30秒的一半
+const DefaultKeepAliveInterval = 15 * time.Second
+
+// ErrProcessExited 监视的本地进程已退出
+var ErrProcessExited = errors.New("process exited")
+
+// KeepAlive 在服务端放行到期前定期重新发送spa报，服务端视为续期
+// 设置 PID 或 ProcessName 时仅在本地进程运行期间续期
+type KeepAlive struct {
+	Client *Client
+	Body   *libspa.Body
+	//服务端的放行时间，Interval 为0时按其一半的间隔续期
+	Duration time.Duration
+	//重新发送间隔，应小于服务端放行时间，为0时按 Duration 计算，均为0时使用 DefaultKeepAliveInterval
+	Interval time.Duration
+	//本地进程ID，进程退出时停止
+	PID int32
+	//本地进程名称，没有同名进程运行时停止
+	ProcessName string
+	//发送失败时回调，发送失败不停止续期
+	OnError func(err error)
+}
+
+// Run 立即发送spa报并定期续期，ctx 取消时返回 ctx.Err()，本地进程退出时返回 ErrProcessExited
+func (k *KeepAlive) Run(ctx context.Context) error {
+	ticker := time.NewTicker(k.interval())
+	defer ticker.Stop()
+	for {
+		running, err := k.running(ctx)
+		if err != nil {
+			return err
+		}
+		if !running {
+			return ErrProcessExited
+		}
+		if err := k.Client.Send(k.Body); err != nil {
+			k.Client.print("keep alive,err", err)
+			if k.OnError != nil {
+				k.OnError(err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// 重新发送间隔，留出半个放行时间用于重试及网络延迟
+func (k *KeepAlive) interval() time.Duration {
+	switch {
+	case k.Interval > 0:
+		return k.Interval
+	case k.Duration >= 2*time.Second:
+		return k.Duration / 2
+	case k.Duration > 0:
+		return time.Second
+	}
+	return DefaultKeepAliveInterval
+}
+
+// 本地进程是否运行，未设置进程时总是运行
+func (k *KeepAlive) running(ctx context.Context) (bool, error) {
+	if k.PID > 0 {
+		return process.PidExistsWithContext(ctx, k.PID)
+	}
+	if k.ProcessName == "" {
+		return true, nil
+	}
+	procs, err := process.ProcessesWithContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range procs {
+		if name, err := p.NameWithContext(ctx); err == nil && name == k.ProcessName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// KeepAlive 发送spa报并在本地进程 pid 运行期间每隔服务端放行时间 duration 的一半续期，pid 为0时续期至 ctx 取消
+func (c *Client) KeepAlive(ctx context.Context, body *libspa.Body, duration time.Duration, pid int32) error {
+	k := &KeepAlive{Client: c, Body: body, Duration: duration, PID: pid}
+	return k.Run(ctx)
+}
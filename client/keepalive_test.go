@@ -0,0 +1,113 @@
+package spaclient
+
+import (
+	"context"
+	"github.com/1uLang/libspa"
+	"github.com/1uLang/libspa/encrypt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive_Interval(t *testing.T) {
+	cases := []struct {
+		keepAlive KeepAlive
+		want      time.Duration
+	}{
+		{KeepAlive{}, DefaultKeepAliveInterval},
+		{KeepAlive{Duration: time.Minute}, 30 * time.Second},
+		{KeepAlive{Duration: 1500 * time.Millisecond}, time.Second},
+		{KeepAlive{Duration: time.Minute, Interval: 5 * time.Second}, 5 * time.Second},
+	}
+	for i, tc := range cases {
+		if got := tc.keepAlive.interval(); got != tc.want {
+			t.Errorf("%d: expect %s, got %s", i, tc.want, got)
+		}
+	}
+}
+
+// 本地udp服务，返回接收到的spa报
+func newTestKeepAlive(t *testing.T) (*KeepAlive, <-chan []byte) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	keys, err := encrypt.NewKeySet(&encrypt.Key{ID: 1, Key: []byte("keep-alive-key"), IV: []byte("keep-alive-iv")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case packets <- append([]byte{}, buf[:n]...):
+			default:
+			}
+		}
+	}()
+	c := New()
+	c.Keys, c.Protocol, c.Addr, c.Port = keys, "udp", "127.0.0.1", pc.LocalAddr().(*net.UDPAddr).Port
+	body := &libspa.Body{
+		ClientDeviceId: "00000000-0000-0000-0000-000000000001",
+		ClientPublicIP: net.ParseIP("127.0.0.1"),
+		ServerPublicIP: net.ParseIP("127.0.0.1"),
+	}
+	return &KeepAlive{Client: c, Body: body, Interval: 10 * time.Millisecond}, packets
+}
+
+func TestKeepAlive_Run(t *testing.T) {
+	k, packets := newTestKeepAlive(t)
+	k.PID = int32(os.Getpid())
+	k.OnError = func(err error) {
+		t.Error("unexpected send error", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- k.Run(ctx)
+	}()
+	//立即发送并按间隔续期
+	for i := 0; i < 3; i++ {
+		select {
+		case <-packets:
+		case <-time.After(3 * time.Second):
+			t.Fatal("keep alive packet was not sent", i)
+		}
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatal("expect context.Canceled, got", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("keep alive did not stop on cancel")
+	}
+}
+
+// 监视的进程退出后停止续期
+func TestKeepAlive_ProcessExited(t *testing.T) {
+	cmd := exec.Command("sleep", "0")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep is not available:", err)
+	}
+	_ = cmd.Wait()
+	k, packets := newTestKeepAlive(t)
+	k.PID = int32(cmd.Process.Pid)
+	if err := k.Run(context.Background()); err != ErrProcessExited {
+		t.Fatal("expect ErrProcessExited, got", err)
+	}
+	select {
+	case <-packets:
+		t.Fatal("must not send after the process exited")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
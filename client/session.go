@@ -0,0 +1,69 @@
+package spaclient
+
+import (
+	"github.com/1uLang/libspa"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Session tcp加密会话，一个连接可发送多个spa报并读取服务端应答
+type Session struct {
+	client  *Client
+	conn    net.Conn
+	session *libspa.Session
+}
+
+// OpenSession 建立tcp加密会话，使用最新的有效密钥
+func (c *Client) OpenSession() (*Session, error) {
+	if err := c.check(); err != nil {
+		return nil, errors.New("config error:" + err.Error())
+	}
+	if c.Protocol != "tcp" {
+		return nil, errors.New("session requires tcp protocol")
+	}
+	key, err := c.Keys.Newest(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout(c.Protocol, net.JoinHostPort(c.Addr, strconv.Itoa(c.Port)), c.Timeout)
+	if err != nil {
+		c.print("connect "+c.Protocol+" server,err", err)
+		return nil, err
+	}
+	if c.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	session, err := libspa.NewClientSession(conn, key)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &Session{client: c, conn: conn, session: session}, nil
+}
+
+// Send 发送spa报并等待服务端应答
+func (s *Session) Send(body *libspa.Body) (*libspa.Reply, error) {
+	bytes, err := s.client.packet(body)
+	if err != nil {
+		s.client.print("new spa packet,err", err)
+		return nil, err
+	}
+	if s.client.Timeout > 0 {
+		_ = s.conn.SetDeadline(time.Now().Add(s.client.Timeout))
+	}
+	if err := s.session.WriteRecord(bytes); err != nil {
+		return nil, err
+	}
+	record, err := s.session.ReadRecord()
+	if err != nil {
+		return nil, err
+	}
+	return libspa.DecodeReply(record)
+}
+
+// Close 关闭会话
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
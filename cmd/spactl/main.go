@@ -0,0 +1,371 @@
+// spactl 通过spa服务的管理接口（spaserver.Server.AdminAddr）查看及管理放行、封禁、密钥、审计事件和监控指标
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	spaserver "github.com/1uLang/libspa/server"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: spactl [-addr addr] [-token token] [-json] <command> [args]
+
+commands:
+  grants  [-ip ip] [-device id] [-proto tcp|udp] [-port port]  列出放行
+  revoke  [-ip ip] [-device id] [-proto tcp|udp] [-port port]  撤销匹配的放行
+  extend  -ip ip -proto tcp|udp -port port -seconds n         延长放行
+  flush                                                       撤销所有放行
+  bans                                                        列出自动封禁
+  unban   ip                                                  解除封禁
+  keys                                                        列出密钥ID及使用情况
+  audit                                                       持续输出审计事件
+  metrics                                                     输出监控指标
+
+addr 默认读取环境变量 SPACTL_ADDR，未设置时为 unix:/run/spa/admin.sock
+token 默认读取环境变量 SPACTL_TOKEN
+`
+
+// 命令行参数错误
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, "spactl:", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// 命令上下文
+type command struct {
+	client *client
+	json   bool
+	out    io.Writer
+}
+
+func run(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("spactl", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	addr := flags.String("addr", envOr("SPACTL_ADDR", "unix:/run/spa/admin.sock"), "admin addr")
+	token := flags.String("token", os.Getenv("SPACTL_TOKEN"), "admin token")
+	asJSON := flags.Bool("json", false, "json output")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+	client, err := newClient(*addr, *token)
+	if err != nil {
+		return err
+	}
+	c := &command{client: client, json: *asJSON, out: out}
+	name, args := flags.Arg(0), flags.Args()[1:]
+	switch name {
+	case "grants":
+		return c.grants(args)
+	case "revoke":
+		return c.revoke(args)
+	case "extend":
+		return c.extend(args)
+	case "flush":
+		return c.flush()
+	case "bans":
+		return c.bans()
+	case "unban":
+		return c.unban(args)
+	case "keys":
+		return c.keys()
+	case "audit":
+		return c.audit()
+	case "metrics":
+		return c.metrics()
+	}
+	fmt.Fprintf(flags.Output(), "unknown command %q\n", name)
+	flags.Usage()
+	return errUsage
+}
+
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// 解析放行筛选条件
+func grantQuery(name string, args []string) (url.Values, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	ip := flags.String("ip", "", "client ip")
+	device := flags.String("device", "", "device id")
+	proto := flags.String("proto", "", "protocol tcp/udp")
+	port := flags.Int("port", 0, "port")
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	query := url.Values{}
+	for key, value := range map[string]string{"ip": *ip, "device": *device, "protocol": *proto} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if *port != 0 {
+		query.Set("port", strconv.Itoa(*port))
+	}
+	return query, nil
+}
+
+func (c *command) grants(args []string) error {
+	query, err := grantQuery("grants", args)
+	if err != nil {
+		return err
+	}
+	var grants []spaserver.Grant
+	data, err := c.client.call(http.MethodGet, "/v1/grants", query, nil, &grants)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(data)
+	}
+	now := time.Now()
+	w := c.table("IP", "PROTO", "PORT", "DEST", "DEVICE", "USER", "RENEWALS", "EXPIRES", "REMAINING")
+	for _, g := range grants {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", g.IP, g.Protocol, grantPort(g), dash(g.Destination), dash(g.DeviceID),
+			dash(g.User), g.Renewals, g.Expires.Local().Format(time.RFC3339), g.Expires.Sub(now).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+// 端口或端口范围，icmp 无端口
+func grantPort(g spaserver.Grant) string {
+	switch {
+	case g.Port == 0:
+		return "-"
+	case g.PortEnd > g.Port:
+		return fmt.Sprintf("%d-%d", g.Port, g.PortEnd)
+	}
+	return strconv.Itoa(g.Port)
+}
+
+func (c *command) revoke(args []string) error {
+	query, err := grantQuery("revoke", args)
+	if err != nil {
+		return err
+	}
+	if len(query) == 0 {
+		return errors.New("revoke requires -ip, -device, -proto or -port, use flush to revoke all grants")
+	}
+	return c.revoked(c.client.call(http.MethodDelete, "/v1/grants", query, nil, nil))
+}
+
+func (c *command) flush() error {
+	return c.revoked(c.client.call(http.MethodPost, "/v1/grants/flush", nil, nil, nil))
+}
+
+// 输出撤销数量
+func (c *command) revoked(data []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(data)
+	}
+	var result struct {
+		Revoked int `json:"revoked"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "revoked %d grants\n", result.Revoked)
+	return err
+}
+
+func (c *command) extend(args []string) error {
+	flags := flag.NewFlagSet("extend", flag.ContinueOnError)
+	req := struct {
+		IP       string `json:"ip"`
+		Protocol string `json:"protocol"`
+		Port     int    `json:"port"`
+		Seconds  int    `json:"seconds"`
+	}{}
+	flags.StringVar(&req.IP, "ip", "", "client ip")
+	flags.StringVar(&req.Protocol, "proto", "", "protocol tcp/udp")
+	flags.IntVar(&req.Port, "port", 0, "port")
+	flags.IntVar(&req.Seconds, "seconds", 0, "seconds to extend")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if req.IP == "" || req.Protocol == "" || req.Port == 0 || req.Seconds <= 0 {
+		return errors.New("extend requires -ip, -proto, -port and -seconds")
+	}
+	var grant spaserver.Grant
+	data, err := c.client.call(http.MethodPost, "/v1/grants/extend", nil, req, &grant)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(data)
+	}
+	_, err = fmt.Fprintf(c.out, "%s %s/%d expires %s\n", grant.IP, grant.Protocol, grant.Port, grant.Expires.Local().Format(time.RFC3339))
+	return err
+}
+
+func (c *command) bans() error {
+	var bans []spaserver.Ban
+	data, err := c.client.call(http.MethodGet, "/v1/bans", nil, nil, &bans)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(data)
+	}
+	w := c.table("IP", "SINCE", "UNTIL", "COUNT")
+	for _, b := range bans {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", b.IP, b.Since.Local().Format(time.RFC3339), b.Until.Local().Format(time.RFC3339), b.Count)
+	}
+	return w.Flush()
+}
+
+func (c *command) unban(args []string) error {
+	if len(args) != 1 {
+		return errors.New("unban requires an ip")
+	}
+	data, err := c.client.call(http.MethodDelete, "/v1/bans", url.Values{"ip": {args[0]}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(data)
+	}
+	_, err = fmt.Fprintf(c.out, "unbanned %s\n", args[0])
+	return err
+}
+
+func (c *command) keys() error {
+	var keys []spaserver.KeyStatus
+	data, err := c.client.call(http.MethodGet, "/v1/keys", nil, nil, &keys)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(data)
+	}
+	w := c.table("ID", "VALID", "NEWEST", "NOT BEFORE", "NOT AFTER", "PACKETS", "LAST USED")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%d\t%t\t%t\t%s\t%s\t%d\t%s\n", k.ID, k.Valid, k.Newest,
+			formatTime(k.NotBefore), formatTime(k.NotAfter), k.Packets, formatTime(k.LastUsed))
+	}
+	return w.Flush()
+}
+
+// 持续输出审计事件直至服务端关闭连接
+func (c *command) audit() error {
+	resp, err := c.client.do(http.MethodGet, "/v1/audit", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if c.json {
+			if _, err := fmt.Fprintln(c.out, scanner.Text()); err != nil {
+				return err
+			}
+			continue
+		}
+		var event spaserver.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(c.out, formatEvent(&event)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// 输出 Prometheus 文本格式的监控指标
+func (c *command) metrics() error {
+	resp, err := c.client.do(http.MethodGet, "/v1/metrics", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(c.out, resp.Body)
+	return err
+}
+
+func (c *command) table(columns ...string) *tabwriter.Writer {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+	return w
+}
+
+// 格式化输出JSON响应
+func (c *command) writeJSON(data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(c.out)
+	return err
+}
+
+// 审计事件的单行文本
+func formatEvent(event *spaserver.AuditEvent) string {
+	fields := []string{event.Time.Local().Format(time.RFC3339), event.Type}
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+value)
+		}
+	}
+	add("decision", event.Decision)
+	add("proto", event.Protocol)
+	add("source", event.SourceIP)
+	add("device", event.DeviceID)
+	add("user", event.User)
+	add("method", event.Method)
+	if event.KeyID != 0 {
+		add("key", strconv.FormatUint(uint64(event.KeyID), 10))
+	}
+	add("grant", event.GrantIP)
+	add("ports", strings.Join(event.Ports, ","))
+	if event.Expires != nil {
+		add("expires", event.Expires.Local().Format(time.RFC3339))
+	}
+	add("error", event.Error)
+	if event.Message != "" {
+		add("message", strconv.Quote(event.Message))
+	}
+	return strings.Join(fields, " ")
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
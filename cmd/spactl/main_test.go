@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/1uLang/libspa/encrypt"
+	spaserver "github.com/1uLang/libspa/server"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type nopFirewall struct{}
+
+func (nopFirewall) Open(rule *spaserver.Rule) error  { return nil }
+func (nopFirewall) Close(rule *spaserver.Rule) error { return nil }
+
+func newTestServer(t *testing.T) string {
+	keys, err := encrypt.NewKeySet(&encrypt.Key{ID: 7, Key: []byte("spactl-test-key"), IV: []byte("spactl-test-iv")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := spaserver.New()
+	srv.Keys = keys
+	srv.ListenAddr = "127.0.0.1:0"
+	srv.Firewall = nopFirewall{}
+	srv.AdminAddr = "unix:" + filepath.Join(t.TempDir(), "admin.sock")
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Run()
+	}()
+	t.Cleanup(func() {
+		_ = srv.Shutdown(context.Background())
+		<-errs
+	})
+	return srv.AdminAddr
+}
+
+func runCommand(t *testing.T, args ...string) string {
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatal(args, err)
+	}
+	return out.String()
+}
+
+func TestRun(t *testing.T) {
+	addr := newTestServer(t)
+
+	out := runCommand(t, "-addr", addr, "keys")
+	if !strings.HasPrefix(out, "ID") || !strings.Contains(out, "7   true   true") {
+		t.Fatal("unexpected keys output", out)
+	}
+	var keys []spaserver.KeyStatus
+	if err := json.Unmarshal([]byte(runCommand(t, "-addr", addr, "-json", "keys")), &keys); err != nil || len(keys) != 1 || keys[0].ID != 7 {
+		t.Fatal("unexpected keys json", keys, err)
+	}
+
+	var grants []spaserver.Grant
+	if err := json.Unmarshal([]byte(runCommand(t, "-addr", addr, "-json", "grants")), &grants); err != nil || len(grants) != 0 {
+		t.Fatal("unexpected grants json", grants, err)
+	}
+	if out := runCommand(t, "-addr", addr, "flush"); out != "revoked 0 grants\n" {
+		t.Fatal("unexpected flush output", out)
+	}
+	if out := runCommand(t, "-addr", addr, "bans"); strings.TrimSpace(out) != "IP  SINCE  UNTIL  COUNT" {
+		t.Fatal("unexpected bans output", out)
+	}
+	if out := runCommand(t, "-addr", addr, "metrics"); !strings.Contains(out, "spa_active_grants 0") {
+		t.Fatal("unexpected metrics output", out)
+	}
+
+	if err := run([]string{"-addr", addr, "revoke"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("expect revoke without filter to fail")
+	}
+	if err := run([]string{"-addr", addr, "extend", "-ip", "10.0.0.1", "-proto", "tcp", "-port", "22", "-seconds", "60"}, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "grant not found") {
+		t.Fatal("expect grant not found", err)
+	}
+}
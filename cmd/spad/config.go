@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/1uLang/libspa/encrypt"
+	spaserver "github.com/1uLang/libspa/server"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 配置文件，按扩展名解析 YAML（.yaml/.yml）或 TOML（.toml）
+type config struct {
+	//测试模式，未配置密钥时使用内置 MagicKey
+	Test bool `yaml:"test" toml:"test"`
+	//监听列表
+	Listeners []listenerConfig `yaml:"listeners" toml:"listeners"`
+	//密钥来源，所有来源的密钥合并为一个密钥集合
+	Keys []keyConfig `yaml:"keys" toml:"keys"`
+	//限定的加密方式，为空时接受所有加密方式
+	Method string `yaml:"method" toml:"method"`
+	//spa 放行时间（秒）
+	SPATimeout int `yaml:"spa_timeout" toml:"spa_timeout"`
+	//tcp 连接读超时时间（秒）
+	RawTimeout int `yaml:"raw_timeout" toml:"raw_timeout"`
+	//udp 监听同时处理的数据报数量
+	UDPWorkers int `yaml:"udp_workers" toml:"udp_workers"`
+	//spa报时间戳允许的偏差
+	ReplayWindow duration `yaml:"replay_window" toml:"replay_window"`
+	//放行IP选择策略 source/packet/match/relay
+	SourcePolicy string `yaml:"source_policy" toml:"source_policy"`
+	//可信中继网段
+	TrustedRelays []string `yaml:"trusted_relays" toml:"trusted_relays"`
+	//服务器公网地址
+	PublicIPs []string `yaml:"public_ips" toml:"public_ips"`
+	//不校验 ServerPublicIP
+	SkipServerIPCheck bool `yaml:"skip_server_ip_check" toml:"skip_server_ip_check"`
+	//要求spa报携带 ServerPublicIP
+	RequireServerIP bool `yaml:"require_server_ip" toml:"require_server_ip"`
+	//限速
+	RateLimits rateLimitsConfig `yaml:"rate_limits" toml:"rate_limits"`
+	//自动封禁
+	Ban banConfig `yaml:"ban" toml:"ban"`
+	//防火墙 iptables/none，none 仅记录不修改防火墙
+	Firewall string `yaml:"firewall" toml:"firewall"`
+	//停止服务时撤销本进程设置的所有放行
+	RevokeOnShutdown bool `yaml:"revoke_on_shutdown" toml:"revoke_on_shutdown"`
+	//放行的最长时间，重复认证续期时不超过首次放行后该时间
+	MaxGrantLifetime duration `yaml:"max_grant_lifetime" toml:"max_grant_lifetime"`
+	//放行记录文件，重启后恢复未到期的放行
+	GrantStore string `yaml:"grant_store" toml:"grant_store"`
+	//认证通过后的放行，设置 policy_file 时不使用
+	Access accessConfig `yaml:"access" toml:"access"`
+	//放行策略文件（spaserver.Policy），SIGHUP 时重新加载
+	PolicyFile string `yaml:"policy_file" toml:"policy_file"`
+	//策略文件修改检查间隔，为0时仅在 SIGHUP 时重新加载
+	PolicyWatch duration `yaml:"policy_watch" toml:"policy_watch"`
+	//外部IAM回调，设置 url 时使用，优先于 policy_file 及 access
+	Webhook webhookConfig `yaml:"webhook" toml:"webhook"`
+	//审计
+	Audit auditConfig `yaml:"audit" toml:"audit"`
+	//监控指标http监听地址
+	MetricsAddr string `yaml:"metrics_addr" toml:"metrics_addr"`
+	//管理接口
+	Admin adminConfig `yaml:"admin" toml:"admin"`
+	//日志
+	Log logConfig `yaml:"log" toml:"log"`
+	//PID文件
+	PIDFile string `yaml:"pid_file" toml:"pid_file"`
+}
+
+type listenerConfig struct {
+	Protocol string `yaml:"protocol" toml:"protocol"`
+	Addr     string `yaml:"addr" toml:"addr"`
+}
+
+// 密钥来源，file/keystore/key_env/key 四选一
+type keyConfig struct {
+	//JSON密钥文件
+	File string `yaml:"file" toml:"file"`
+	//口令加密的密钥库文件
+	Keystore string `yaml:"keystore" toml:"keystore"`
+	//密钥库口令文件
+	PassphraseFile string `yaml:"passphrase_file" toml:"passphrase_file"`
+	//密钥库口令所在环境变量
+	PassphraseEnv string `yaml:"passphrase_env" toml:"passphrase_env"`
+	//密钥ID，key_env/key 时使用
+	ID uint32 `yaml:"id" toml:"id"`
+	//key及iv所在环境变量
+	KeyEnv string `yaml:"key_env" toml:"key_env"`
+	IVEnv  string `yaml:"iv_env" toml:"iv_env"`
+	//key及iv字面值，支持 hex:/base64: 前缀
+	Key string `yaml:"key" toml:"key"`
+	IV  string `yaml:"iv" toml:"iv"`
+}
+
+type rateLimitConfig struct {
+	Rate  float64 `yaml:"rate" toml:"rate"`
+	Burst int     `yaml:"burst" toml:"burst"`
+}
+
+type rateLimitsConfig struct {
+	Global rateLimitConfig `yaml:"global" toml:"global"`
+	Source rateLimitConfig `yaml:"source" toml:"source"`
+	Prefix rateLimitConfig `yaml:"prefix" toml:"prefix"`
+	Device rateLimitConfig `yaml:"device" toml:"device"`
+}
+
+type banConfig struct {
+	MaxFailures int      `yaml:"max_failures" toml:"max_failures"`
+	Window      duration `yaml:"window" toml:"window"`
+	BanTime     duration `yaml:"ban_time" toml:"ban_time"`
+	MaxBanTime  duration `yaml:"max_ban_time" toml:"max_ban_time"`
+	Allowlist   []string `yaml:"allowlist" toml:"allowlist"`
+}
+
+// 认证通过的设备放行的端口，devices 为空时放行所有设备
+type accessConfig struct {
+	TcpPorts []int    `yaml:"tcp_ports" toml:"tcp_ports"`
+	UdpPorts []int    `yaml:"udp_ports" toml:"udp_ports"`
+	Devices  []string `yaml:"devices" toml:"devices"`
+	//放行时间，为0时使用 spa_timeout
+	Duration duration `yaml:"duration" toml:"duration"`
+	//放行来源IP所在网段的前缀长度，为0时仅放行来源IP
+	SourcePrefix int `yaml:"source_prefix" toml:"source_prefix"`
+}
+
+func (c *accessConfig) allow() spaserver.Allow {
+	return spaserver.Allow{
+		TcpPorts:     c.TcpPorts,
+		UdpPorts:     c.UdpPorts,
+		Duration:     time.Duration(c.Duration),
+		SourcePrefix: c.SourcePrefix,
+	}
+}
+
+type webhookConfig struct {
+	URL      string `yaml:"url" toml:"url"`
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	CAFile   string `yaml:"ca_file" toml:"ca_file"`
+	//请求签名密钥文件
+	SecretFile string   `yaml:"secret_file" toml:"secret_file"`
+	Timeout    duration `yaml:"timeout" toml:"timeout"`
+	Retries    int      `yaml:"retries" toml:"retries"`
+	CacheTTL   duration `yaml:"cache_ttl" toml:"cache_ttl"`
+	//拒绝结果的缓存时间，默认为 cache_ttl 与10秒中较小的值
+	NegativeCacheTTL duration `yaml:"negative_cache_ttl" toml:"negative_cache_ttl"`
+	//回调失败时放行的端口，为空时拒绝
+	FailOpen *accessConfig `yaml:"fail_open" toml:"fail_open"`
+}
+
+type auditConfig struct {
+	//JSON lines 文件
+	File string `yaml:"file" toml:"file"`
+	//文件轮转大小（字节），为0时不轮转
+	MaxSize int64 `yaml:"max_size" toml:"max_size"`
+	//保留的轮转文件数量
+	MaxBackups int `yaml:"max_backups" toml:"max_backups"`
+	//syslog 地址，如 udp://127.0.0.1:514、unixgram:///dev/log
+	Syslog string `yaml:"syslog" toml:"syslog"`
+}
+
+type adminConfig struct {
+	//监听地址，如 unix:/run/spa/admin.sock
+	Addr string `yaml:"addr" toml:"addr"`
+	//访问令牌
+	Token string `yaml:"token" toml:"token"`
+	//访问令牌文件
+	TokenFile string `yaml:"token_file" toml:"token_file"`
+}
+
+type logConfig struct {
+	//日志级别 debug/info/warn/error
+	Level string `yaml:"level" toml:"level"`
+	//日志格式 text/json
+	Format string `yaml:"format" toml:"format"`
+	//日志文件，为空时输出到标准错误
+	File string `yaml:"file" toml:"file"`
+}
+
+// 支持 "10m"、"1h30m" 格式的时长
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// 读取配置文件
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		_, err = toml.Decode(string(data), cfg)
+	default:
+		return nil, fmt.Errorf("unsupported config format %s, use .yaml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s error:%v", path, err)
+	}
+	return cfg, nil
+}
+
+// 多个密钥来源合并
+type keyProviders []encrypt.KeyProvider
+
+func (p keyProviders) Keys() ([]*encrypt.Key, error) {
+	var keys []*encrypt.Key
+	for _, provider := range p {
+		k, err := provider.Keys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k...)
+	}
+	return keys, nil
+}
+
+// 创建密钥来源，未配置密钥时返回空，由 Server 使用 KEY/IV
+func (c *config) keyProvider() (encrypt.KeyProvider, error) {
+	if len(c.Keys) == 0 {
+		return nil, nil
+	}
+	providers := make(keyProviders, 0, len(c.Keys))
+	for i, k := range c.Keys {
+		switch {
+		case k.File != "":
+			providers = append(providers, &encrypt.FileKeyProvider{Path: k.File})
+		case k.Keystore != "":
+			passphrase, err := secret(k.PassphraseFile, k.PassphraseEnv)
+			if err != nil {
+				return nil, fmt.Errorf("keys[%d] passphrase error:%v", i, err)
+			}
+			providers = append(providers, &encrypt.KeystoreKeyProvider{Path: k.Keystore, Passphrase: []byte(passphrase)})
+		case k.KeyEnv != "":
+			providers = append(providers, &encrypt.EnvKeyProvider{ID: k.ID, KeyEnv: k.KeyEnv, IVEnv: k.IVEnv})
+		case k.Key != "":
+			providers = append(providers, &encrypt.LiteralKeyProvider{ID: k.ID, Key: k.Key, IV: k.IV})
+		default:
+			return nil, fmt.Errorf("keys[%d] requires file, keystore, key_env or key", i)
+		}
+	}
+	return providers, nil
+}
+
+// 从文件或环境变量读取口令及令牌，文件内容去除首尾空白
+func secret(file, env string) (string, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if env != "" {
+		return lookupEnv(env)
+	}
+	return "", errors.New("passphrase_file or passphrase_env is required")
+}
+
+// 创建回调 Handler
+func (c *webhookConfig) handler() (*spaserver.WebhookHandler, error) {
+	config := spaserver.WebhookConfig{
+		URL:              c.URL,
+		CertFile:         c.CertFile,
+		KeyFile:          c.KeyFile,
+		CAFile:           c.CAFile,
+		Timeout:          time.Duration(c.Timeout),
+		Retries:          c.Retries,
+		CacheTTL:         time.Duration(c.CacheTTL),
+		NegativeCacheTTL: time.Duration(c.NegativeCacheTTL),
+	}
+	if c.SecretFile != "" {
+		var err error
+		if config.Secret, err = secret(c.SecretFile, ""); err != nil {
+			return nil, fmt.Errorf("webhook secret error:%v", err)
+		}
+	}
+	if c.FailOpen != nil {
+		allow := c.FailOpen.allow()
+		config.FailOpen = &allow
+	}
+	return spaserver.NewWebhookHandler(config)
+}
+
+// 根据配置创建spa服务
+func (c *config) server() (*spaserver.Server, error) {
+	srv := spaserver.New()
+	srv.Test = c.Test
+	for _, l := range c.Listeners {
+		srv.Listeners = append(srv.Listeners, spaserver.Listener{Protocol: l.Protocol, Addr: l.Addr})
+	}
+	var err error
+	if srv.KeyProvider, err = c.keyProvider(); err != nil {
+		return nil, err
+	}
+	srv.Method = c.Method
+	if c.SPATimeout != 0 {
+		srv.SPATimeout = c.SPATimeout
+	}
+	srv.RawTimeout = c.RawTimeout
+	srv.UDPWorkers = c.UDPWorkers
+	srv.ReplayWindow = time.Duration(c.ReplayWindow)
+	if srv.SourcePolicy, err = spaserver.ParseSourcePolicy(c.SourcePolicy); err != nil {
+		return nil, err
+	}
+	srv.TrustedRelays = c.TrustedRelays
+	srv.PublicIPs = c.PublicIPs
+	srv.SkipServerIPCheck = c.SkipServerIPCheck
+	srv.RequireServerIP = c.RequireServerIP
+	srv.RateLimits = spaserver.RateLimits{
+		Global: spaserver.RateLimit(c.RateLimits.Global),
+		Source: spaserver.RateLimit(c.RateLimits.Source),
+		Prefix: spaserver.RateLimit(c.RateLimits.Prefix),
+		Device: spaserver.RateLimit(c.RateLimits.Device),
+	}
+	srv.Ban = spaserver.BanPolicy{
+		MaxFailures: c.Ban.MaxFailures,
+		Window:      time.Duration(c.Ban.Window),
+		BanTime:     time.Duration(c.Ban.BanTime),
+		MaxBanTime:  time.Duration(c.Ban.MaxBanTime),
+		Allowlist:   c.Ban.Allowlist,
+	}
+	switch strings.ToLower(c.Firewall) {
+	case "", "iptables":
+	case "none":
+		srv.Firewall = logFirewall{}
+	default:
+		return nil, errors.New("invalid firewall " + c.Firewall)
+	}
+	srv.RevokeOnShutdown = c.RevokeOnShutdown
+	srv.GrantStore = c.GrantStore
+	srv.MaxGrantLifetime = time.Duration(c.MaxGrantLifetime)
+	srv.MetricsAddr = c.MetricsAddr
+	srv.AdminAddr, srv.AdminToken = c.Admin.Addr, c.Admin.Token
+	if c.Admin.TokenFile != "" {
+		if srv.AdminToken, err = secret(c.Admin.TokenFile, ""); err != nil {
+			return nil, fmt.Errorf("admin token error:%v", err)
+		}
+	}
+	return srv, nil
+}
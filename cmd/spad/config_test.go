@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/1uLang/libspa"
+	spaserver "github.com/1uLang/libspa/server"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testYAML = `
+test: true
+listeners:
+  - protocol: udp
+    addr: "127.0.0.1:0"
+keys:
+  - id: 3
+    key: hex:00112233445566778899aabbccddeeff
+    iv: spad-test-iv
+spa_timeout: 60
+replay_window: 2m
+source_policy: match
+rate_limits:
+  source:
+    rate: 5
+    burst: 10
+ban:
+  max_failures: 3
+  ban_time: 10m
+firewall: none
+access:
+  tcp_ports: [22, 443]
+  devices: ["00000000-0000-0000-0000-000000000001"]
+admin:
+  addr: unix:/tmp/spad-test.sock
+`
+
+const testTOML = `
+test = true
+spa_timeout = 60
+replay_window = "2m"
+source_policy = "match"
+firewall = "none"
+
+[[listeners]]
+protocol = "udp"
+addr = "127.0.0.1:0"
+
+[[keys]]
+id = 3
+key = "hex:00112233445566778899aabbccddeeff"
+iv = "spad-test-iv"
+
+[rate_limits.source]
+rate = 5.0
+burst = 10
+
+[ban]
+max_failures = 3
+ban_time = "10m"
+
+[access]
+tcp_ports = [22, 443]
+devices = ["00000000-0000-0000-0000-000000000001"]
+
+[admin]
+addr = "unix:/tmp/spad-test.sock"
+`
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	yamlCfg, err := loadConfig(writeConfig(t, "spad.yaml", testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tomlCfg, err := loadConfig(writeConfig(t, "spad.toml", testTOML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(yamlCfg, tomlCfg) {
+		t.Fatalf("yaml and toml configs differ:\n%+v\n%+v", yamlCfg, tomlCfg)
+	}
+	if time.Duration(yamlCfg.ReplayWindow) != 2*time.Minute || time.Duration(yamlCfg.Ban.BanTime) != 10*time.Minute {
+		t.Fatal("unexpected durations", yamlCfg.ReplayWindow, yamlCfg.Ban.BanTime)
+	}
+	if _, err := loadConfig(writeConfig(t, "spad.json", "{}")); err == nil {
+		t.Fatal("expect unsupported format error")
+	}
+}
+
+func TestConfig_Server(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "spad.yaml", testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := cfg.server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.SPATimeout != 60 || srv.SourcePolicy != spaserver.MatchIPPolicy || srv.RateLimits.Source.Burst != 10 {
+		t.Fatal("unexpected server config", srv)
+	}
+	if _, ok := srv.Firewall.(logFirewall); !ok {
+		t.Fatal("expect log firewall", srv.Firewall)
+	}
+	keys, err := srv.KeyProvider.Keys()
+	if err != nil || len(keys) != 1 || keys[0].ID != 3 || len(keys[0].Key) != 16 {
+		t.Fatal("unexpected keys", keys, err)
+	}
+
+	d := &daemon{cfg: cfg}
+	if err := d.check(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.SourcePolicy = "nat"
+	if err := d.check(); err == nil {
+		t.Fatal("expect invalid source policy")
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	cfg, err := loadConfig("spad.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.server(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccessHandler(t *testing.T) {
+	h := newAccessHandler(accessConfig{TcpPorts: []int{22}, Devices: []string{"00000000-0000-0000-0000-00000000000A"}})
+	allow, err := h.OnAuthority(&libspa.Body{ClientDeviceId: "00000000-0000-0000-0000-00000000000a"}, nil)
+	if err != nil || allow == nil || !reflect.DeepEqual(allow.TcpPorts, []int{22}) {
+		t.Fatal("unexpected allow", allow, err)
+	}
+	if allow, _ := h.OnAuthority(&libspa.Body{ClientDeviceId: "00000000-0000-0000-0000-000000000002"}, nil); allow != nil {
+		t.Fatal("unknown device should be blocked", allow)
+	}
+	//重新加载后放行所有设备
+	h.update(accessConfig{UdpPorts: []int{53}})
+	allow, _ = h.OnAuthority(&libspa.Body{ClientDeviceId: "00000000-0000-0000-0000-000000000002"}, nil)
+	if allow == nil || len(allow.TcpPorts) != 0 || !reflect.DeepEqual(allow.UdpPorts, []int{53}) {
+		t.Fatal("unexpected allow after update", allow)
+	}
+}
+
+func TestDaemon_Apply(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "spad.yaml", testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := cfg.server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &daemon{cfg: cfg, srv: srv, access: newAccessHandler(cfg.Access)}
+	srv.SetHandler(d.access)
+	if err := srv.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := loadConfig(writeConfig(t, "spad.yaml", testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Keys = []keyConfig{{ID: 4, Key: "next-key", IV: "next-iv"}}
+	next.Access = accessConfig{UdpPorts: []int{53}}
+	if err := d.apply(next); err != nil {
+		t.Fatal(err)
+	}
+	keys := srv.Keys.Keys()
+	if len(keys) != 1 || keys[0].ID != 4 {
+		t.Fatal("keys were not replaced", keys)
+	}
+	allow, _ := d.access.OnAuthority(&libspa.Body{ClientDeviceId: "00000000-0000-0000-0000-000000000002"}, nil)
+	if allow == nil || !reflect.DeepEqual(allow.UdpPorts, []int{53}) {
+		t.Fatal("access was not updated", allow)
+	}
+}
+
+func TestDaemon_Override(t *testing.T) {
+	path := writeConfig(t, "spad.yaml", testYAML)
+	d, err := newDaemon(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.policyFile, d.pidFile = "/etc/spa/policy.yaml", "/run/spad.pid"
+	d.override(d.cfg)
+	//重新加载的配置同样使用命令行参数，不应被视为需要重启的变化
+	next, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.override(next)
+	if next.PolicyFile != d.policyFile || next.PIDFile != d.pidFile {
+		t.Fatal("flags were not applied", next.PolicyFile, next.PIDFile)
+	}
+	if !reflect.DeepEqual(restartConfig(d.cfg), restartConfig(next)) {
+		t.Fatal("flag overrides must not require a restart")
+	}
+}
+
+func TestWhatIf(t *testing.T) {
+	file := writeConfig(t, "policy.yaml", `
+rules:
+  - name: office
+    sources: [10.0.0.0/8]
+    tcp_ports: [22, 443]
+`)
+	var out bytes.Buffer
+	allow, err := whatIf(file, "device=00000000-0000-0000-0000-000000000001,source=10.0.0.1,tcp=22+443,time=2022-11-07T09:30:00Z", &out)
+	if err != nil || !allow {
+		t.Fatal("expect allow", out.String(), err)
+	}
+	var decision spaserver.PolicyDecision
+	if err := json.Unmarshal(out.Bytes(), &decision); err != nil || decision.Rule != "office" || !reflect.DeepEqual(decision.TcpPorts, []int{22, 443}) {
+		t.Fatal("unexpected decision", out.String(), err)
+	}
+	if allow, err := whatIf(file, "source=172.16.0.1", &bytes.Buffer{}); err != nil || allow {
+		t.Fatal("expect deny", err)
+	}
+	if _, err := whatIf(file, "port=22", &bytes.Buffer{}); err == nil {
+		t.Fatal("expect unknown field error")
+	}
+}
+
+func TestExamplePolicy(t *testing.T) {
+	if _, err := spaserver.LoadPolicy("policy.example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Webhook(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "spad.yaml", testYAML+`
+webhook:
+  url: https://127.0.0.1:8443/authorize
+  cert_file: ../../certs/client.pem
+  key_file: ../../certs/client.key
+  timeout: 3s
+  fail_open:
+    tcp_ports: [22]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := cfg.server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &daemon{cfg: cfg}
+	if err := d.setHandler(srv); err != nil {
+		t.Fatal(err)
+	}
+	if d.access != nil || d.policy != nil {
+		t.Fatal("webhook should take precedence over access and policy")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/1uLang/libspa/encrypt"
+	spaserver "github.com/1uLang/libspa/server"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 停止服务的等待时间
+const shutdownTimeout = 30 * time.Second
+
+// 守护进程
+type daemon struct {
+	path string
+	//命令行参数，不为空时覆盖配置文件，重新加载时同样生效
+	policyFile string
+	pidFile    string
+	cfg        *config
+	srv        *spaserver.Server
+	access     *accessHandler
+	policy     *spaserver.PolicyHandler
+	sinks      []io.Closer
+	logFile    *os.File
+}
+
+func newDaemon(path string) (*daemon, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return &daemon{path: path, cfg: cfg}, nil
+}
+
+// 检测配置，不创建监听及审计输出
+func (d *daemon) check() error {
+	if _, err := parseLogLevel(d.cfg.Log.Level); err != nil {
+		return err
+	}
+	if _, _, err := parseSyslogAddr(d.cfg.Audit.Syslog); err != nil {
+		return err
+	}
+	srv, err := d.cfg.server()
+	if err != nil {
+		return err
+	}
+	if err := d.setHandler(srv); err != nil {
+		return err
+	}
+	return srv.Check()
+}
+
+// 启动服务，阻塞至收到停止信号或监听失败
+func (d *daemon) run() error {
+	if err := d.setupLog(d.cfg.Log); err != nil {
+		return err
+	}
+	defer d.closeLog()
+	srv, err := d.cfg.server()
+	if err != nil {
+		return err
+	}
+	d.srv = srv
+	if err := d.setHandler(srv); err != nil {
+		return err
+	}
+	if srv.AuditSinks, err = d.openAudit(d.cfg.Audit); err != nil {
+		return err
+	}
+	defer d.closeAudit()
+	if err := srv.Listen(); err != nil {
+		return err
+	}
+	if err := writePIDFile(d.cfg.PIDFile); err != nil {
+		_ = srv.Shutdown(context.Background())
+		return err
+	}
+	defer removePIDFile(d.cfg.PIDFile)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Run()
+	}()
+	for _, addr := range srv.Addrs() {
+		log.Infof("listen %s/%s", addr.Network(), addr)
+	}
+	d.notify("READY=1")
+	stopWatchdog := d.watchdog()
+	defer stopWatchdog()
+	if d.policy != nil && d.cfg.PolicyWatch > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go d.policy.Watch(ctx, time.Duration(d.cfg.PolicyWatch))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case err := <-errs:
+			d.notify("STOPPING=1")
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				d.reload()
+				continue
+			}
+			log.Infof("received %s, shutting down", sig)
+			d.notify("STOPPING=1")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			err := srv.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				return err
+			}
+			if err := <-errs; err != spaserver.ErrServerClosed {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+// 重新加载配置，监听等需要重启的配置变化时仅输出警告
+func (d *daemon) reload() {
+	d.notify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec()))
+	defer d.notify("READY=1")
+	cfg, err := loadConfig(d.path)
+	if err == nil {
+		d.override(cfg)
+		err = d.apply(cfg)
+	}
+	if err != nil {
+		log.Error("reload config err:", err)
+		return
+	}
+	log.Info("config reloaded")
+}
+
+// 使用命令行参数覆盖配置
+func (d *daemon) override(cfg *config) {
+	if d.policyFile != "" {
+		cfg.PolicyFile = d.policyFile
+	}
+	if d.pidFile != "" {
+		cfg.PIDFile = d.pidFile
+	}
+}
+
+// 应用可在运行中修改的配置：密钥、放行配置及日志
+func (d *daemon) apply(cfg *config) error {
+	if err := d.setupLog(cfg.Log); err != nil {
+		return err
+	}
+	if len(cfg.Keys) > 0 {
+		provider, err := cfg.keyProvider()
+		if err != nil {
+			return err
+		}
+		keys, err := encrypt.LoadKeySet(provider, cfg.Test)
+		if err != nil {
+			return err
+		}
+		if err := d.srv.Keys.Replace(keys.Keys()...); err != nil {
+			return err
+		}
+	}
+	if d.policy != nil {
+		if err := d.policy.Reload(); err != nil {
+			return err
+		}
+	} else if d.access != nil {
+		d.access.update(cfg.Access)
+	}
+	if !reflect.DeepEqual(restartConfig(d.cfg), restartConfig(cfg)) {
+		log.Warn("listeners, policies, firewall, audit, metrics or admin changed, restart spad to apply")
+	}
+	d.cfg.Keys, d.cfg.Access, d.cfg.Log = cfg.Keys, cfg.Access, cfg.Log
+	return nil
+}
+
+// 设置认证handler，依次使用外部IAM回调、策略文件或 access 配置
+func (d *daemon) setHandler(srv *spaserver.Server) (err error) {
+	if d.cfg.Webhook.URL != "" {
+		h, err := d.cfg.Webhook.handler()
+		if err != nil {
+			return err
+		}
+		srv.SetHandler(h)
+		return nil
+	}
+	if d.cfg.PolicyFile != "" {
+		if d.policy, err = spaserver.NewPolicyHandler(d.cfg.PolicyFile); err != nil {
+			return err
+		}
+		srv.SetHandler(d.policy)
+		return nil
+	}
+	d.access = newAccessHandler(d.cfg.Access)
+	srv.SetHandler(d.access)
+	return nil
+}
+
+// 去除可重新加载的配置，剩余部分变化时需要重启
+func restartConfig(cfg *config) config {
+	c := *cfg
+	c.Keys, c.Access, c.Log, c.PIDFile = nil, accessConfig{}, logConfig{}, ""
+	return c
+}
+
+// 定期发送 watchdog 通知，返回停止函数
+func (d *daemon) watchdog() func() {
+	timeout := sdWatchdog()
+	if timeout == 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(timeout / 2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				d.notify("WATCHDOG=1")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+func (d *daemon) notify(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Warn("sd_notify err:", err)
+	}
+}
+
+// 配置日志，日志文件每次调用时重新打开，便于 logrotate 轮转
+func (d *daemon) setupLog(cfg logConfig) error {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return errors.New("invalid log format " + cfg.Format)
+	}
+	var out io.Writer = os.Stderr
+	var file *os.File
+	if cfg.File != "" {
+		file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+	log.SetOutput(out)
+	log.SetLevel(level)
+	d.closeLog()
+	d.logFile = file
+	return nil
+}
+
+func (d *daemon) closeLog() {
+	if d.logFile != nil {
+		d.logFile.Close()
+		d.logFile = nil
+	}
+}
+
+func parseLogLevel(level string) (log.Level, error) {
+	if level == "" {
+		return log.InfoLevel, nil
+	}
+	return log.ParseLevel(level)
+}
+
+// 创建审计输出
+func (d *daemon) openAudit(cfg auditConfig) ([]spaserver.AuditSink, error) {
+	var sinks []spaserver.AuditSink
+	if cfg.File != "" {
+		sink, err := spaserver.NewJSONFileSink(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+		d.sinks = append(d.sinks, sink)
+	}
+	if cfg.Syslog != "" {
+		network, addr, err := parseSyslogAddr(cfg.Syslog)
+		if err != nil {
+			d.closeAudit()
+			return nil, err
+		}
+		sink, err := spaserver.NewSyslogSink(network, addr, "spad")
+		if err != nil {
+			d.closeAudit()
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+		d.sinks = append(d.sinks, sink)
+	}
+	return sinks, nil
+}
+
+func (d *daemon) closeAudit() {
+	for _, sink := range d.sinks {
+		_ = sink.Close()
+	}
+	d.sinks = nil
+}
+
+// 解析 syslog 地址，如 udp://127.0.0.1:514、unixgram:///dev/log
+func parseSyslogAddr(s string) (network, addr string, err error) {
+	if s == "" {
+		return "", "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		return u.Scheme, u.Host, nil
+	case "unix", "unixgram":
+		return u.Scheme, u.Path, nil
+	}
+	return "", "", errors.New("invalid syslog addr " + s)
+}
+
+// 写入PID文件
+func writePIDFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+func removePIDFile(path string) {
+	if path != "" {
+		_ = os.Remove(path)
+	}
+}
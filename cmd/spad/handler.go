@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/1uLang/libspa"
+	spaserver "github.com/1uLang/libspa/server"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+// 按配置放行认证通过的设备，可在运行中替换配置
+type accessHandler struct {
+	locker  sync.RWMutex
+	allow   spaserver.Allow
+	devices map[string]bool
+}
+
+func newAccessHandler(access accessConfig) *accessHandler {
+	h := &accessHandler{}
+	h.update(access)
+	return h
+}
+
+// 替换放行配置
+func (h *accessHandler) update(access accessConfig) {
+	devices := map[string]bool{}
+	for _, device := range access.Devices {
+		devices[strings.ToLower(device)] = true
+	}
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	h.allow = access.allow()
+	h.devices = devices
+}
+
+func (h *accessHandler) OnConnect(conn *spaserver.Conn) {}
+
+func (h *accessHandler) OnAuthority(body *libspa.Body, err error) (*spaserver.Allow, error) {
+	if err != nil {
+		return nil, err
+	}
+	h.locker.RLock()
+	defer h.locker.RUnlock()
+	if len(h.devices) > 0 && !h.devices[strings.ToLower(body.ClientDeviceId)] {
+		return nil, nil
+	}
+	allow := h.allow
+	return &allow, nil
+}
+
+func (h *accessHandler) OnClose(conn *spaserver.Conn, err error) {}
+
+// 仅记录日志的防火墙，用于测试配置
+type logFirewall struct{}
+
+func (logFirewall) Open(rule *spaserver.Rule) error {
+	log.Infof("open %s for %ds", rule, rule.Timeout)
+	return nil
+}
+
+func (logFirewall) Close(rule *spaserver.Rule) error {
+	log.Infof("close %s", rule)
+	return nil
+}
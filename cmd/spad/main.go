@@ -0,0 +1,65 @@
+// spad spa服务守护进程
+//
+//	spad -config /etc/spa/spad.yaml          启动服务
+//	spad -config /etc/spa/spad.yaml -check   检测配置后退出
+//	spad -config /etc/spa/spad.yaml -what-if "device=...,source=10.0.0.1,tcp=22"
+//	                                         按策略文件评估请求，放行时退出码为0，否则为1
+//
+// SIGTERM/SIGINT 优雅停止，SIGHUP 重新加载密钥、放行配置及日志配置并重新打开日志文件。
+// 由 systemd 启动时（Type=notify）发送 READY/RELOADING/STOPPING 通知，设置 WatchdogSec 时定期发送 WATCHDOG 通知。
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	path := flag.String("config", "/etc/spa/spad.yaml", "config file (.yaml or .toml)")
+	check := flag.Bool("check", false, "check config and exit")
+	pidFile := flag.String("pid-file", "", "pid file, overrides pid_file in config")
+	policy := flag.String("policy", "", "policy file, overrides policy_file in config")
+	what := flag.String("what-if", "", "evaluate a request against the policy and exit")
+	flag.Parse()
+
+	d, err := newDaemon(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "spad:", err)
+		os.Exit(2)
+	}
+	d.policyFile, d.pidFile = *policy, *pidFile
+	d.override(d.cfg)
+	if *what != "" {
+		allow, err := whatIf(d.cfg.PolicyFile, *what, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "spad:", err)
+			os.Exit(2)
+		}
+		if !allow {
+			os.Exit(1)
+		}
+		return
+	}
+	if *check {
+		if err := d.check(); err != nil {
+			fmt.Fprintln(os.Stderr, "spad:", err)
+			os.Exit(1)
+		}
+		fmt.Println("config ok")
+		return
+	}
+	if err := d.run(); err != nil {
+		fmt.Fprintln(os.Stderr, "spad:", err)
+		os.Exit(1)
+	}
+}
+
+// 读取环境变量，未设置时返回错误
+func lookupEnv(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
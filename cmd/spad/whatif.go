@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	spaserver "github.com/1uLang/libspa/server"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 解析 -what-if 参数，如 "device=...,source=10.0.0.1,tcp=22,udp=53,user=alice,time=2022-11-07T09:30:00Z"
+// 端口可用 "+" 分隔多个，如 tcp=22+443
+func parseWhatIf(s string) (*spaserver.PolicyRequest, error) {
+	req := &spaserver.PolicyRequest{}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid what-if field " + field)
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "device":
+			req.DeviceID = value
+		case "user":
+			req.User = value
+		case "source":
+			if req.SourceIP = net.ParseIP(value); req.SourceIP == nil {
+				return nil, errors.New("invalid source " + value)
+			}
+		case "tcp":
+			req.TcpPorts, err = parsePorts(value)
+		case "udp":
+			req.UdpPorts, err = parsePorts(value)
+		case "time":
+			req.Time, err = time.Parse(time.RFC3339, value)
+		default:
+			return nil, errors.New("unknown what-if field " + key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("what-if %s: %v", key, err)
+		}
+	}
+	return req, nil
+}
+
+func parsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, p := range strings.Split(s, "+") {
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, errors.New("invalid port " + p)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// 按策略文件评估请求并输出结果
+func whatIf(file, s string, out io.Writer) (bool, error) {
+	if file == "" {
+		return false, errors.New("policy_file is not set")
+	}
+	req, err := parseWhatIf(s)
+	if err != nil {
+		return false, err
+	}
+	policy, err := spaserver.LoadPolicy(file)
+	if err != nil {
+		return false, err
+	}
+	decision := policy.Evaluate(req)
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return decision.Allow, encoder.Encode(decision)
+}
@@ -0,0 +1,275 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"github.com/ZZMarquis/gm/sm2"
+	"github.com/ZZMarquis/gm/sm3"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// 跨语言测试向量文件，C/Java 等其他SPA客户端实现可直接读取校验
+// 使用 go test ./encrypt -run TestConformance_VectorFile -update 重新生成
+const (
+	vectorFileVersion = 2
+	vectorFilePath    = "testdata/vectors.json"
+)
+
+var updateVectors = flag.Bool("update", false, "regenerate "+vectorFilePath)
+
+type conformanceVector struct {
+	source string
+	//仅校验解密，用于加密结果带随机数的加密方式
+	decryptOnly bool
+	methodVector
+}
+
+var conformanceVectors = func() []conformanceVector {
+	vectors := []conformanceVector{
+		{"identity", false, methodVector{"raw", "", "", "48656c6c6f2c20576f726c64", "48656c6c6f2c20576f726c64"}},
+		{"NIST SP 800-38A F.3.13", false, methodVector{"aes-128-cfb", nistKey128, nistIV, nistPlaintext, "3b3fd92eb72dad20333449f8e83cfb4ac8a64537a0b3a93fcde3cdad9f1ce58b26751f67a3cbb140b1808cf187a4f4dfc04b05357c5d1c0eeac4c66f9ff7f2e6"}},
+		{"NIST SP 800-38A F.3.15", false, methodVector{"aes-192-cfb", nistKey192, nistIV, nistPlaintext, "cdc80d6fddf18cab34c25909c99a417467ce7f7f81173621961a2b70171d3d7a2e1e8a1dd59b88b1c8e60fed1efac4c9c05f9f9ca9834fa042ae8fba584b09ff"}},
+		{"NIST SP 800-38A F.3.17", false, methodVector{"aes-256-cfb", nistKey256, nistIV, nistPlaintext, "dc7e84bfda79164b7ecd8486985d386039ffed143b28b1c832113c6331e5407bdf10132415e54b92a13ed0a8267ae2f975a385741ab9cef82031623d55b1e471"}},
+		// 首个分组为标准密文，第二个分组为 PKCS#5 填充分组
+		{"GB/T 32907-2016 A.1, PKCS#5 padded", false, methodVector{"gm-sm4-cbc", gbtKey, "00000000000000000000000000000000", gbtKey, gbtCiphertext + "677d307e844d7aa24579d556490dc7aa"}},
+		// sm3 为摘要算法，密文即摘要
+		{"GB/T 32905-2016 A.1", false, methodVector{"gm-sm3-sum", "", "", "616263", "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0"}},
+		{"GB/T 32905-2016 A.2", false, methodVector{"gm-sm3-sum", "", "", "61626364616263646162636461626364616263646162636461626364616263646162636461626364616263646162636461626364616263646162636461626364", "debe9ff92275b8a138604889c18e5a4d6fdb70e5387e5765293dcba39c0c5732"}},
+		// sm2 加密带随机数，key为私钥，iv为公钥，C1C2C3 格式
+		{"libspa", true, methodVector{"gm-sm2-ecc",
+			"910b34e6a1814b3ffe8cda68b71dd5e542a6be36d743f3a93d0a68ede7774040",
+			"6e46a249630c281f9d7bbf104f2cde38ef088f43daa6296e136138e13f04f3b90550f3178ada4f4eebd59a56a9224300465e97ea4f574a6289839459845e81e4",
+			"6c696273706120736d3220636f6e666f726d616e636520766563746f72",
+			"044df9e3ebe38f4aa5366d2a55a7df4c212b39b376d2aca10e36b53e21e74ebef5698553bf2d91b7a16020179d169574de85100ee947d70bf034eabfcbd689a0805c0e6b50f0a91442e9bdac6f226c95f28e6c5bff1e56ef2b2eda1c63a4263f4ae7f1ab60c1c09922c6b17659722d402c343ad04a83003bf2f381703bab"}},
+	}
+	// 流加密模式的密文为 IV + 标准密文，加密时IV随机生成，因此仅校验解密
+	prefixed := func(source string, v methodVector) conformanceVector {
+		return conformanceVector{source + ", iv prefixed", true, methodVector{v.method, v.key, "", v.plaintext, v.iv + v.ciphertext}}
+	}
+	for _, v := range aesModeVectors {
+		vectors = append(vectors, prefixed("NIST SP 800-38A F.4/F.5", v))
+	}
+	for _, v := range sm4ModeVectors {
+		vectors = append(vectors, prefixed("GB/T 32907-2016 A.1, first block", v))
+	}
+	for _, v := range sm4BlockVectors[:3] {
+		vectors = append(vectors, prefixed("draft-ribose-cfrg-sm4-10 A.2, OpenSSL cross-checked", v))
+	}
+	vectors = append(vectors, conformanceVector{"draft-ribose-cfrg-sm4-10 A.2, PKCS#5 padded", false, sm4CBCBlockVector})
+	vectors = append(vectors,
+		prefixed("RFC 8439 A.1 #1", chacha20Vectors[0]),
+		prefixed("draft-irtf-cfrg-xchacha-01 A.3.2", chacha20Vectors[1]),
+	)
+	return vectors
+}()
+
+func TestConformance_KnownAnswer(t *testing.T) {
+	for _, v := range conformanceVectors {
+		t.Run(v.method, func(t *testing.T) {
+			checkConformanceVector(t, v.methodVector, v.decryptOnly)
+		})
+	}
+}
+
+func checkConformanceVector(t *testing.T, v methodVector, decryptOnly bool) {
+	key, _ := hex.DecodeString(v.key)
+	iv, _ := hex.DecodeString(v.iv)
+	plaintext, _ := hex.DecodeString(v.plaintext)
+	ciphertext, _ := hex.DecodeString(v.ciphertext)
+
+	method, err := NewMethodInstance(v.method, string(key), string(iv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decryptOnly {
+		dst, err := method.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dst, ciphertext) {
+			t.Fatalf("encrypt\nhave %x\nwant %x", dst, ciphertext)
+		}
+	}
+	if v.method == "gm-sm3-sum" {
+		return
+	}
+	src, err := method.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, plaintext) {
+		t.Fatalf("decrypt\nhave %x\nwant %x", src, plaintext)
+	}
+}
+
+// 所有注册的加密方式均需有测试向量及ID
+func TestConformance_Coverage(t *testing.T) {
+	covered := map[string]bool{}
+	for _, v := range conformanceVectors {
+		covered[v.method] = true
+	}
+	ids := map[string]bool{}
+	for _, method := range methodIds {
+		ids[method] = true
+	}
+	for method := range methods {
+		if !covered[method] {
+			t.Errorf("method %s has no conformance vector", method)
+		}
+		if !ids[method] {
+			t.Errorf("method %s has no registered id", method)
+		}
+	}
+}
+
+func TestConformance_RoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 7, 15, 16, 17, 31, 33, 60, 64, 100, 1000, 4099}
+	for method := range methods {
+		t.Run(method, func(t *testing.T) {
+			instance := randomMethodInstance(t, method)
+			for _, size := range sizes {
+				src := make([]byte, size)
+				if _, err := rand.Read(src); err != nil {
+					t.Fatal(err)
+				}
+				dst, err := instance.Encrypt(src)
+				if err != nil {
+					t.Fatal(size, err)
+				}
+				if method == "gm-sm3-sum" {
+					if size > 0 && !bytes.Equal(dst, sm3Sum(src)) {
+						t.Fatalf("%d: digest mismatch", size)
+					}
+					continue
+				}
+				got, err := instance.Decrypt(dst)
+				if err != nil {
+					t.Fatal(size, err)
+				}
+				if !bytes.Equal(got, src) {
+					t.Fatalf("%d: round trip mismatch", size)
+				}
+			}
+		})
+	}
+}
+
+func randomMethodInstance(t *testing.T, method string) MethodInterface {
+	key := make([]byte, 32)
+	iv := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+	if method == "gm-sm2-ecc" {
+		pri, pub, err := sm2.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, iv = pri.GetRawBytes(), pub.GetRawBytes()
+	}
+	instance, err := NewMethodInstance(method, string(key), string(iv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func sm3Sum(data []byte) []byte {
+	sum := sm3.Sum(data)
+	return sum[:]
+}
+
+// 测试向量文件格式
+type vectorFile struct {
+	Version int           `json:"version"`
+	Note    string        `json:"note"`
+	Vectors []*fileVector `json:"vectors"`
+}
+
+type fileVector struct {
+	Method      string `json:"method"`
+	ID          uint8  `json:"id"`
+	Source      string `json:"source"`
+	DecryptOnly bool   `json:"decrypt_only,omitempty"`
+	Key         string `json:"key"`
+	IV          string `json:"iv"`
+	Plaintext   string `json:"plaintext"`
+	Ciphertext  string `json:"ciphertext"`
+}
+
+func buildVectorFile(t *testing.T) *vectorFile {
+	ids := map[string]uint8{}
+	for id, method := range methodIds {
+		ids[method] = id
+	}
+	file := &vectorFile{
+		Version: vectorFileVersion,
+		Note:    "all values are hex encoded; key and iv are used as-is, shorter values are right padded with 0x20 by the go implementation; ctr/ofb, sm4 cfb and chacha20 ciphertexts start with a random iv (nonce) generated per packet",
+	}
+	for _, v := range conformanceVectors {
+		id, ok := ids[v.method]
+		if !ok {
+			t.Fatalf("method %s has no registered id", v.method)
+		}
+		file.Vectors = append(file.Vectors, &fileVector{
+			Method:      v.method,
+			ID:          id,
+			Source:      v.source,
+			DecryptOnly: v.decryptOnly,
+			Key:         v.key,
+			IV:          v.iv,
+			Plaintext:   v.plaintext,
+			Ciphertext:  v.ciphertext,
+		})
+	}
+	sort.SliceStable(file.Vectors, func(i, j int) bool {
+		return file.Vectors[i].ID < file.Vectors[j].ID
+	})
+	return file
+}
+
+func TestConformance_VectorFile(t *testing.T) {
+	want, err := json.MarshalIndent(buildVectorFile(t), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, '\n')
+	path := filepath.FromSlash(vectorFilePath)
+	if *updateVectors {
+		if err := ioutil.WriteFile(path, want, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("%s is out of date, run go test ./encrypt -run TestConformance_VectorFile -update", vectorFilePath)
+	}
+
+	//文件中的向量同样需要通过校验
+	file := &vectorFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Version != vectorFileVersion {
+		t.Fatalf("unexpected vector file version %d", file.Version)
+	}
+	for _, v := range file.Vectors {
+		name, ok := MethodName(v.ID)
+		if !ok || name != v.Method {
+			t.Fatalf("vector id %d does not match method %s", v.ID, v.Method)
+		}
+		checkConformanceVector(t, methodVector{v.Method, v.Key, v.IV, v.Plaintext, v.Ciphertext}, v.DecryptOnly)
+	}
+}
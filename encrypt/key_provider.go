@@ -0,0 +1,212 @@
+package encrypt
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyEmpty          = errors.New("key is empty")
+	ErrMagicKeyInUse     = errors.New("the built-in magic key must not be used outside test mode")
+	ErrKeyFilePermission = errors.New("key file must not be accessible by group or others")
+)
+
+// KeyProvider 密钥来源接口
+type KeyProvider interface {
+	// 加载密钥
+	Keys() ([]*Key, error)
+}
+
+// NewKeyProvider 根据字面值创建密钥来源，测试模式下未设置key时使用内置 MagicKey
+func NewKeyProvider(key, iv string, test bool) KeyProvider {
+	if key == "" && test {
+		return &LiteralKeyProvider{Key: MagicKey, IV: MagicKey[:16]}
+	}
+	return &LiteralKeyProvider{Key: key, IV: iv}
+}
+
+// LoadKeySet 从密钥来源加载密钥集合，非测试模式下拒绝使用内置 MagicKey
+func LoadKeySet(provider KeyProvider, test bool) (*KeySet, error) {
+	keys, err := provider.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := CheckMagicKey(key, test); err != nil {
+			return nil, err
+		}
+	}
+	return NewKeySet(keys...)
+}
+
+// CheckMagicKey 检测是否在非测试模式下使用了内置 MagicKey
+func CheckMagicKey(key *Key, test bool) error {
+	if !test && string(key.Key) == MagicKey {
+		return ErrMagicKeyInUse
+	}
+	return nil
+}
+
+// LiteralKeyProvider 直接给定的密钥，值支持 hex:/base64: 前缀
+type LiteralKeyProvider struct {
+	ID  uint32
+	Key string
+	IV  string
+}
+
+func (this *LiteralKeyProvider) Keys() ([]*Key, error) {
+	key, err := newKey(this.ID, this.Key, this.IV)
+	if err != nil {
+		return nil, err
+	}
+	return []*Key{key}, nil
+}
+
+// EnvKeyProvider 从环境变量读取密钥，值支持 hex:/base64: 前缀
+type EnvKeyProvider struct {
+	ID uint32
+	//key所在环境变量
+	KeyEnv string
+	//iv所在环境变量
+	IVEnv string
+}
+
+func (this *EnvKeyProvider) Keys() ([]*Key, error) {
+	value, ok := os.LookupEnv(this.KeyEnv)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", this.KeyEnv)
+	}
+	iv := ""
+	if this.IVEnv != "" {
+		iv = os.Getenv(this.IVEnv)
+	}
+	key, err := newKey(this.ID, value, iv)
+	if err != nil {
+		return nil, fmt.Errorf("environment variable %s: %w", this.KeyEnv, err)
+	}
+	return []*Key{key}, nil
+}
+
+// FileKeyProvider 从JSON密钥文件读取密钥，文件不得被组或其他用户访问
+//
+//	{"keys":[{"id":1,"key":"hex:...","iv":"...","not_before":"2022-11-01T00:00:00Z","not_after":""}]}
+type FileKeyProvider struct {
+	Path string
+}
+
+func (this *FileKeyProvider) Keys() ([]*Key, error) {
+	data, err := readKeyFile(this.Path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKeyFile(data)
+}
+
+// 密钥文件格式
+type keyFile struct {
+	Keys []*keyFileEntry `json:"keys"`
+}
+
+type keyFileEntry struct {
+	ID        uint32 `json:"id"`
+	Key       string `json:"key"`
+	IV        string `json:"iv"`
+	NotBefore string `json:"not_before,omitempty"`
+	NotAfter  string `json:"not_after,omitempty"`
+}
+
+// 读取密钥文件并检查权限
+func readKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%w: %s has mode %04o", ErrKeyFilePermission, path, info.Mode().Perm())
+	}
+	return ioutil.ReadFile(path)
+}
+
+func decodeKeyFile(data []byte) ([]*Key, error) {
+	file := &keyFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, errors.New("decode key file failed:" + err.Error())
+	}
+	if len(file.Keys) == 0 {
+		return nil, errors.New("key file contains no keys")
+	}
+	keys := make([]*Key, 0, len(file.Keys))
+	for _, entry := range file.Keys {
+		key, err := newKey(entry.ID, entry.Key, entry.IV)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", entry.ID, err)
+		}
+		if key.NotBefore, err = parseKeyTime(entry.NotBefore); err != nil {
+			return nil, fmt.Errorf("key %d not_before: %w", entry.ID, err)
+		}
+		if key.NotAfter, err = parseKeyTime(entry.NotAfter); err != nil {
+			return nil, fmt.Errorf("key %d not_after: %w", entry.ID, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func encodeKeyFile(keys []*Key) ([]byte, error) {
+	file := &keyFile{}
+	for _, key := range keys {
+		entry := &keyFileEntry{
+			ID:  key.ID,
+			Key: "base64:" + base64.StdEncoding.EncodeToString(key.Key),
+			IV:  "base64:" + base64.StdEncoding.EncodeToString(key.IV),
+		}
+		if !key.NotBefore.IsZero() {
+			entry.NotBefore = key.NotBefore.Format(time.RFC3339)
+		}
+		if !key.NotAfter.IsZero() {
+			entry.NotAfter = key.NotAfter.Format(time.RFC3339)
+		}
+		file.Keys = append(file.Keys, entry)
+	}
+	return json.Marshal(file)
+}
+
+func newKey(id uint32, key, iv string) (*Key, error) {
+	if key == "" {
+		return nil, ErrKeyEmpty
+	}
+	k, err := decodeKeyValue(key)
+	if err != nil {
+		return nil, err
+	}
+	i, err := decodeKeyValue(iv)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{ID: id, Key: k, IV: i}, nil
+}
+
+// 解析密钥值，支持 hex:/base64: 前缀，无前缀时按原始字符串处理
+func decodeKeyValue(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, "hex:"):
+		return hex.DecodeString(strings.TrimPrefix(value, "hex:"))
+	case strings.HasPrefix(value, "base64:"):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:"))
+	}
+	return []byte(value), nil
+}
+
+func parseKeyTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,114 @@
+package encrypt
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadKeySet_MagicKey(t *testing.T) {
+	if _, err := LoadKeySet(NewKeyProvider("", "", false), false); err != ErrKeyEmpty {
+		t.Fatal("expect ErrKeyEmpty, got", err)
+	}
+	if _, err := LoadKeySet(NewKeyProvider("", "", true), false); err != ErrMagicKeyInUse {
+		t.Fatal("expect ErrMagicKeyInUse, got", err)
+	}
+	if _, err := LoadKeySet(NewKeyProvider("", "", true), true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnvKeyProvider_Keys(t *testing.T) {
+	os.Setenv("LIBSPA_TEST_KEY", "hex:00112233")
+	os.Setenv("LIBSPA_TEST_IV", "base64:AAEC")
+	defer os.Unsetenv("LIBSPA_TEST_KEY")
+	defer os.Unsetenv("LIBSPA_TEST_IV")
+
+	keys, err := (&EnvKeyProvider{ID: 3, KeyEnv: "LIBSPA_TEST_KEY", IVEnv: "LIBSPA_TEST_IV"}).Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].ID != 3 || string(keys[0].Key) != "\x00\x11\x22\x33" || string(keys[0].IV) != "\x00\x01\x02" {
+		t.Fatalf("unexpected key %+v", keys[0])
+	}
+	if _, err := (&EnvKeyProvider{KeyEnv: "LIBSPA_TEST_MISSING"}).Keys(); err == nil {
+		t.Fatal("expect error for missing environment variable")
+	}
+}
+
+func TestFileKeyProvider_Permission(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data := []byte(`{"keys":[{"id":1,"key":"abc","iv":"123","not_after":"2030-01-01T00:00:00Z"}]}`)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&FileKeyProvider{Path: path}).Keys(); !errors.Is(err, ErrKeyFilePermission) {
+		t.Fatal("expect ErrKeyFilePermission, got", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := (&FileKeyProvider{Path: path}).Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].ID != 1 || string(keys[0].Key) != "abc" || !keys[0].NotAfter.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected key %+v", keys[0])
+	}
+}
+
+func TestKeystoreKeyProvider_Keys(t *testing.T) {
+	keystoreScryptN = 1 << 10
+	defer func() { keystoreScryptN = 1 << 15 }()
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	err := WriteKeystore(path, []byte("passphrase"), []*Key{
+		{ID: 1, Key: []byte{0, 1, 2, 3}, IV: []byte("iv"), NotBefore: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: 2, Key: []byte("second")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := (&KeystoreKeyProvider{Path: path, Passphrase: []byte("passphrase")}).Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys[0].Key) != "\x00\x01\x02\x03" || string(keys[1].Key) != "second" || keys[0].NotBefore.Year() != 2022 {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	if _, err := (&KeystoreKeyProvider{Path: path, Passphrase: []byte("wrong")}).Keys(); err != ErrKeystorePassphrase {
+		t.Fatal("expect ErrKeystorePassphrase, got", err)
+	}
+}
+
+// 被篡改的scrypt参数在派生密钥前被拒绝
+func TestKeystore_ScryptParams(t *testing.T) {
+	keystoreScryptN = 1 << 10
+	defer func() { keystoreScryptN = 1 << 15 }()
+
+	data, err := sealKeystore([]byte("{}"), []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, params := range [][3]int{{1 << 30, 8, 1}, {1 << 20, 8, 1}, {1 << 15, 1 << 20, 1}, {1 << 15, 8, 1 << 20}, {1000, 8, 1}, {0, 8, 1}, {1 << 15, 0, 1}} {
+		file := &keystoreFile{}
+		if err := json.Unmarshal(data, file); err != nil {
+			t.Fatal(err)
+		}
+		file.N, file.R, file.P = params[0], params[1], params[2]
+		tampered, err := json.Marshal(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openKeystore(tampered, []byte("passphrase")); err != ErrKeystoreParams {
+			t.Fatal(params, "expect ErrKeystoreParams, got", err)
+		}
+	}
+	if _, err := openKeystore(data, []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+}
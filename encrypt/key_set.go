@@ -0,0 +1,227 @@
+package encrypt
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrKeyInvalid  = errors.New("key is not valid at this time")
+	ErrKeyExists   = errors.New("key id already exists")
+	ErrNoValidKey  = errors.New("no valid key")
+)
+
+// Key 带有ID及有效期的密钥
+type Key struct {
+	//密钥ID，随报文头部发送
+	ID uint32
+	//加密key
+	Key []byte
+	//加密iv
+	IV []byte
+	//生效时间，零值表示不限制
+	NotBefore time.Time
+	//失效时间，零值表示不限制
+	NotAfter time.Time
+}
+
+// Valid 判断密钥在指定时间是否有效
+func (k *Key) Valid(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// KeySet 密钥集合，支持在运行中添加或停用密钥
+// 集合中的 Key 视为只读，修改时整体替换
+type KeySet struct {
+	locker  sync.RWMutex
+	keys    map[uint32]*Key
+	methods map[methodCacheKey]MethodInterface
+}
+
+// 已初始化的加密方式实例缓存键
+type methodCacheKey struct {
+	keyId  uint32
+	method uint8
+}
+
+// NewKeySet 创建密钥集合
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+	s := &KeySet{keys: map[uint32]*Key{}, methods: map[methodCacheKey]MethodInterface{}}
+	for _, key := range keys {
+		if err := s.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Add 添加密钥
+func (s *KeySet) Add(key *Key) error {
+	if key == nil {
+		return errors.New("key is nil")
+	}
+	if !key.NotBefore.IsZero() && !key.NotAfter.IsZero() && !key.NotAfter.After(key.NotBefore) {
+		return errors.New("key not after must be later than not before")
+	}
+	k := *key
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if _, ok := s.keys[k.ID]; ok {
+		return ErrKeyExists
+	}
+	s.keys[k.ID] = &k
+	return nil
+}
+
+// Retire 在指定时间停用密钥，at 之前新旧密钥同时有效
+func (s *KeySet) Retire(id uint32, at time.Time) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	k := *key
+	k.NotAfter = at
+	s.keys[id] = &k
+	return nil
+}
+
+// Replace 使用给定的密钥替换集合中的所有密钥，用于重新加载密钥配置
+// 校验失败时不修改集合，未变化的密钥保留已缓存的加密方式实例
+func (s *KeySet) Replace(keys ...*Key) error {
+	next, err := NewKeySet(keys...)
+	if err != nil {
+		return err
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for k := range s.methods {
+		old, key := s.keys[k.keyId], next.keys[k.keyId]
+		if old == nil || key == nil || !bytes.Equal(old.Key, key.Key) || !bytes.Equal(old.IV, key.IV) {
+			delete(s.methods, k)
+		}
+	}
+	s.keys = next.keys
+	return nil
+}
+
+// Remove 删除密钥
+func (s *KeySet) Remove(id uint32) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if _, ok := s.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	delete(s.keys, id)
+	for k := range s.methods {
+		if k.keyId == id {
+			delete(s.methods, k)
+		}
+	}
+	return nil
+}
+
+// Method 获取使用指定时间有效的密钥初始化的加密方式实例
+// 实例按密钥ID及加密方式缓存并在所有goroutine间共享
+func (s *KeySet) Method(id uint32, method uint8, t time.Time) (MethodInterface, error) {
+	key, err := s.Get(id, t)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := methodCacheKey{keyId: id, method: method}
+	s.locker.RLock()
+	instance, ok := s.methods[cacheKey]
+	s.locker.RUnlock()
+	if ok {
+		return instance, nil
+	}
+
+	name, ok := MethodName(method)
+	if !ok {
+		return nil, errors.New("method id is not registered")
+	}
+	instance, err = NewMethod(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := instance.Init(key.Key, key.IV); err != nil {
+		return nil, err
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	//密钥在初始化期间被删除或被 Replace 替换时不缓存，避免缓存旧密钥的实例
+	if s.keys[id] == key {
+		s.methods[cacheKey] = instance
+	}
+	return instance, nil
+}
+
+// Get 获取指定时间有效的密钥
+func (s *KeySet) Get(id uint32, t time.Time) (*Key, error) {
+	s.locker.RLock()
+	key, ok := s.keys[id]
+	s.locker.RUnlock()
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if !key.Valid(t) {
+		return nil, ErrKeyInvalid
+	}
+	return key, nil
+}
+
+// Lookup 获取密钥，不校验有效期
+func (s *KeySet) Lookup(id uint32) (*Key, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// Newest 获取指定时间有效且生效时间最晚的密钥，生效时间相同时取ID最大者
+func (s *KeySet) Newest(t time.Time) (*Key, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	var newest *Key
+	for _, key := range s.keys {
+		if !key.Valid(t) {
+			continue
+		}
+		if newest == nil || key.NotBefore.After(newest.NotBefore) ||
+			key.NotBefore.Equal(newest.NotBefore) && key.ID > newest.ID {
+			newest = key
+		}
+	}
+	if newest == nil {
+		return nil, ErrNoValidKey
+	}
+	return newest, nil
+}
+
+// Keys 按ID顺序返回所有密钥
+func (s *KeySet) Keys() []*Key {
+	s.locker.RLock()
+	keys := make([]*Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	s.locker.RUnlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
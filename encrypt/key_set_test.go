@@ -0,0 +1,87 @@
+package encrypt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeySet_Newest(t *testing.T) {
+	now := time.Now()
+	keys, err := NewKeySet(
+		&Key{ID: 1, Key: []byte("old"), NotAfter: now.Add(time.Hour)},
+		&Key{ID: 2, Key: []byte("new"), NotBefore: now.Add(-time.Minute)},
+		&Key{ID: 3, Key: []byte("future"), NotBefore: now.Add(time.Hour)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.Newest(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != 2 {
+		t.Fatal("newest key should be 2, got", key.ID)
+	}
+	key, err = keys.Newest(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != 3 {
+		t.Fatal("newest key should be 3, got", key.ID)
+	}
+}
+
+func TestKeySet_Retire(t *testing.T) {
+	now := time.Now()
+	keys, err := NewKeySet(&Key{ID: 1}, &Key{ID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Add(&Key{ID: 1}); err != ErrKeyExists {
+		t.Fatal("expect ErrKeyExists, got", err)
+	}
+	if err := keys.Retire(1, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Get(1, now); err != nil {
+		t.Fatal("key 1 should still be valid in the overlap window:", err)
+	}
+	if _, err := keys.Get(1, now.Add(time.Minute)); err != ErrKeyInvalid {
+		t.Fatal("expect ErrKeyInvalid, got", err)
+	}
+	if _, err := keys.Get(4, now); err != ErrKeyNotFound {
+		t.Fatal("expect ErrKeyNotFound, got", err)
+	}
+	if err := keys.Retire(4, now); err != ErrKeyNotFound {
+		t.Fatal("expect ErrKeyNotFound, got", err)
+	}
+}
+
+func TestKeySet_Replace(t *testing.T) {
+	keys, err := NewKeySet(&Key{ID: 1, Key: []byte("first-key"), IV: []byte("first-iv")}, &Key{ID: 2, Key: []byte("second-key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	first, err := keys.Method(1, encryptMethodAES256CFB, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//校验失败时不修改集合
+	if err := keys.Replace(&Key{ID: 3, NotBefore: now, NotAfter: now}); err == nil {
+		t.Fatal("expect invalid key error")
+	}
+	if err := keys.Replace(&Key{ID: 1, Key: []byte("first-key"), IV: []byte("first-iv")}, &Key{ID: 3, Key: []byte("third-key")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Lookup(2); err != ErrKeyNotFound {
+		t.Fatal("key 2 should be removed", err)
+	}
+	if _, err := keys.Lookup(3); err != nil {
+		t.Fatal(err)
+	}
+	//未变化的密钥保留缓存的实例
+	if method, err := keys.Method(1, encryptMethodAES256CFB, now); err != nil || method != first {
+		t.Fatal("unchanged key should keep cached method", err)
+	}
+}
@@ -0,0 +1,160 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+)
+
+const (
+	keystoreVersion = 1
+	keystoreKDF     = "scrypt"
+	keystoreCipher  = "aes-256-gcm"
+)
+
+var (
+	ErrKeystorePassphrase = errors.New("keystore passphrase is wrong or keystore is corrupted")
+	ErrKeystoreParams     = errors.New("keystore scrypt parameters are out of range")
+)
+
+// 默认scrypt参数
+var (
+	keystoreScryptN = 1 << 15
+	keystoreScryptR = 8
+	keystoreScryptP = 1
+)
+
+// 读取密钥库时允许的scrypt参数上限，防止被篡改的文件占用大量内存或CPU
+const (
+	//scrypt 占用内存 128*N*r 字节
+	keystoreMaxScryptMemory = 256 << 20
+	keystoreMaxScryptP      = 16
+)
+
+// KeystoreKeyProvider 从口令加密的密钥库文件读取密钥
+// 密钥库使用scrypt派生密钥，AES-256-GCM加密JSON密钥文件内容
+type KeystoreKeyProvider struct {
+	Path       string
+	Passphrase []byte
+}
+
+func (this *KeystoreKeyProvider) Keys() ([]*Key, error) {
+	data, err := readKeyFile(this.Path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := openKeystore(data, this.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKeyFile(plain)
+}
+
+// WriteKeystore 将密钥加密写入密钥库文件，文件权限为0600
+func WriteKeystore(path string, passphrase []byte, keys []*Key) error {
+	plain, err := encodeKeyFile(keys)
+	if err != nil {
+		return err
+	}
+	data, err := sealKeystore(plain, passphrase)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// 密钥库文件格式
+type keystoreFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Cipher  string `json:"cipher"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+func sealKeystore(plain, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("keystore passphrase is empty")
+	}
+	file := &keystoreFile{
+		Version: keystoreVersion,
+		KDF:     keystoreKDF,
+		N:       keystoreScryptN,
+		R:       keystoreScryptR,
+		P:       keystoreScryptP,
+		Salt:    make([]byte, 16),
+		Cipher:  keystoreCipher,
+	}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := file.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return nil, err
+	}
+	file.Data = aead.Seal(nil, file.Nonce, plain, file.additionalData())
+	return json.MarshalIndent(file, "", "  ")
+}
+
+func openKeystore(data, passphrase []byte) ([]byte, error) {
+	file := &keystoreFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, errors.New("decode keystore failed:" + err.Error())
+	}
+	if file.Version != keystoreVersion || file.KDF != keystoreKDF || file.Cipher != keystoreCipher {
+		return nil, fmt.Errorf("unsupported keystore version %d (%s/%s)", file.Version, file.KDF, file.Cipher)
+	}
+	if !file.validParams() {
+		return nil, ErrKeystoreParams
+	}
+	aead, err := file.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, ErrKeystorePassphrase
+	}
+	plain, err := aead.Open(nil, file.Nonce, file.Data, file.additionalData())
+	if err != nil {
+		return nil, ErrKeystorePassphrase
+	}
+	return plain, nil
+}
+
+// scrypt 参数是否在允许的范围内，N 须为大于1的2的幂
+func (this *keystoreFile) validParams() bool {
+	if this.N <= 1 || this.N&(this.N-1) != 0 || this.R <= 0 || this.P <= 0 || this.P > keystoreMaxScryptP {
+		return false
+	}
+	return int64(this.N) <= keystoreMaxScryptMemory/128/int64(this.R)
+}
+
+func (this *keystoreFile) aead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, this.Salt, this.N, this.R, this.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 将格式参数作为附加数据，防止被篡改
+func (this *keystoreFile) additionalData() []byte {
+	return []byte(fmt.Sprintf("libspa-keystore:%d:%s:%d:%d:%d:%s", this.Version, this.KDF, this.N, this.R, this.P, this.Cipher))
+}
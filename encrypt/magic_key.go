@@ -5,6 +5,8 @@ const (
 )
 
 // 加密特殊信息
+//
+// Deprecated: MagicKey 为公开常量且出错时返回原文，请使用 Sealer
 func MagicKeyEncode(data []byte) []byte {
 	method, err := NewMethodInstance("aes-256-cfb", MagicKey, MagicKey[:16])
 	if err != nil {
@@ -19,15 +21,22 @@ func MagicKeyEncode(data []byte) []byte {
 }
 
 // 解密特殊信息
+//
+// Deprecated: MagicKey 为公开常量且出错时返回原文，请使用 Sealer
 func MagicKeyDecode(data []byte) []byte {
-	method, err := NewMethodInstance("aes-256-cfb", MagicKey, MagicKey[:16])
+	src, err := MagicKeyOpen(data)
 	if err != nil {
 		return data
 	}
+	return src
+}
 
-	src, err := method.Decrypt(data)
+// MagicKeyOpen 解密 MagicKeyEncode 生成的旧格式数据，出错时返回错误
+// 旧格式不带认证信息，无法识别错误的输入，仅用于迁移至 Sealer
+func MagicKeyOpen(data []byte) ([]byte, error) {
+	method, err := NewMethodInstance("aes-256-cfb", MagicKey, MagicKey[:16])
 	if err != nil {
-		return data
+		return nil, err
 	}
-	return src
+	return method.Decrypt(data)
 }
@@ -8,4 +8,7 @@ func TestMagicKeyEncode(t *testing.T) {
 
 	src := MagicKeyDecode(dst)
 	t.Log("src:", string(src))
+	if string(src) != "Hello,World" {
+		t.Fatal("magic key round trip mismatch")
+	}
 }
@@ -8,8 +8,23 @@ const (
 	encryptMethodGMSM2ECC
 	encryptMethodGMSM3SUM
 	encryptMethodGMSM4CBC
+	encryptMethodAES128CTR
+	encryptMethodAES192CTR
+	encryptMethodAES256CTR
+	encryptMethodAES128OFB
+	encryptMethodAES192OFB
+	encryptMethodAES256OFB
+	encryptMethodGMSM4CTR
+	encryptMethodGMSM4CFB
+	encryptMethodGMSM4OFB
+	encryptMethodChaCha20
+	encryptMethodXChaCha20
 )
 
+// MethodInterface 加密方式接口
+//
+// 实现在 Init 之后不可再修改内部状态，Encrypt/Decrypt 每次调用都创建新的流或分组模式对象，
+// 且不修改传入的切片，因此同一实例可被多个goroutine并发使用。
 type MethodInterface interface {
 	// 初始化
 	Init(key []byte, iv []byte) error
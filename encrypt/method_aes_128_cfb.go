@@ -1,7 +1,6 @@
 package encrypt
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 )
@@ -13,20 +12,10 @@ type AES128CFBMethod struct {
 
 func (this *AES128CFBMethod) Init(key, iv []byte) error {
 	// 判断key是否为32长度
-	l := len(key)
-	if l > 16 {
-		key = key[:16]
-	} else if l < 16 {
-		key = append(key, bytes.Repeat([]byte{' '}, 16-l)...)
-	}
+	key = fitSize(key, 16)
 
 	// 判断iv长度
-	l2 := len(iv)
-	if l2 > aes.BlockSize {
-		iv = iv[:aes.BlockSize]
-	} else if l2 < aes.BlockSize {
-		iv = append(iv, bytes.Repeat([]byte{' '}, aes.BlockSize-l2)...)
-	}
+	iv = fitSize(iv, aes.BlockSize)
 
 	this.iv = iv
 
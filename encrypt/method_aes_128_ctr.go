@@ -0,0 +1,37 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// AES128CTRMethod AES-128-CTR 流加密，每次加密使用随机IV并置于密文前，Init 的 iv 不使用
+type AES128CTRMethod struct {
+	block cipher.Block
+}
+
+func (this *AES128CTRMethod) Init(key, iv []byte) error {
+	// 判断key是否为16长度
+	block, err := aes.NewCipher(fitSize(key, 16))
+	if err != nil {
+		return err
+	}
+	this.block = block
+	return nil
+}
+
+func (this *AES128CTRMethod) Encrypt(src []byte) (dst []byte, err error) {
+	return sealStream(src, aes.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCTR(this.block, iv), nil
+	})
+}
+
+func (this *AES128CTRMethod) Decrypt(dst []byte) (src []byte, err error) {
+	return openStream(dst, aes.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCTR(this.block, iv), nil
+	})
+}
+
+func (this *AES128CTRMethod) Method() uint8 {
+	return encryptMethodAES128CTR
+}
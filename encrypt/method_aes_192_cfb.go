@@ -1,7 +1,6 @@
 package encrypt
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 )
@@ -13,12 +12,7 @@ type AES192CFBMethod struct {
 
 func (this *AES192CFBMethod) Init(key, iv []byte) error {
 	// 判断key是否为24长度
-	l := len(key)
-	if l > 24 {
-		key = key[:24]
-	} else if l < 24 {
-		key = append(key, bytes.Repeat([]byte{' '}, 24-l)...)
-	}
+	key = fitSize(key, 24)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -27,12 +21,7 @@ func (this *AES192CFBMethod) Init(key, iv []byte) error {
 	this.block = block
 
 	// 判断iv长度
-	l2 := len(iv)
-	if l2 > aes.BlockSize {
-		iv = iv[:aes.BlockSize]
-	} else if l2 < aes.BlockSize {
-		iv = append(iv, bytes.Repeat([]byte{' '}, aes.BlockSize-l2)...)
-	}
+	iv = fitSize(iv, aes.BlockSize)
 
 	this.iv = iv
 
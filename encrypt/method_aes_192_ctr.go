@@ -0,0 +1,37 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// AES192CTRMethod AES-192-CTR 流加密，每次加密使用随机IV并置于密文前，Init 的 iv 不使用
+type AES192CTRMethod struct {
+	block cipher.Block
+}
+
+func (this *AES192CTRMethod) Init(key, iv []byte) error {
+	// 判断key是否为24长度
+	block, err := aes.NewCipher(fitSize(key, 24))
+	if err != nil {
+		return err
+	}
+	this.block = block
+	return nil
+}
+
+func (this *AES192CTRMethod) Encrypt(src []byte) (dst []byte, err error) {
+	return sealStream(src, aes.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCTR(this.block, iv), nil
+	})
+}
+
+func (this *AES192CTRMethod) Decrypt(dst []byte) (src []byte, err error) {
+	return openStream(dst, aes.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCTR(this.block, iv), nil
+	})
+}
+
+func (this *AES192CTRMethod) Method() uint8 {
+	return encryptMethodAES192CTR
+}
@@ -1,7 +1,6 @@
 package encrypt
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 )
@@ -13,12 +12,7 @@ type AES256CFBMethod struct {
 
 func (this *AES256CFBMethod) Init(key, iv []byte) error {
 	// 判断key是否为32长度
-	l := len(key)
-	if l > 32 {
-		key = key[:32]
-	} else if l < 32 {
-		key = append(key, bytes.Repeat([]byte{' '}, 32-l)...)
-	}
+	key = fitSize(key, 32)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -27,12 +21,7 @@ func (this *AES256CFBMethod) Init(key, iv []byte) error {
 	this.block = block
 
 	// 判断iv长度
-	l2 := len(iv)
-	if l2 > aes.BlockSize {
-		iv = iv[:aes.BlockSize]
-	} else if l2 < aes.BlockSize {
-		iv = append(iv, bytes.Repeat([]byte{' '}, aes.BlockSize-l2)...)
-	}
+	iv = fitSize(iv, aes.BlockSize)
 	this.iv = iv
 
 	return nil
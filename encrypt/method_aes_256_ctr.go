@@ -0,0 +1,37 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// AES256CTRMethod AES-256-CTR 流加密，每次加密使用随机IV并置于密文前，Init 的 iv 不使用
+type AES256CTRMethod struct {
+	block cipher.Block
+}
+
+func (this *AES256CTRMethod) Init(key, iv []byte) error {
+	// 判断key是否为32长度
+	block, err := aes.NewCipher(fitSize(key, 32))
+	if err != nil {
+		return err
+	}
+	this.block = block
+	return nil
+}
+
+func (this *AES256CTRMethod) Encrypt(src []byte) (dst []byte, err error) {
+	return sealStream(src, aes.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCTR(this.block, iv), nil
+	})
+}
+
+func (this *AES256CTRMethod) Decrypt(dst []byte) (src []byte, err error) {
+	return openStream(dst, aes.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCTR(this.block, iv), nil
+	})
+}
+
+func (this *AES256CTRMethod) Method() uint8 {
+	return encryptMethodAES256CTR
+}
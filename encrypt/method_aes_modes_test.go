@@ -0,0 +1,121 @@
+package encrypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// NIST SP 800-38A F.1-F.5 公共参数
+const (
+	nistKey128    = "2b7e151628aed2a6abf7158809cf4f3c"
+	nistKey192    = "8e73b0f7da0e6452c810f32b809079e562f8ead2522c6b7b"
+	nistKey256    = "603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4"
+	nistIV        = "000102030405060708090a0b0c0d0e0f"
+	nistCounter   = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+	nistPlaintext = "6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710"
+)
+
+type methodVector struct {
+	method     string
+	key        string
+	iv         string
+	plaintext  string
+	ciphertext string
+}
+
+// NIST SP 800-38A F.4 (OFB) 及 F.5 (CTR)
+var aesModeVectors = []methodVector{
+	{"aes-128-ctr", nistKey128, nistCounter, nistPlaintext, "874d6191b620e3261bef6864990db6ce9806f66b7970fdff8617187bb9fffdff5ae4df3edbd5d35e5b4f09020db03eab1e031dda2fbe03d1792170a0f3009cee"},
+	{"aes-192-ctr", nistKey192, nistCounter, nistPlaintext, "1abc932417521ca24f2b0459fe7e6e0b090339ec0aa6faefd5ccc2c6f4ce8e941e36b26bd1ebc670d1bd1d665620abf74f78a7f6d29809585a97daec58c6b050"},
+	{"aes-256-ctr", nistKey256, nistCounter, nistPlaintext, "601ec313775789a5b7a7f504bbf3d228f443e3ca4d62b59aca84e990cacaf5c52b0930daa23de94ce87017ba2d84988ddfc9c58db67aada613c2dd08457941a6"},
+	{"aes-128-ofb", nistKey128, nistIV, nistPlaintext, "3b3fd92eb72dad20333449f8e83cfb4a7789508d16918f03f53c52dac54ed8259740051e9c5fecf64344f7a82260edcc304c6528f659c77866a510d9c1d6ae5e"},
+	{"aes-192-ofb", nistKey192, nistIV, nistPlaintext, "cdc80d6fddf18cab34c25909c99a4174fcc28b8d4c63837c09e81700c11004018d9a9aeac0f6596f559c6d4daf59a5f26d9f200857ca6c3e9cac524bd9acc92a"},
+	{"aes-256-ofb", nistKey256, nistIV, nistPlaintext, "dc7e84bfda79164b7ecd8486985d38604febdc6740d20b3ac88f6ad82a4fb08d71ab47a086e86eedf39d1c5bba97c4080126141d67f37be8538f5a8be740e484"},
+}
+
+func TestAESModes_KnownAnswer(t *testing.T) {
+	testMethodVectors(t, aesModeVectors)
+}
+
+// 按向量校验加密结果，向量中的iv为置于密文前的随机IV，并对截断的输入校验流模式的前缀一致性
+func testMethodVectors(t *testing.T, vectors []methodVector) {
+	for _, v := range vectors {
+		key, _ := hex.DecodeString(v.key)
+		iv, _ := hex.DecodeString(v.iv)
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		ciphertext, _ := hex.DecodeString(v.ciphertext)
+
+		method, err := NewMethodInstance(v.method, string(key), "")
+		if err != nil {
+			t.Fatal(v.method, err)
+		}
+		for _, n := range []int{len(plaintext), len(plaintext) - 5, 1} {
+			want := append(append([]byte{}, iv...), ciphertext[:n]...)
+			var dst []byte
+			withRandReader(iv, func() {
+				dst, err = method.Encrypt(plaintext[:n])
+			})
+			if err != nil {
+				t.Fatal(v.method, err)
+			}
+			if !bytes.Equal(dst, want) {
+				t.Fatalf("%s/%d: encrypt\nhave %x\nwant %x", v.method, n, dst, want)
+			}
+			src, err := method.Decrypt(want)
+			if err != nil {
+				t.Fatal(v.method, err)
+			}
+			if !bytes.Equal(src, plaintext[:n]) {
+				t.Fatalf("%s/%d: decrypt\nhave %x\nwant %x", v.method, n, src, plaintext[:n])
+			}
+		}
+	}
+}
+
+// 使用固定的随机IV执行 fn
+func withRandReader(iv []byte, fn func()) {
+	reader := randReader
+	randReader = bytes.NewReader(iv)
+	defer func() {
+		randReader = reader
+	}()
+	fn()
+}
+
+// 流加密模式每次加密使用不同的IV，相同明文的密文不同
+func TestStreamModes_RandomIV(t *testing.T) {
+	for method := range randomIVMethods {
+		instance := randomMethodInstance(t, method)
+		src := []byte("same plaintext")
+		a, err := instance.Encrypt(src)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		b, err := instance.Encrypt(src)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		if bytes.Equal(a, b) || len(a) <= len(src) {
+			t.Fatalf("%s: ciphertext must carry a fresh iv\n%x\n%x", method, a, b)
+		}
+		if _, err := instance.Decrypt(a[:4]); err != ErrShortCiphertext {
+			t.Fatal(method, "expect short ciphertext error, got", err)
+		}
+	}
+}
+
+// 每次加密使用随机IV的加密方式
+var randomIVMethods = map[string]bool{
+	"aes-128-ctr": true,
+	"aes-192-ctr": true,
+	"aes-256-ctr": true,
+	"aes-128-ofb": true,
+	"aes-192-ofb": true,
+	"aes-256-ofb": true,
+	"gm-sm4-ctr":  true,
+	"gm-sm4-cfb":  true,
+	"gm-sm4-ofb":  true,
+	"chacha20":    true,
+	"xchacha20":   true,
+}
@@ -0,0 +1,32 @@
+package encrypt
+
+import (
+	"crypto/cipher"
+	"golang.org/x/crypto/chacha20"
+)
+
+// ChaCha20Method RFC 8439 ChaCha20 流加密，key为32字节，每次加密使用随机的12字节nonce并置于密文前，Init 的 iv 不使用
+type ChaCha20Method struct {
+	key []byte
+}
+
+func (this *ChaCha20Method) Init(key, iv []byte) error {
+	this.key = fitSize(key, chacha20.KeySize)
+	return nil
+}
+
+func (this *ChaCha20Method) Encrypt(src []byte) (dst []byte, err error) {
+	return sealStream(src, chacha20.NonceSize, this.stream)
+}
+
+func (this *ChaCha20Method) Decrypt(dst []byte) (src []byte, err error) {
+	return openStream(dst, chacha20.NonceSize, this.stream)
+}
+
+func (this *ChaCha20Method) stream(nonce []byte) (cipher.Stream, error) {
+	return chacha20.NewUnauthenticatedCipher(this.key, nonce)
+}
+
+func (this *ChaCha20Method) Method() uint8 {
+	return encryptMethodChaCha20
+}
@@ -0,0 +1,101 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 同一实例在多个goroutine中并发加解密，使用 go test -race 运行
+func TestMethod_Concurrent(t *testing.T) {
+	for method := range methods {
+		t.Run(method, func(t *testing.T) {
+			instance := randomMethodInstance(t, method)
+			src := make([]byte, 100)
+			if _, err := rand.Read(src); err != nil {
+				t.Fatal(err)
+			}
+			want, err := instance.Encrypt(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wg := sync.WaitGroup{}
+			errs := make(chan string, 16)
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						dst, err := instance.Encrypt(src)
+						if err != nil {
+							errs <- err.Error()
+							return
+						}
+						//sm2 及流加密模式加密带随机数
+						if method != "gm-sm2-ecc" && !randomIVMethods[method] && !bytes.Equal(dst, want) {
+							errs <- "encrypt result differs between goroutines"
+							return
+						}
+						if method == "gm-sm3-sum" {
+							continue
+						}
+						got, err := instance.Decrypt(dst)
+						if err != nil {
+							errs <- err.Error()
+							return
+						}
+						if !bytes.Equal(got, src) {
+							errs <- "decrypt result differs between goroutines"
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestKeySet_MethodShared(t *testing.T) {
+	keys, err := NewKeySet(&Key{ID: 1, Key: []byte("key"), IV: []byte("iv")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	wg := sync.WaitGroup{}
+	instances := make([]MethodInterface, 8)
+	for i := range instances {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			instances[i], _ = keys.Method(1, encryptMethodAES256CFB, now)
+		}(i)
+	}
+	wg.Wait()
+	first, err := keys.Method(1, encryptMethodAES256CFB, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := keys.Method(1, encryptMethodAES256CFB, now)
+	if first != second {
+		t.Fatal("method instance should be cached")
+	}
+	for _, instance := range instances {
+		if instance == nil {
+			t.Fatal("method instance should not be nil")
+		}
+	}
+	if err := keys.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Method(1, encryptMethodAES256CFB, now); err != ErrKeyNotFound {
+		t.Fatal("expect ErrKeyNotFound, got", err)
+	}
+}
@@ -5,31 +5,30 @@ import (
 )
 
 type GMSM2ECCMethod struct {
-	iv  []byte
-	key []byte
+	pri *sm2.PrivateKey
+	pub *sm2.PublicKey
 }
 
 func (this *GMSM2ECCMethod) Init(pri, pub []byte) error {
-	_, err := sm2.RawBytesToPublicKey(pub)
+	publicKey, err := sm2.RawBytesToPublicKey(pub)
 	if err != nil {
 		return err
 	}
-	_, err = sm2.RawBytesToPrivateKey(pri)
+	privateKey, err := sm2.RawBytesToPrivateKey(pri)
 	if err != nil {
 		return err
 	}
-	this.key = pri
-	this.iv = pub
+	this.pri = privateKey
+	this.pub = publicKey
 	return nil
 }
 
 func (this *GMSM2ECCMethod) Encrypt(in []byte) (dst []byte, err error) {
-
-	pub, err := sm2.RawBytesToPublicKey(this.iv)
-	if err != nil {
+	// 空数据会导致sm2密钥派生无限重试
+	if len(in) == 0 {
 		return
 	}
-	cipherText, err := sm2.Encrypt(pub, in, sm2.C1C2C3)
+	cipherText, err := sm2.Encrypt(this.pub, in, sm2.C1C2C3)
 	if err != nil {
 		return
 	}
@@ -38,12 +37,18 @@ func (this *GMSM2ECCMethod) Encrypt(in []byte) (dst []byte, err error) {
 }
 
 func (this *GMSM2ECCMethod) Decrypt(out []byte) (in []byte, err error) {
-	pri, err := sm2.RawBytesToPrivateKey(this.key)
-	if err != nil {
+	if len(out) == 0 {
 		return
 	}
 
-	plainText, err := sm2.Decrypt(pri, out, sm2.C1C2C3)
+	// 密文长度不足时sm2库会panic
+	defer func() {
+		if r := recover(); r != nil {
+			in, err = nil, RecoverMethodPanic(r)
+		}
+	}()
+
+	plainText, err := sm2.Decrypt(this.pri, out, sm2.C1C2C3)
 	if err != nil {
 		return
 	}
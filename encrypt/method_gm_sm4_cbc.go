@@ -2,32 +2,29 @@ package encrypt
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"errors"
 	"github.com/ZZMarquis/gm/sm4"
-	"github.com/ZZMarquis/gm/util"
+)
+
+var (
+	ErrInvalidPadding = errors.New("invalid pkcs5 padding")
 )
 
 type GMSM4CBCMethod struct {
-	iv  []byte
-	key []byte
+	iv    []byte
+	block cipher.Block
 }
 
 func (this *GMSM4CBCMethod) Init(key, iv []byte) error {
-	l := len(key)
-	if l > sm4.BlockSize {
-		key = key[:16]
-	} else if l < sm4.BlockSize {
-		key = append(key, bytes.Repeat([]byte{' '}, 16-l)...)
+	block, err := sm4.NewCipher(fitSize(key, sm4.BlockSize))
+	if err != nil {
+		return err
 	}
+	this.block = block
 
 	// 判断iv长度
-	l2 := len(iv)
-	if l2 > sm4.BlockSize {
-		iv = iv[:sm4.BlockSize]
-	} else if l2 < sm4.BlockSize {
-		iv = append(iv, bytes.Repeat([]byte{' '}, sm4.BlockSize-l2)...)
-	}
-	this.key = key
-	this.iv = iv
+	this.iv = fitSize(iv, sm4.BlockSize)
 
 	return nil
 }
@@ -36,24 +33,49 @@ func (this *GMSM4CBCMethod) Encrypt(in []byte) (dst []byte, err error) {
 	if len(in) == 0 {
 		return
 	}
-	cipherText, err := sm4.CBCEncrypt(this.key, this.iv, util.PKCS5Padding(in, sm4.BlockSize))
-	if err != nil {
-		return nil, err
-	}
-	return cipherText, nil
+	padded := pkcs5Padding(in, sm4.BlockSize)
+	dst = make([]byte, len(padded))
+	cipher.NewCBCEncrypter(this.block, this.iv).CryptBlocks(dst, padded)
+	return dst, nil
 }
 
 func (this *GMSM4CBCMethod) Decrypt(out []byte) (in []byte, err error) {
 	if len(out) == 0 {
 		return
 	}
-
-	plainTextWithPadding, err := sm4.CBCDecrypt(this.key, this.iv, out)
-	if err != nil {
-		return nil, err
+	if len(out)%sm4.BlockSize != 0 {
+		return nil, errors.New("input not full blocks")
 	}
-	return util.PKCS5UnPadding(plainTextWithPadding), nil
+	plainTextWithPadding := make([]byte, len(out))
+	cipher.NewCBCDecrypter(this.block, this.iv).CryptBlocks(plainTextWithPadding, out)
+	return pkcs5UnPadding(plainTextWithPadding, sm4.BlockSize)
 }
 func (this *GMSM4CBCMethod) Method() uint8 {
 	return encryptMethodGMSM4CBC
 }
+
+// 填充至分组长度的整数倍，不修改输入切片
+func pkcs5Padding(src []byte, blockSize int) []byte {
+	padding := blockSize - len(src)%blockSize
+	dst := make([]byte, len(src), len(src)+padding)
+	copy(dst, src)
+	return append(dst, bytes.Repeat([]byte{byte(padding)}, padding)...)
+}
+
+// 去除填充，填充不合法时返回错误
+func pkcs5UnPadding(src []byte, blockSize int) ([]byte, error) {
+	length := len(src)
+	if length == 0 {
+		return nil, ErrInvalidPadding
+	}
+	padding := int(src[length-1])
+	if padding == 0 || padding > blockSize || padding > length {
+		return nil, ErrInvalidPadding
+	}
+	for _, b := range src[length-padding:] {
+		if int(b) != padding {
+			return nil, ErrInvalidPadding
+		}
+	}
+	return src[:length-padding], nil
+}
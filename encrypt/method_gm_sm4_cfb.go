@@ -0,0 +1,36 @@
+package encrypt
+
+import (
+	"crypto/cipher"
+	"github.com/ZZMarquis/gm/sm4"
+)
+
+// GMSM4CFBMethod SM4-CFB 流加密，每次加密使用随机IV并置于密文前，Init 的 iv 不使用
+type GMSM4CFBMethod struct {
+	block cipher.Block
+}
+
+func (this *GMSM4CFBMethod) Init(key, iv []byte) error {
+	block, err := sm4.NewCipher(fitSize(key, sm4.BlockSize))
+	if err != nil {
+		return err
+	}
+	this.block = block
+	return nil
+}
+
+func (this *GMSM4CFBMethod) Encrypt(src []byte) (dst []byte, err error) {
+	return sealStream(src, sm4.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCFBEncrypter(this.block, iv), nil
+	})
+}
+
+func (this *GMSM4CFBMethod) Decrypt(dst []byte) (src []byte, err error) {
+	return openStream(dst, sm4.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCFBDecrypter(this.block, iv), nil
+	})
+}
+
+func (this *GMSM4CFBMethod) Method() uint8 {
+	return encryptMethodGMSM4CFB
+}
@@ -0,0 +1,36 @@
+package encrypt
+
+import (
+	"crypto/cipher"
+	"github.com/ZZMarquis/gm/sm4"
+)
+
+// GMSM4CTRMethod SM4-CTR 流加密，每次加密使用随机IV并置于密文前，Init 的 iv 不使用
+type GMSM4CTRMethod struct {
+	block cipher.Block
+}
+
+func (this *GMSM4CTRMethod) Init(key, iv []byte) error {
+	block, err := sm4.NewCipher(fitSize(key, sm4.BlockSize))
+	if err != nil {
+		return err
+	}
+	this.block = block
+	return nil
+}
+
+func (this *GMSM4CTRMethod) Encrypt(src []byte) (dst []byte, err error) {
+	return sealStream(src, sm4.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCTR(this.block, iv), nil
+	})
+}
+
+func (this *GMSM4CTRMethod) Decrypt(dst []byte) (src []byte, err error) {
+	return openStream(dst, sm4.BlockSize, func(iv []byte) (cipher.Stream, error) {
+		return cipher.NewCTR(this.block, iv), nil
+	})
+}
+
+func (this *GMSM4CTRMethod) Method() uint8 {
+	return encryptMethodGMSM4CTR
+}
@@ -0,0 +1,63 @@
+package encrypt
+
+import (
+	"encoding/hex"
+	"github.com/ZZMarquis/gm/sm4"
+	"testing"
+)
+
+// GB/T 32907-2016 附录A 示例1：密钥与明文均为 0123456789abcdeffedcba9876543210
+const (
+	gbtKey        = "0123456789abcdeffedcba9876543210"
+	gbtCiphertext = "681edf34d206965e86b3e94f536e4246"
+)
+
+// 以标准分组为iv、全零明文时，CTR/CFB/OFB 的首个分组即为标准密文
+var sm4ModeVectors = []methodVector{
+	{"gm-sm4-ctr", gbtKey, gbtKey, "00000000000000000000000000000000", gbtCiphertext},
+	{"gm-sm4-cfb", gbtKey, gbtKey, "00000000000000000000000000000000", gbtCiphertext},
+	{"gm-sm4-ofb", gbtKey, gbtKey, "00000000000000000000000000000000", gbtCiphertext},
+}
+
+func TestGMSM4Modes_KnownAnswer(t *testing.T) {
+	key, _ := hex.DecodeString(gbtKey)
+	dst, err := sm4.ECBEncrypt(key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(dst[:sm4.BlockSize]) != gbtCiphertext {
+		t.Fatalf("sm4 block cipher does not match GB/T 32907: %x", dst)
+	}
+	testMethodVectors(t, sm4ModeVectors)
+}
+
+// 多分组向量，与被测实现无关：
+// draft-ribose-cfrg-sm4-10 附录A.2 示例，并以 OpenSSL 3.0 enc -sm4-{cbc,ctr,cfb,ofb} 交叉生成
+// 非整分组的向量由 OpenSSL 生成，明文为 "The quick brown fox jumps over the lazy dog, 47 bytes"
+const (
+	sm4DraftIV        = "000102030405060708090a0b0c0d0e0f"
+	sm4DraftPlaintext = "aaaaaaaabbbbbbbbccccccccddddddddeeeeeeeeffffffffaaaaaaaabbbbbbbb"
+	sm4FoxIV          = "30313233343536373839616263646566"
+	sm4FoxPlaintext   = "54686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672c2034372062797465"
+)
+
+var sm4BlockVectors = []methodVector{
+	{"gm-sm4-ctr", gbtKey, sm4DraftIV, sm4DraftPlaintext, "ac3236cb861dd316e6413b4e3c7524b781e9e3a5bf5c03fe703bb94f3abb16a1"},
+	{"gm-sm4-cfb", gbtKey, sm4DraftIV, sm4DraftPlaintext, "ac3236cb861dd316e6413b4e3c7524b769d4c54ed433b9a0346009beb37b2b3f"},
+	{"gm-sm4-ofb", gbtKey, sm4DraftIV, sm4DraftPlaintext, "ac3236cb861dd316e6413b4e3c7524b71d01aca2487ca582cbf5463e6698539b"},
+	{"gm-sm4-ctr", gbtKey, sm4FoxIV, sm4FoxPlaintext, "b2e01e57aadedc1194801d9f1a3fdfb21053881badb3c814bc131d4db6f6c083422f3c01509470fd17c0e5dd96df6f3442d23f1a68"},
+	{"gm-sm4-cfb", gbtKey, sm4FoxIV, sm4FoxPlaintext, "b2e01e57aadedc1194801d9f1a3fdfb25edf64a577361194c43658da0e62c0988c51125b477d2d607c0d47e9fd589128e63f5a8796"},
+	{"gm-sm4-ofb", gbtKey, sm4FoxIV, sm4FoxPlaintext, "b2e01e57aadedc1194801d9f1a3fdfb2fbe6f34c5122df7288d1cd6a96f13f46a8f6168824fe11360f283d7269c724806b34e9c69d"},
+}
+
+func TestGMSM4Modes_Blocks(t *testing.T) {
+	testMethodVectors(t, sm4BlockVectors)
+}
+
+// CBC 多分组，最后一个分组为 PKCS#5 填充分组（OpenSSL 默认填充）
+func TestGMSM4CBC_Blocks(t *testing.T) {
+	checkConformanceVector(t, sm4CBCBlockVector, false)
+}
+
+var sm4CBCBlockVector = methodVector{"gm-sm4-cbc", gbtKey, sm4DraftIV, sm4DraftPlaintext,
+	"78ebb11cc40b0a48312aaeb2040244cb4cb7016951909226979b0d15dc6a8f6d40d84132e99974a4a880886842074859"}
@@ -1,10 +1,20 @@
 package encrypt
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
 	"errors"
+	"io"
 	"reflect"
 )
 
+// ErrShortCiphertext 密文短于IV长度
+var ErrShortCiphertext = errors.New("ciphertext too short")
+
+// 随机IV来源，测试时替换以生成固定结果
+var randReader io.Reader = rand.Reader
+
 var (
 	encryptKey = ""
 	encryptIv  = ""
@@ -18,6 +28,39 @@ var methods = map[string]reflect.Type{
 	"gm-sm2-ecc":  reflect.TypeOf(new(GMSM2ECCMethod)).Elem(),
 	"gm-sm3-sum":  reflect.TypeOf(new(GMSM3SUMMethod)).Elem(),
 	"gm-sm4-cbc":  reflect.TypeOf(new(GMSM4CBCMethod)).Elem(),
+	"aes-128-ctr": reflect.TypeOf(new(AES128CTRMethod)).Elem(),
+	"aes-192-ctr": reflect.TypeOf(new(AES192CTRMethod)).Elem(),
+	"aes-256-ctr": reflect.TypeOf(new(AES256CTRMethod)).Elem(),
+	"aes-128-ofb": reflect.TypeOf(new(AES128OFBMethod)).Elem(),
+	"aes-192-ofb": reflect.TypeOf(new(AES192OFBMethod)).Elem(),
+	"aes-256-ofb": reflect.TypeOf(new(AES256OFBMethod)).Elem(),
+	"gm-sm4-ctr":  reflect.TypeOf(new(GMSM4CTRMethod)).Elem(),
+	"gm-sm4-cfb":  reflect.TypeOf(new(GMSM4CFBMethod)).Elem(),
+	"gm-sm4-ofb":  reflect.TypeOf(new(GMSM4OFBMethod)).Elem(),
+	"chacha20":    reflect.TypeOf(new(ChaCha20Method)).Elem(),
+	"xchacha20":   reflect.TypeOf(new(XChaCha20Method)).Elem(),
+}
+
+// 加密方式ID，随报文头部发送，已分配的ID不可变更
+var methodIds = map[uint8]string{
+	encryptMethodRaw:       "raw",
+	encryptMethodAES128CFB: "aes-128-cfb",
+	encryptMethodAES192CFB: "aes-192-cfb",
+	encryptMethodAES256CFB: "aes-256-cfb",
+	encryptMethodGMSM2ECC:  "gm-sm2-ecc",
+	encryptMethodGMSM3SUM:  "gm-sm3-sum",
+	encryptMethodGMSM4CBC:  "gm-sm4-cbc",
+	encryptMethodAES128CTR: "aes-128-ctr",
+	encryptMethodAES192CTR: "aes-192-ctr",
+	encryptMethodAES256CTR: "aes-256-ctr",
+	encryptMethodAES128OFB: "aes-128-ofb",
+	encryptMethodAES192OFB: "aes-192-ofb",
+	encryptMethodAES256OFB: "aes-256-ofb",
+	encryptMethodGMSM4CTR:  "gm-sm4-ctr",
+	encryptMethodGMSM4CFB:  "gm-sm4-cfb",
+	encryptMethodGMSM4OFB:  "gm-sm4-ofb",
+	encryptMethodChaCha20:  "chacha20",
+	encryptMethodXChaCha20: "xchacha20",
 }
 
 func Init(key string, iv string) {
@@ -43,25 +86,58 @@ func NewMethodInstance(method string, key string, iv string) (MethodInterface, e
 	return instance, err
 }
 func GetMethodInstance(id uint8) (MethodInterface, error) {
-	method := ""
-	switch id {
-	case encryptMethodRaw:
-		method = "raw"
-	case encryptMethodAES128CFB:
-		method = "aes-128-cfb"
-	case encryptMethodAES192CFB:
-		method = "aes-192-cfb"
-	case encryptMethodAES256CFB:
-		method = "aes-256-cfb"
-	case encryptMethodGMSM2ECC:
-		method = "gm-sm2-ecc"
-	case encryptMethodGMSM3SUM:
-		method = "gm-sm3-sum"
-	case encryptMethodGMSM4CBC:
-		method = "gm-sm4-cbc"
+	return NewMethodInstance(methodIds[id], encryptKey, encryptIv)
+}
+
+// MethodName 根据加密方式ID获取加密方式名称
+func MethodName(id uint8) (string, bool) {
+	method, ok := methodIds[id]
+	return method, ok
+}
+
+// 将key或iv截断或以空格补齐至指定长度，返回新的切片
+func fitSize(b []byte, size int) []byte {
+	dst := bytes.Repeat([]byte{' '}, size)
+	copy(dst, b)
+	return dst
+}
+
+// 流加密模式每次加密生成随机IV（nonce），避免同一密钥下重复使用密钥流
+// 密文为 IV + 加密数据，空数据不加密
+func sealStream(src []byte, ivSize int, newStream func(iv []byte) (cipher.Stream, error)) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, nil
+	}
+	dst := make([]byte, ivSize+len(src))
+	iv := dst[:ivSize]
+	if _, err := io.ReadFull(randReader, iv); err != nil {
+		return nil, err
 	}
-	return NewMethodInstance(method, encryptKey, encryptIv)
+	stream, err := newStream(iv)
+	if err != nil {
+		return nil, err
+	}
+	stream.XORKeyStream(dst[ivSize:], src)
+	return dst, nil
 }
+
+// 从密文前读取IV并解密
+func openStream(dst []byte, ivSize int, newStream func(iv []byte) (cipher.Stream, error)) ([]byte, error) {
+	if len(dst) == 0 {
+		return nil, nil
+	}
+	if len(dst) < ivSize {
+		return nil, ErrShortCiphertext
+	}
+	stream, err := newStream(dst[:ivSize])
+	if err != nil {
+		return nil, err
+	}
+	src := make([]byte, len(dst)-ivSize)
+	stream.XORKeyStream(src, dst[ivSize:])
+	return src, nil
+}
+
 func RecoverMethodPanic(err interface{}) error {
 	if err != nil {
 		s, ok := err.(string)
@@ -1,8 +1,8 @@
 package encrypt
 
 import (
+	"bytes"
 	"crypto/rand"
-	"fmt"
 	"github.com/ZZMarquis/gm/sm2"
 	"testing"
 )
@@ -18,6 +18,20 @@ func TestSm2(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Println(string(pri.GetRawBytes()))
-	fmt.Println(string(pub.GetRawBytes()))
+	method, err := NewMethodInstance("gm-sm2-ecc", string(pri.GetRawBytes()), string(pub.GetRawBytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("Hello, World")
+	dst, err := method.Encrypt(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := method.Decrypt(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatalf("sm2 round trip mismatch: %q", got)
+	}
 }
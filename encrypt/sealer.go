@@ -0,0 +1,150 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	sealedVersion = 0x01
+	// magic(3) + version(1) + key id(4)
+	sealedHeaderLength = 8
+	sealedKeyInfo      = "libspa sealer v1"
+)
+
+var (
+	sealedMagic = []byte("SPS")
+
+	ErrSealedInvalid = errors.New("invalid sealed data")
+	ErrSealedOpen    = errors.New("sealed data authentication failed")
+)
+
+// Sealer 使用部署专属密钥对敏感信息进行认证加密，用于替代 MagicKeyEncode/MagicKeyDecode
+//
+// 密文格式为 "SPS" + 版本 + 密钥ID + nonce + AES-256-GCM 密文，
+// 加密时使用最新的有效密钥，解密时按密文中的密钥ID选择密钥，不校验密钥有效期。
+type Sealer struct {
+	keys   *KeySet
+	locker sync.Mutex
+	//按密钥ID缓存，密钥被替换后重新派生
+	aeads map[uint32]*sealerAEAD
+}
+
+type sealerAEAD struct {
+	key  *Key
+	aead cipher.AEAD
+}
+
+// NewSealer 从密钥来源创建Sealer，拒绝使用内置 MagicKey
+func NewSealer(provider KeyProvider) (*Sealer, error) {
+	keys, err := LoadKeySet(provider, false)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeySetSealer(keys), nil
+}
+
+// NewKeySetSealer 使用已有的密钥集合创建Sealer
+func NewKeySetSealer(keys *KeySet) *Sealer {
+	return &Sealer{keys: keys, aeads: map[uint32]*sealerAEAD{}}
+}
+
+// Seal 使用最新的有效密钥加密
+func (this *Sealer) Seal(data []byte) ([]byte, error) {
+	key, err := this.keys.Newest(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := this.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, sealedHeaderLength, sealedHeaderLength+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(header, sealedMagic)
+	header[3] = sealedVersion
+	binary.BigEndian.PutUint32(header[4:], key.ID)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dst := append(header, nonce...)
+	return aead.Seal(dst, nonce, data, header), nil
+}
+
+// Open 解密并校验Seal生成的密文
+func (this *Sealer) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return nil, ErrSealedInvalid
+	}
+	key, err := this.keys.Lookup(binary.BigEndian.Uint32(data[4:sealedHeaderLength]))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := this.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sealedHeaderLength+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrSealedInvalid
+	}
+	nonce := data[sealedHeaderLength : sealedHeaderLength+aead.NonceSize()]
+	src, err := aead.Open(nil, nonce, data[sealedHeaderLength+aead.NonceSize():], data[:sealedHeaderLength])
+	if err != nil {
+		return nil, ErrSealedOpen
+	}
+	return src, nil
+}
+
+// Reseal 使用最新的有效密钥重新加密
+// 支持Seal生成的密文（用于密钥轮换）以及 MagicKeyEncode 生成的旧格式数据
+func (this *Sealer) Reseal(data []byte) ([]byte, error) {
+	var src []byte
+	var err error
+	if IsSealed(data) {
+		src, err = this.Open(data)
+	} else {
+		src, err = MagicKeyOpen(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return this.Seal(src)
+}
+
+// IsSealed 判断数据是否为Seal生成的格式
+func IsSealed(data []byte) bool {
+	return len(data) >= sealedHeaderLength && bytes.Equal(data[:3], sealedMagic) && data[3] == sealedVersion
+}
+
+// 获取密钥对应的AEAD，密钥经HKDF派生为AES-256密钥
+func (this *Sealer) aead(key *Key) (cipher.AEAD, error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if cached, ok := this.aeads[key.ID]; ok && cached.key == key {
+		return cached.aead, nil
+	}
+	derived := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key.Key, key.IV, []byte(sealedKeyInfo)), derived); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	this.aeads[key.ID] = &sealerAEAD{key: key, aead: aead}
+	return aead, nil
+}
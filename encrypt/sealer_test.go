@@ -0,0 +1,112 @@
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSealer_Seal(t *testing.T) {
+	sealer, err := NewSealer(&LiteralKeyProvider{ID: 1, Key: "deployment-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("Hello,World")
+	dst, err := sealer.Seal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(dst) || bytes.Contains(dst, src) {
+		t.Fatalf("unexpected sealed data %x", dst)
+	}
+	got, err := sealer.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatalf("unexpected open result %q", got)
+	}
+
+	dst[len(dst)-1] ^= 0xff
+	if _, err := sealer.Open(dst); err != ErrSealedOpen {
+		t.Fatal("expect ErrSealedOpen, got", err)
+	}
+	if _, err := sealer.Open(src); err != ErrSealedInvalid {
+		t.Fatal("expect ErrSealedInvalid, got", err)
+	}
+	if _, err := NewSealer(&LiteralKeyProvider{Key: MagicKey}); err != ErrMagicKeyInUse {
+		t.Fatal("expect ErrMagicKeyInUse, got", err)
+	}
+}
+
+func TestSealer_Reseal(t *testing.T) {
+	keys, err := NewKeySet(&Key{ID: 1, Key: []byte("old-key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := NewKeySetSealer(keys)
+
+	//旧格式
+	legacy := MagicKeyEncode([]byte("legacy secret"))
+	sealed, err := sealer.Reseal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := sealer.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "legacy secret" {
+		t.Fatalf("unexpected open result %q", got)
+	}
+
+	//密钥轮换后重新加密
+	if err := keys.Add(&Key{ID: 2, Key: []byte("new-key"), NotBefore: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Retire(1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	resealed, err := sealer.Reseal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resealed[7] != 2 {
+		t.Fatalf("resealed data should use key 2: %x", resealed[:sealedHeaderLength])
+	}
+	got, err = sealer.Open(resealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "legacy secret" {
+		t.Fatalf("unexpected open result %q", got)
+	}
+}
+
+func TestSealer_ReplaceKey(t *testing.T) {
+	keys, err := NewKeySet(&Key{ID: 1, Key: []byte("deployment-key-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := NewKeySetSealer(keys)
+	old, err := sealer.Seal([]byte("Hello,World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//同一ID替换为新的密钥材料后不能再使用旧密钥
+	if err := keys.Replace(&Key{ID: 1, Key: []byte("deployment-key-2")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sealer.Open(old); err != ErrSealedOpen {
+		t.Fatal("expect ErrSealedOpen, got", err)
+	}
+	dst, err := sealer.Seal([]byte("Hello,World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewKeySetSealer(keys)
+	if got, err := other.Open(dst); err != nil || string(got) != "Hello,World" {
+		t.Fatal("unexpected open result", string(got), err)
+	}
+}
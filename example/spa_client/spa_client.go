@@ -9,6 +9,8 @@ import (
 
 func main() {
 	cli := spaclient.New()
+	//测试模式下未设置密钥时使用内置 MagicKey
+	cli.Test = true
 	cli.Addr = "127.0.0.1"
 	cli.Protocol = "udp"
 	cli.Port = 54732
@@ -1,10 +1,24 @@
 package main
 
 import (
+	"context"
 	spaserver "github.com/1uLang/libspa/server"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 	srv := spaserver.New()
-	srv.Run()
+	//测试模式下未设置密钥时使用内置 MagicKey
+	srv.Test = true
+	//退出时撤销本进程设置的放行
+	srv.RevokeOnShutdown = true
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := srv.RunContext(ctx); err != nil && err != spaserver.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
@@ -5,14 +5,17 @@ go 1.16
 //replace github.com/1uLang/libnet => ../libnet
 
 require (
-	github.com/1uLang/libnet v0.0.0-20221103125411-034f115ad643
+	github.com/BurntSushi/toml v1.2.1
 	github.com/ZZMarquis/gm v1.3.2
 	github.com/kr/pretty v0.3.0 // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.12.2
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/sirupsen/logrus v1.9.0
 	github.com/stretchr/testify v1.8.0 // indirect
 	github.com/tklauser/go-sysconf v0.3.10 // indirect
 	github.com/yusufpapurcu/wmi v1.2.2 // indirect
-	golang.org/x/sys v0.0.0-20221013171732-95e765b1cc43 // indirect
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	golang.org/x/sys v0.0.0-20221013171732-95e765b1cc43
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -3,6 +3,7 @@ package iptables
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net"
 	"os/exec"
@@ -86,3 +87,233 @@ func getRuleId(name string) int {
 	rid, _ := strconv.Atoi(res)
 	return rid
 }
+
+// CloseAddrPort 撤销指定IP及端口的放行
+func CloseAddrPort(addr, proto string, port int) error {
+	if net.ParseIP(addr) == nil {
+		return nil
+	}
+	cluster := fmt.Sprintf("%s%s%d", spa_cluster_prefix, proto, port)
+	cmd := exec.Command("ipset", "-exist", "del", cluster, addr)
+	_, err := cmd.Output()
+	if err != nil {
+		fmt.Println("do cmd : ", cmd, " error : ", err)
+		return err
+	}
+	return nil
+}
+
+// 封禁集合，IPv4 及 IPv6 分别使用 iptables 及 ip6tables
+const (
+	denySet  = "spa-deny"
+	denySet6 = "spa-deny6"
+)
+
+// Listener spa服务监听的协议及端口
+type Listener struct {
+	Proto string
+	Port  int
+}
+
+// BanAddr 封禁指定IP发往spa服务监听的流量，timeout 秒后由 ipset 自动解除
+// 仅丢弃发往监听端口的流量，避免伪造来源的数据报导致该IP的其他服务（如已建立的SSH）被中断
+func BanAddr(addr string, timeout int, listeners []Listener) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	if len(listeners) == 0 {
+		return fmt.Errorf("ban %s: no listener", addr)
+	}
+	set, family, iptablesCmd := denySet, "inet", "iptables"
+	if ip.To4() == nil {
+		set, family, iptablesCmd = denySet6, "inet6", "ip6tables"
+	}
+	//集合不存在时创建，超时时间由每个条目指定
+	if _, err := exec.Command("ipset", "list", set).Output(); err != nil {
+		cmd := exec.Command("ipset", "create", set, "hash:ip", "family", family, "timeout", "0")
+		if _, err := cmd.Output(); err != nil {
+			fmt.Println("do cmd : ", cmd, " error : ", err)
+			return err
+		}
+	}
+	cmd := exec.Command("ipset", "-exist", "add", set, addr, "timeout", strconv.Itoa(timeout))
+	if _, err := cmd.Output(); err != nil {
+		fmt.Println("do cmd : ", cmd, " error : ", err)
+		return err
+	}
+	//每个监听的规则不存在时添加到最前
+	for _, l := range listeners {
+		args := banMatch(set, l)
+		if exec.Command(iptablesCmd, append([]string{"-C", "INPUT"}, args...)...).Run() == nil {
+			continue
+		}
+		cmd = exec.Command(iptablesCmd, append([]string{"-I", "INPUT"}, args...)...)
+		if _, err := cmd.Output(); err != nil {
+			fmt.Println("do cmd : ", cmd, " error : ", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// 丢弃封禁集合中的IP发往监听的流量
+func banMatch(set string, l Listener) []string {
+	return []string{"-p", l.Proto, "--dport", strconv.Itoa(l.Port), "-m", "set", "--match-set", set, "src", "-j", "DROP"}
+}
+
+// UnbanAddr 解除指定IP的封禁
+func UnbanAddr(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	set := denySet
+	if ip.To4() == nil {
+		set = denySet6
+	}
+	cmd := exec.Command("ipset", "-exist", "del", set, addr)
+	if _, err := cmd.Output(); err != nil {
+		fmt.Println("do cmd : ", cmd, " error : ", err)
+		return err
+	}
+	return nil
+}
+
+// 网段及端口范围等放行使用的集合前缀，集合类型为 hash:net
+const spa_net_prefix = "spa-net:"
+
+// ipset 集合名称最大长度
+const setNameMaxLength = 31
+
+// Rule 放行规则
+type Rule struct {
+	//客户端IP或网段（CIDR）
+	Addr string
+	//协议 tcp/udp/sctp/icmp/icmpv6
+	Proto string
+	//端口及端口范围的结束端口，PortEnd 为0时仅 Port
+	Port    int
+	PortEnd int
+	//目标地址，设置时在 FORWARD 链放行转发到该地址的流量
+	Dest string
+	//放行时间（秒）
+	Timeout int
+}
+
+// 单个IPv4、tcp/udp 单端口且无目标地址的放行使用 OpenAddrPort 的集合
+// OpenAddrPort 的集合为 inet 协议族，IPv6 地址需使用按协议族区分的集合
+func (r *Rule) simple() bool {
+	ip := net.ParseIP(r.Addr)
+	return ip != nil && ip.To4() != nil && (r.Proto == "tcp" || r.Proto == "udp") &&
+		(r.PortEnd == 0 || r.PortEnd == r.Port) && r.Dest == ""
+}
+
+// 客户端地址是否为IPv6
+func (r *Rule) ipv6() (bool, error) {
+	ip := net.ParseIP(r.Addr)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(r.Addr); err != nil {
+			return false, fmt.Errorf("invalid address %s", r.Addr)
+		}
+	}
+	return ip.To4() == nil, nil
+}
+
+// 集合名称，超出长度限制时使用哈希值
+func (r *Rule) set(v6 bool) string {
+	name := r.Proto
+	if r.Port > 0 {
+		name += strconv.Itoa(r.Port)
+		if r.PortEnd > r.Port {
+			name += "-" + strconv.Itoa(r.PortEnd)
+		}
+	}
+	if r.Dest != "" {
+		name += ">" + r.Dest
+	}
+	if v6 {
+		name += "/6"
+	}
+	if len(spa_net_prefix)+len(name) > setNameMaxLength {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		name = fmt.Sprintf("%016x", h.Sum64())
+	}
+	return spa_net_prefix + name
+}
+
+// iptables 规则参数，不包含操作及链
+func (r *Rule) match(set string) []string {
+	args := []string{"-m", "set", "--match-set", set, "src", "-p", r.Proto}
+	if r.Port > 0 {
+		port := strconv.Itoa(r.Port)
+		if r.PortEnd > r.Port {
+			port += ":" + strconv.Itoa(r.PortEnd)
+		}
+		args = append(args, "--dport", port)
+	}
+	if r.Dest != "" {
+		args = append(args, "-d", r.Dest)
+	}
+	return append(args, "-j", "ACCEPT")
+}
+
+// Open 开放规则，单个IP及端口时同 OpenAddrPort
+func Open(r *Rule) error {
+	if r.simple() {
+		return OpenAddrPort(r.Addr, r.Proto, r.Port, r.Timeout)
+	}
+	v6, err := r.ipv6()
+	if err != nil {
+		return err
+	}
+	set, family, iptablesCmd := r.set(v6), "inet", "iptables"
+	if v6 {
+		family, iptablesCmd = "inet6", "ip6tables"
+	}
+	//集合不存在时创建，超时时间由每个条目指定
+	if _, err := exec.Command("ipset", "list", set).Output(); err != nil {
+		cmd := exec.Command("ipset", "create", set, "hash:net", "family", family, "timeout", "0")
+		if _, err := cmd.Output(); err != nil {
+			fmt.Println("do cmd : ", cmd, " error : ", err)
+			return err
+		}
+	}
+	cmd := exec.Command("ipset", "-exist", "add", set, r.Addr, "timeout", strconv.Itoa(r.Timeout))
+	if _, err := cmd.Output(); err != nil {
+		fmt.Println("do cmd : ", cmd, " error : ", err)
+		return err
+	}
+	chain := "INPUT"
+	if r.Dest != "" {
+		chain = "FORWARD"
+	}
+	match := r.match(set)
+	if exec.Command(iptablesCmd, append([]string{"-C", chain}, match...)...).Run() != nil {
+		cmd = exec.Command(iptablesCmd, append([]string{"-I", chain}, match...)...)
+		if _, err := cmd.Output(); err != nil {
+			fmt.Println("do cmd : ", cmd, " error : ", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 撤销规则，单个IP及端口时同 CloseAddrPort
+func Close(r *Rule) error {
+	if r.simple() {
+		return CloseAddrPort(r.Addr, r.Proto, r.Port)
+	}
+	v6, err := r.ipv6()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("ipset", "-exist", "del", r.set(v6), r.Addr)
+	if _, err := cmd.Output(); err != nil {
+		fmt.Println("do cmd : ", cmd, " error : ", err)
+		return err
+	}
+	return nil
+}
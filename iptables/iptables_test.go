@@ -0,0 +1,50 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRule_Simple(t *testing.T) {
+	tests := []struct {
+		rule   Rule
+		simple bool
+	}{
+		{Rule{Addr: "192.168.1.10", Proto: "tcp", Port: 22}, true},
+		{Rule{Addr: "192.168.1.10", Proto: "udp", Port: 53, PortEnd: 53}, true},
+		{Rule{Addr: "2001:db8::10", Proto: "tcp", Port: 22}, false},
+		{Rule{Addr: "192.168.1.0/24", Proto: "tcp", Port: 22}, false},
+		{Rule{Addr: "192.168.1.10", Proto: "tcp", Port: 8000, PortEnd: 8080}, false},
+		{Rule{Addr: "192.168.1.10", Proto: "icmp"}, false},
+		{Rule{Addr: "192.168.1.10", Proto: "tcp", Port: 22, Dest: "10.0.0.2"}, false},
+	}
+	for _, test := range tests {
+		if simple := test.rule.simple(); simple != test.simple {
+			t.Errorf("%+v: expect simple %v, got %v", test.rule, test.simple, simple)
+		}
+	}
+}
+
+// IPv6 单端口放行使用 inet6 的集合
+func TestRule_IPv6SinglePort(t *testing.T) {
+	rule := Rule{Addr: "2001:db8::10", Proto: "tcp", Port: 22}
+	v6, err := rule.ipv6()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v6 {
+		t.Fatal("expect ipv6 rule")
+	}
+	if set := rule.set(v6); set != spa_net_prefix+"tcp22/6" {
+		t.Fatal("unexpected set", set)
+	}
+}
+
+// 封禁仅丢弃发往监听端口的流量
+func TestBanMatch(t *testing.T) {
+	args := banMatch(denySet, Listener{Proto: "udp", Port: 62201})
+	want := []string{"-p", "udp", "--dport", "62201", "-m", "set", "--match-set", denySet, "src", "-j", "DROP"}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatal("unexpected ban rule", args)
+	}
+}
@@ -2,6 +2,7 @@ package libspa
 
 import (
 	"crypto/md5"
+	"encoding/binary"
 	"fmt"
 	"github.com/1uLang/libspa/encrypt"
 	"github.com/pkg/errors"
@@ -10,12 +11,14 @@ import (
 )
 
 const (
-	startCode          = 0x2323
-	packetVersion      = 0x01
-	packetLength       = 80
-	packetHeaderLength = 4
-	packetSignLength   = 16
-	packetBodyLength   = 60
+	startCode            = 0x2323
+	packetVersion        = 0x02
+	packetVersionV1      = 0x01
+	packetLength         = 84
+	packetHeaderLength   = 8
+	packetHeaderLengthV1 = 4
+	packetSignLength     = 16
+	packetBodyLength     = 60
 
 	timestampFieldSize      = 8  // Unix Timestamp - 64 bit = 8 bytes
 	nonceFieldSize          = 4  // bytes - according to the OpenSPA protocol
@@ -30,6 +33,8 @@ var (
 	InvalidMethodSecret    = errors.New("invalid packet (packet method secret is error)")
 	InvalidSignPacket      = errors.New("invalid packet (packet sign is error)")
 	InvalidBodyPacket      = errors.New("invalid packet (body packet length is error)")
+	InvalidHeaderPacket    = errors.New("invalid packet (header packet length is error)")
+	InvalidKeyPacket       = errors.New("invalid packet (packet key id is not valid)")
 	VersionLowPacket       = errors.New("version low packet")
 )
 
@@ -37,7 +42,9 @@ var (
 // 0               |   1           |       2       |           3
 // 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
 // +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-// |   START  CODE[0x2323]         | VERSION[0x01] | METHOD[0x01]  | [HEADER]
+// |   START  CODE[0x2323]         | VERSION[0x02] | METHOD[0x01]  | [HEADER]
+// |-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-|
+// |                        KEY ID                                 |
 // |-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-|
 // +                                                               +
 // |                        MD5 SUM			                       | [SIGN]
@@ -64,21 +71,42 @@ var (
 // |                                                               |
 // +                                                               +
 // +-+-+-+-+-+-+-+-|-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// 0x01 版本的报文头部不包含 KEY ID，解析时视为 KEY ID 0
 
 type Body struct {
 	ClientDeviceId string
 	ClientPublicIP net.IP
 	ServerPublicIP net.IP
 }
-type requestBody struct {
+
+// Header spa报头部
+type Header struct {
+	Version uint8
+	Method  uint8
+	KeyId   uint32
+}
+
+// Packet 解析后的spa报
+type Packet struct {
+	Header
 	Timestamp uint64
 	Nonce     Nonce
 	Body
 }
 
-// NewPacket 生成spa报
+// NewPacket 生成 0x01 版本的spa报，头部不包含 KEY ID，兼容不支持密钥ID的服务端
 func NewPacket(body *Body, method encrypt.MethodInterface) ([]byte, error) {
-	packet := encodeHeader(packetVersion, method)
+	return newPacket(body, packetVersionV1, 0, method)
+}
+
+// NewKeyedPacket 生成携带密钥ID的 0x02 版本spa报
+func NewKeyedPacket(body *Body, keyId uint32, method encrypt.MethodInterface) ([]byte, error) {
+	return newPacket(body, packetVersion, keyId, method)
+}
+
+func newPacket(body *Body, version uint8, keyId uint32, method encrypt.MethodInterface) ([]byte, error) {
+	packet := encodeHeader(version, keyId, method)
 	bytes, err := body.Encrypt(method)
 	if err != nil {
 		return nil, errors.New("body encode failed:" + err.Error())
@@ -87,22 +115,17 @@ func NewPacket(body *Body, method encrypt.MethodInterface) ([]byte, error) {
 	return packet, nil
 }
 
-// ParsePacket 解析spa报
+// ParsePacket 解析spa报，忽略报文中的密钥ID
 func ParsePacket(data []byte, key, iv []byte) (body *Body, err error) {
-
-	offset := 0
-	if !checkStartCode(data) {
-		return nil, InvalidStartCodePacket
+	header, err := ParseHeader(data)
+	if err != nil {
+		return nil, err
 	}
-
-	version, method := decodeHeader(data)
-
-	if version != packetVersion {
-		return nil, VersionLowPacket
+	name, ok := encrypt.MethodName(header.Method)
+	if !ok {
+		return nil, InvalidMethodPacket
 	}
-	offset += packetHeaderLength
-
-	c, err := encrypt.GetMethodInstance(method)
+	c, err := encrypt.NewMethod(name)
 	if err != nil {
 		return nil, InvalidMethodPacket
 	}
@@ -110,6 +133,68 @@ func ParsePacket(data []byte, key, iv []byte) (body *Body, err error) {
 	if err != nil {
 		return nil, InvalidMethodSecret
 	}
+	packet, err := parsePacket(data, header, c)
+	if err != nil {
+		return nil, err
+	}
+	return &packet.Body, nil
+}
+
+// ParseKeyedPacket 根据报文中的密钥ID从密钥集合中选择当前有效的密钥解析spa报
+// 加密方式实例由密钥集合缓存，可被并发调用
+func ParseKeyedPacket(data []byte, keys *encrypt.KeySet) (*Packet, error) {
+	header, err := ParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := encrypt.MethodName(header.Method); !ok {
+		return nil, InvalidMethodPacket
+	}
+	c, err := keys.Method(header.KeyId, header.Method, time.Now())
+	if err != nil {
+		if err == encrypt.ErrKeyNotFound || err == encrypt.ErrKeyInvalid {
+			return nil, InvalidKeyPacket
+		}
+		return nil, InvalidMethodSecret
+	}
+	return parsePacket(data, header, c)
+}
+
+// ParseHeader 解析spa报头部
+func ParseHeader(data []byte) (*Header, error) {
+	if len(data) < packetHeaderLengthV1 {
+		return nil, InvalidHeaderPacket
+	}
+	if !checkStartCode(data) {
+		return nil, InvalidStartCodePacket
+	}
+	header := &Header{Version: data[2], Method: data[3]}
+	switch header.Version {
+	case packetVersionV1:
+	case packetVersion:
+		if len(data) < packetHeaderLength {
+			return nil, InvalidHeaderPacket
+		}
+		header.KeyId = binary.BigEndian.Uint32(data[packetHeaderLengthV1:packetHeaderLength])
+	default:
+		return nil, VersionLowPacket
+	}
+	return header, nil
+}
+
+// Length 头部长度
+func (header *Header) Length() int {
+	if header.Version == packetVersionV1 {
+		return packetHeaderLengthV1
+	}
+	return packetHeaderLength
+}
+
+func parsePacket(data []byte, header *Header, c encrypt.MethodInterface) (*Packet, error) {
+	offset := header.Length()
+	if len(data) < offset+packetSignLength {
+		return nil, InvalidBodyPacket
+	}
 
 	md5sum := make([]byte, packetSignLength)
 	copy(md5sum, data[offset:offset+packetSignLength])
@@ -123,15 +208,16 @@ func ParsePacket(data []byte, key, iv []byte) (body *Body, err error) {
 	if fmt.Sprintf("%x", md5.Sum(bodyBytes)) != fmt.Sprintf("%x", md5sum) {
 		return nil, InvalidSignPacket
 	}
-	b, err := bodyDecode(bodyBytes)
+	packet, err := bodyDecode(bodyBytes)
 	if err != nil {
 		return nil, errors.New("body decode failed:" + err.Error())
 	}
-	return &b.Body, nil
+	packet.Header = *header
+	return packet, nil
 }
 
-func encodeHeader(version byte, method encrypt.MethodInterface) []byte {
-	header := make([]byte, packetHeaderLength)
+func encodeHeader(version byte, keyId uint32, method encrypt.MethodInterface) []byte {
+	header := make([]byte, (&Header{Version: version}).Length())
 	header[0] = byte(startCode & 0x00ff)
 	header[1] = byte(startCode >> 8)
 	header[2] = version
@@ -139,15 +225,12 @@ func encodeHeader(version byte, method encrypt.MethodInterface) []byte {
 	if method != nil {
 		header[3] = method.Method()
 	}
+	if version != packetVersionV1 {
+		binary.BigEndian.PutUint32(header[packetHeaderLengthV1:], keyId)
+	}
 	return header
 }
 
-func decodeHeader(data []byte) (version, method uint8) {
-	version = data[2]
-	method = data[3]
-	return
-}
-
 func (body *Body) encode() ([]byte, error) {
 	// This is our packet payload
 	buffer := make([]byte, packetBodyLength)
@@ -203,11 +286,11 @@ func (body *Body) encode() ([]byte, error) {
 	return buffer, nil
 }
 
-func bodyDecode(data []byte) (body *requestBody, err error) {
+func bodyDecode(data []byte) (body *Packet, err error) {
 	if len(data) < packetBodyLength {
 		return nil, InvalidBodyPacket
 	}
-	body = new(requestBody)
+	body = new(Packet)
 	offset := 0 // we initialize the offset to 0
 	body.Timestamp, err = timestampDecode(data[:timestampFieldSize])
 	if err != nil {
@@ -215,6 +298,7 @@ func bodyDecode(data []byte) (body *requestBody, err error) {
 	}
 	offset += timestampFieldSize
 
+	body.Nonce = make(Nonce, nonceFieldSize)
 	copy(body.Nonce, data[offset:offset+nonceFieldSize])
 	offset += nonceFieldSize
 
@@ -0,0 +1,88 @@
+package libspa
+
+import (
+	"github.com/1uLang/libspa/encrypt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseKeyedPacket(t *testing.T) {
+	keys, err := encrypt.NewKeySet(
+		&encrypt.Key{ID: 7, Key: []byte("key-7"), IV: []byte("iv-7")},
+		&encrypt.Key{ID: 8, Key: []byte("key-8"), IV: []byte("iv-8"), NotAfter: time.Now().Add(-time.Second)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &Body{
+		ClientDeviceId: "0123456789abcdef0123456789abcdef",
+		ClientPublicIP: net.ParseIP("10.0.0.1"),
+		ServerPublicIP: net.ParseIP("10.0.0.2"),
+	}
+	method, err := encrypt.NewMethodInstance("aes-256-cfb", "key-7", "iv-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := NewKeyedPacket(body, 7, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := ParseKeyedPacket(data, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.KeyId != 7 || packet.Version != packetVersion || len(packet.Nonce) != nonceFieldSize {
+		t.Fatalf("unexpected packet header %+v", packet.Header)
+	}
+	if !packet.ClientPublicIP.Equal(body.ClientPublicIP) || !packet.ServerPublicIP.Equal(body.ServerPublicIP) {
+		t.Fatalf("unexpected packet body %+v", packet.Body)
+	}
+
+	//已失效的密钥
+	method, err = encrypt.NewMethodInstance("aes-256-cfb", "key-8", "iv-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = NewKeyedPacket(body, 8, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseKeyedPacket(data, keys); err != InvalidKeyPacket {
+		t.Fatal("expect InvalidKeyPacket, got", err)
+	}
+	if _, err := ParseKeyedPacket(data[:3], keys); err != InvalidHeaderPacket {
+		t.Fatal("expect InvalidHeaderPacket, got", err)
+	}
+}
+
+func TestNewPacket_V1(t *testing.T) {
+	keys, err := encrypt.NewKeySet(&encrypt.Key{Key: []byte("key-0"), IV: []byte("iv-0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	method, err := encrypt.NewMethodInstance("aes-256-cfb", "key-0", "iv-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &Body{
+		ClientDeviceId: "0123456789abcdef0123456789abcdef",
+		ClientPublicIP: net.ParseIP("10.0.0.1"),
+		ServerPublicIP: net.ParseIP("10.0.0.2"),
+	}
+	data, err := NewPacket(body, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//0x01 版本头部不包含 KEY ID
+	if data[2] != packetVersionV1 || len(data) != packetLength-packetHeaderLength+packetHeaderLengthV1 {
+		t.Fatalf("unexpected v1 packet version %d length %d", data[2], len(data))
+	}
+	packet, err := ParseKeyedPacket(data, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Version != packetVersionV1 || packet.KeyId != 0 || !packet.ServerPublicIP.Equal(body.ServerPublicIP) {
+		t.Fatalf("unexpected packet %+v", packet)
+	}
+}
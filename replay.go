@@ -0,0 +1,84 @@
+package libspa
+
+import (
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// DefaultReplayWindow spa报时间戳允许的默认偏差
+const DefaultReplayWindow = time.Minute
+
+var (
+	InvalidTimestampPacket = errors.New("invalid packet (packet timestamp is out of window)")
+	ReplayedPacket         = errors.New("invalid packet (packet is replayed)")
+)
+
+// ReplayCache 防重放缓存，记录时间窗口内已接受的spa报
+// 时间戳超出窗口的spa报直接拒绝，窗口内的spa报按密钥ID、设备ID、时间戳及随机数去重
+type ReplayCache struct {
+	window time.Duration
+
+	locker    sync.Mutex
+	seen      map[replayKey]time.Time
+	lastSweep time.Time
+}
+
+type replayKey struct {
+	keyId          uint32
+	clientDeviceId string
+	timestamp      uint64
+	nonce          string
+}
+
+// NewReplayCache 创建防重放缓存，window 小于等于0时使用 DefaultReplayWindow
+func NewReplayCache(window time.Duration) *ReplayCache {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	return &ReplayCache{window: window, seen: map[replayKey]time.Time{}}
+}
+
+// Check 校验spa报时间戳并记录，重复的spa报返回 ReplayedPacket
+func (r *ReplayCache) Check(packet *Packet, now time.Time) error {
+	timestamp := time.Unix(int64(packet.Timestamp), 0)
+	if timestamp.Before(now.Add(-r.window)) || timestamp.After(now.Add(r.window)) {
+		return InvalidTimestampPacket
+	}
+	key := replayKey{
+		keyId:          packet.KeyId,
+		clientDeviceId: packet.ClientDeviceId,
+		timestamp:      packet.Timestamp,
+		nonce:          string(packet.Nonce),
+	}
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.sweep(now)
+	if _, ok := r.seen[key]; ok {
+		return ReplayedPacket
+	}
+	//超过该时间后时间戳校验即可拒绝
+	r.seen[key] = timestamp.Add(r.window)
+	return nil
+}
+
+// Len 缓存中的记录数
+func (r *ReplayCache) Len() int {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return len(r.seen)
+}
+
+// 清理过期记录，每秒最多执行一次
+func (r *ReplayCache) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Second {
+		return
+	}
+	r.lastSweep = now
+	for key, expire := range r.seen {
+		if now.After(expire) {
+			delete(r.seen, key)
+		}
+	}
+}
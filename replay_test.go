@@ -0,0 +1,49 @@
+package libspa
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := NewReplayCache(30 * time.Second)
+	packet := &Packet{
+		Header:    Header{Version: packetVersion, KeyId: 1},
+		Timestamp: uint64(now.Unix()),
+		Nonce:     Nonce{1, 2, 3, 4},
+		Body:      Body{ClientDeviceId: "device"},
+	}
+	if err := cache.Check(packet, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Check(packet, now.Add(time.Second)); err != ReplayedPacket {
+		t.Fatal("expect ReplayedPacket, got", err)
+	}
+
+	//不同随机数或密钥ID视为不同的spa报
+	other := *packet
+	other.Nonce = Nonce{1, 2, 3, 5}
+	if err := cache.Check(&other, now); err != nil {
+		t.Fatal(err)
+	}
+	other.KeyId = 2
+	if err := cache.Check(&other, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Check(packet, now.Add(31*time.Second)); err != InvalidTimestampPacket {
+		t.Fatal("expect InvalidTimestampPacket, got", err)
+	}
+	if err := cache.Check(packet, now.Add(-31*time.Second)); err != InvalidTimestampPacket {
+		t.Fatal("expect InvalidTimestampPacket, got", err)
+	}
+
+	//过期记录被清理
+	if err := cache.Check(&Packet{Timestamp: uint64(now.Add(time.Minute).Unix())}, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Len() != 1 {
+		t.Fatal("expect expired entries to be swept, len", cache.Len())
+	}
+}
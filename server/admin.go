@@ -0,0 +1,247 @@
+package spaserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 管理接口
+//
+//	GET    /v1/grants         列出未到期的放行，可按 ip/protocol/port/device 筛选
+//	DELETE /v1/grants         撤销匹配的放行，至少需要一个筛选条件
+//	POST   /v1/grants/extend  延长放行，请求体 {"ip","protocol","port","seconds"}
+//	POST   /v1/grants/flush   撤销所有放行
+//	GET    /v1/bans           列出生效的自动封禁
+//	DELETE /v1/bans?ip=       解除封禁
+//	GET    /v1/keys           密钥有效期及使用情况
+//	GET    /v1/audit          以 JSON lines 持续输出审计事件
+//	GET    /v1/metrics        Prometheus 监控指标
+
+// 检测管理接口配置，tcp 监听必须设置令牌
+func (c *Server) checkAdmin() error {
+	if c.AdminAddr == "" {
+		return nil
+	}
+	if _, ok := unixSocketPath(c.AdminAddr); !ok && c.AdminToken == "" {
+		return errors.New("admin token is required when admin addr is not a unix socket")
+	}
+	return nil
+}
+
+// 管理接口的请求处理
+func (c *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/grants", c.adminGrants)
+	mux.HandleFunc("/v1/grants/extend", c.adminExtendGrant)
+	mux.HandleFunc("/v1/grants/flush", c.adminFlushGrants)
+	mux.HandleFunc("/v1/bans", c.adminBans)
+	mux.HandleFunc("/v1/keys", c.adminKeys)
+	mux.HandleFunc("/v1/audit", c.adminAudit)
+	if c.gatherer != nil {
+		mux.Handle("/v1/metrics", promhttp.HandlerFor(c.gatherer, promhttp.HandlerOpts{}))
+	}
+	return c.adminAuth(mux)
+}
+
+// 校验 Bearer 令牌，未设置令牌时依赖unix socket的文件权限
+func (c *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.AdminToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				adminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Server) adminGrants(w http.ResponseWriter, r *http.Request) {
+	filter, err := grantFilter(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		adminJSON(w, http.StatusOK, c.Grants(filter))
+	case http.MethodDelete:
+		if filter == (GrantFilter{}) {
+			adminError(w, http.StatusBadRequest, errors.New("grant filter is required, use POST /v1/grants/flush to revoke all grants"))
+			return
+		}
+		c.adminRevoke(w, filter)
+	default:
+		adminMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (c *Server) adminFlushGrants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	c.adminRevoke(w, GrantFilter{})
+}
+
+func (c *Server) adminRevoke(w http.ResponseWriter, filter GrantFilter) {
+	count, err := c.RevokeGrants(filter)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]int{"revoked": count})
+}
+
+// 延长放行请求
+type extendGrantRequest struct {
+	IP       string `json:"ip"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	Seconds  int    `json:"seconds"`
+}
+
+func (c *Server) adminExtendGrant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var req extendGrantRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Seconds <= 0 {
+		adminError(w, http.StatusBadRequest, InvalidConfigTimeout)
+		return
+	}
+	grant, err := c.ExtendGrant(req.IP, strings.ToLower(req.Protocol), req.Port, time.Duration(req.Seconds)*time.Second)
+	if err == ErrGrantNotFound {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+	if err == ErrGrantMaxLifetime {
+		adminError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	adminJSON(w, http.StatusOK, grant)
+}
+
+func (c *Server) adminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		bans := c.Bans()
+		if bans == nil {
+			bans = []Ban{}
+		}
+		adminJSON(w, http.StatusOK, bans)
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if ip == "" {
+			adminError(w, http.StatusBadRequest, errors.New("ip is required"))
+			return
+		}
+		err := c.Unban(ip)
+		if err == ErrBanNotFound {
+			adminError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		adminJSON(w, http.StatusOK, map[string]string{"unbanned": ip})
+	default:
+		adminMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (c *Server) adminKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	adminJSON(w, http.StatusOK, c.KeyStatus())
+}
+
+// 持续输出审计事件，客户端断开或服务停止时返回
+func (c *Server) adminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		adminError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	events, err := c.stream.subscribe()
+	if err != nil {
+		adminError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer c.stream.unsubscribe(events)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// 解析放行筛选条件
+func grantFilter(r *http.Request) (GrantFilter, error) {
+	query := r.URL.Query()
+	filter := GrantFilter{
+		IP:       query.Get("ip"),
+		Protocol: strings.ToLower(query.Get("protocol")),
+		DeviceID: query.Get("device"),
+	}
+	if port := query.Get("port"); port != "" {
+		var err error
+		filter.Port, err = strconv.Atoi(port)
+		if err != nil || filter.Port <= 0 {
+			return filter, errors.New("invalid port")
+		}
+	}
+	return filter, nil
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	adminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func adminMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
@@ -0,0 +1,226 @@
+package spaserver
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/1uLang/libspa/encrypt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAdminTestServer(t *testing.T) (*Server, *recordFirewall) {
+	srv, _ := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	firewall := &recordFirewall{}
+	srv.Firewall = firewall
+	srv.AdminToken = "secret"
+	now := time.Now()
+	srv.grants.add(&Rule{IP: "10.0.0.1", Protocol: "tcp", Port: 22, Timeout: 30}, firstDevice, "alice", now)
+	srv.grants.add(&Rule{IP: "10.0.0.1", Protocol: "udp", Port: 53, Timeout: 30}, firstDevice, "alice", now)
+	srv.grants.add(&Rule{IP: "10.0.0.2", Protocol: "tcp", Port: 22, Timeout: 30}, replayedDevice, "", now)
+	//已到期的放行不列出
+	srv.grants.add(&Rule{IP: "10.0.0.3", Protocol: "tcp", Port: 22, Timeout: 30}, "", "", now.Add(-time.Minute))
+	return srv, firewall
+}
+
+func adminRequest(t *testing.T, h http.Handler, method, target, body string, v interface{}) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func TestServer_AdminGrants(t *testing.T) {
+	srv, firewall := newAdminTestServer(t)
+	h := srv.adminHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/grants", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("expect unauthorized without token", w.Code)
+	}
+
+	var grants []Grant
+	if code := adminRequest(t, h, http.MethodGet, "/v1/grants", "", &grants); code != http.StatusOK || len(grants) != 3 {
+		t.Fatal("unexpected grants", code, grants)
+	}
+	if grants[0].IP != "10.0.0.1" || grants[0].DeviceID != firstDevice || grants[0].User != "alice" {
+		t.Fatal("unexpected grant", grants[0])
+	}
+	if code := adminRequest(t, h, http.MethodGet, "/v1/grants?device="+replayedDevice, "", &grants); code != http.StatusOK || len(grants) != 1 || grants[0].IP != "10.0.0.2" {
+		t.Fatal("unexpected filtered grants", code, grants)
+	}
+
+	//延长放行
+	var grant Grant
+	before := srv.Grants(GrantFilter{IP: "10.0.0.2"})[0].Expires
+	body := `{"ip":"10.0.0.2","protocol":"tcp","port":22,"seconds":60}`
+	if code := adminRequest(t, h, http.MethodPost, "/v1/grants/extend", body, &grant); code != http.StatusOK {
+		t.Fatal("extend grant failed", code)
+	}
+	if d := grant.Expires.Sub(before); d < 59*time.Second || d > 61*time.Second {
+		t.Fatal("unexpected extended expiry", d)
+	}
+	if len(firewall.opened) != 1 || firewall.opened[0].Timeout < 89 || firewall.opened[0].Timeout > 90 {
+		t.Fatal("unexpected firewall open", firewall.opened)
+	}
+	body = `{"ip":"10.0.0.3","protocol":"tcp","port":22,"seconds":60}`
+	if code := adminRequest(t, h, http.MethodPost, "/v1/grants/extend", body, nil); code != http.StatusNotFound {
+		t.Fatal("expect expired grant not found", code)
+	}
+
+	//撤销需要筛选条件
+	if code := adminRequest(t, h, http.MethodDelete, "/v1/grants", "", nil); code != http.StatusBadRequest {
+		t.Fatal("expect filter required", code)
+	}
+	var revoked map[string]int
+	if code := adminRequest(t, h, http.MethodDelete, "/v1/grants?ip=10.0.0.1", "", &revoked); code != http.StatusOK || revoked["revoked"] != 2 {
+		t.Fatal("unexpected revoke", code, revoked)
+	}
+	if len(firewall.closed) != 2 || firewall.closed[0].IP != "10.0.0.1" {
+		t.Fatal("unexpected firewall close", firewall.closed)
+	}
+	if code := adminRequest(t, h, http.MethodPost, "/v1/grants/flush", "", &revoked); code != http.StatusOK || revoked["revoked"] != 1 {
+		t.Fatal("unexpected flush", code, revoked)
+	}
+	if len(srv.Grants(GrantFilter{})) != 0 || len(firewall.closed) != 3 {
+		t.Fatal("grants were not flushed", firewall.closed)
+	}
+}
+
+func TestServer_ExtendGrantMaxLifetime(t *testing.T) {
+	srv, firewall := newAdminTestServer(t)
+	srv.MaxGrantLifetime = 45 * time.Second
+	h := srv.adminHandler()
+
+	var grant Grant
+	body := `{"ip":"10.0.0.2","protocol":"tcp","port":22,"seconds":60}`
+	if code := adminRequest(t, h, http.MethodPost, "/v1/grants/extend", body, &grant); code != http.StatusOK {
+		t.Fatal("extend grant failed", code)
+	}
+	if limit := grant.Created.Add(srv.MaxGrantLifetime); grant.Expires.After(limit.Add(time.Second)) {
+		t.Fatal("extended grant exceeds max lifetime", grant.Expires, limit)
+	}
+	if len(firewall.opened) != 1 || firewall.opened[0].Timeout > 45 {
+		t.Fatal("unexpected firewall open", firewall.opened)
+	}
+
+	//已达到最长时间
+	srv.MaxGrantLifetime = time.Second / 2
+	if code := adminRequest(t, h, http.MethodPost, "/v1/grants/extend", body, nil); code != http.StatusConflict {
+		t.Fatal("expect conflict beyond max lifetime", code)
+	}
+	if _, err := srv.ExtendGrant("10.0.0.2", "tcp", 22, time.Minute); err != ErrGrantMaxLifetime {
+		t.Fatal("expect ErrGrantMaxLifetime, got", err)
+	}
+}
+
+func TestServer_AdminAddr(t *testing.T) {
+	srv, _ := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	srv.AdminAddr = "127.0.0.1:0"
+	if err := srv.checkAdmin(); err == nil {
+		t.Fatal("expect token required for tcp admin addr")
+	}
+
+	//unix socket 依赖文件权限，不要求令牌
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	srv.AdminAddr = "unix:" + path
+	errs, _ := runTestServer(t, srv, context.Background())
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("unexpected admin socket mode", info, err)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatal("temporary socket directory should be removed", entries)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://spa/v1/grants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.StatusCode)
+	}
+
+	//管理接口启用时注册独立的监控指标
+	resp, err = client.Get("http://spa/v1/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(data), "spa_active_grants 0") {
+		t.Fatal("unexpected metrics", string(data))
+	}
+
+	//订阅审计事件，服务停止时结束输出
+	resp, err = client.Get("http://spa/v1/audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	srv.Firewall = &recordFirewall{}
+	srv.grants.add(&Rule{IP: "10.0.0.1", Protocol: "tcp", Port: 22, Timeout: 30}, firstDevice, "alice", time.Now())
+	if _, err := srv.FlushGrants(); err != nil {
+		t.Fatal(err)
+	}
+	var event AuditEvent
+	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != AuditRevoke || event.GrantIP != "10.0.0.1" || event.DeviceID != firstDevice {
+		t.Fatal("unexpected audit event", event)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-errs
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("admin socket should be removed on shutdown", err)
+	}
+}
+
+func TestServer_AdminKeys(t *testing.T) {
+	srv, _ := newAdminTestServer(t)
+	now := time.Now()
+	if err := srv.AddKey(&encrypt.Key{ID: 2, Key: []byte("next-key"), IV: []byte("next-iv"), NotBefore: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	srv.usage.use(testKey.ID, now)
+	srv.usage.use(testKey.ID, now)
+
+	var keys []KeyStatus
+	if code := adminRequest(t, srv.adminHandler(), http.MethodGet, "/v1/keys", "", &keys); code != http.StatusOK || len(keys) != 2 {
+		t.Fatal("unexpected keys", code, keys)
+	}
+	if !keys[0].Valid || !keys[0].Newest || keys[0].Packets != 2 || keys[0].LastUsed == nil {
+		t.Fatal("unexpected key status", keys[0])
+	}
+	if keys[1].Valid || keys[1].Newest || keys[1].NotBefore == nil || keys[1].Packets != 0 {
+		t.Fatal("unexpected key status", keys[1])
+	}
+
+	var bans []Ban
+	if code := adminRequest(t, srv.adminHandler(), http.MethodGet, "/v1/bans", "", &bans); code != http.StatusOK || len(bans) != 0 {
+		t.Fatal("unexpected bans", code, bans)
+	}
+	if code := adminRequest(t, srv.adminHandler(), http.MethodDelete, "/v1/bans?ip=10.0.0.1", "", nil); code != http.StatusNotFound {
+		t.Fatal("expect ban not found", code)
+	}
+}
@@ -0,0 +1,103 @@
+package spaserver
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// 审计事件类型
+const (
+	AuditKnock  = "knock"
+	AuditGrant  = "grant"
+	AuditRevoke = "revoke"
+	AuditBan    = "ban"
+	AuditUnban  = "unban"
+)
+
+// 认证结果
+const (
+	DecisionAllow   = "allow"
+	DecisionBlock   = "block"
+	DecisionInvalid = "invalid"
+	//来源IP被封禁，未解析spa报
+	DecisionBanned = "banned"
+	//被限速丢弃
+	DecisionRateLimited = "rate_limited"
+)
+
+// AuditEvent 审计事件，记录每个spa报的认证结果及每次防火墙变更
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	//事件类型 knock/grant/revoke/ban/unban
+	Type     string `json:"type"`
+	Protocol string `json:"protocol,omitempty"`
+	SourceIP string `json:"source_ip,omitempty"`
+	DeviceID string `json:"device_id,omitempty"`
+	//OnAuthority 返回的用户
+	User   string `json:"user,omitempty"`
+	Method string `json:"method,omitempty"`
+	KeyID  uint32 `json:"key_id,omitempty"`
+	//认证结果 allow/block/invalid/banned/rate_limited
+	Decision string `json:"decision,omitempty"`
+	//设备已有该来源IP未到期的放行
+	Renewal bool `json:"renewal,omitempty"`
+	//放行或封禁的IP
+	GrantIP string `json:"grant_ip,omitempty"`
+	//放行的端口，如 tcp/22
+	Ports []string `json:"ports,omitempty"`
+	//放行或封禁的到期时间
+	Expires *time.Time `json:"expires,omitempty"`
+	//错误码，见 ErrorCode
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// AuditSink 审计事件输出接口，需支持并发调用
+type AuditSink interface {
+	Audit(event *AuditEvent) error
+}
+
+// 审计事件分发，与日志级别及测试模式无关
+type auditor struct {
+	sinks []AuditSink
+}
+
+func newAuditor(sinks []AuditSink) *auditor {
+	if len(sinks) == 0 {
+		return nil
+	}
+	return &auditor{sinks: sinks}
+}
+
+func (a *auditor) emit(event *AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, sink := range a.sinks {
+		if err := sink.Audit(event); err != nil {
+			log.Error(fmt.Sprintf("audit %s event err:", event.Type), err)
+		}
+	}
+}
+
+// 防火墙变更事件
+func ruleEvent(typ string, rule *Rule, err error) *AuditEvent {
+	event := &AuditEvent{
+		Type:     typ,
+		Protocol: rule.Protocol,
+		GrantIP:  rule.IP,
+		Ports:    []string{rule.service()},
+	}
+	if typ == AuditGrant && err == nil {
+		expires := time.Now().Add(time.Duration(rule.Timeout) * time.Second)
+		event.Expires = &expires
+	}
+	if err != nil {
+		event.Error, event.Message = CodeFirewall, err.Error()
+	}
+	return event
+}
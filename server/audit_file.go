@@ -0,0 +1,107 @@
+package spaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// JSONFileSink 以 JSON lines 格式写入审计事件，文件超过 MaxSize 时轮转
+// 轮转后的文件为 path.1 ... path.N，N 为 MaxBackups
+type JSONFileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	locker sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+// NewJSONFileSink 创建审计文件，maxSize 为0时不轮转
+func NewJSONFileSink(path string, maxSize int64, maxBackups int) (*JSONFileSink, error) {
+	s := &JSONFileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Audit 写入审计事件
+func (s *JSONFileSink) Audit(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Close 关闭审计文件
+func (s *JSONFileSink) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *JSONFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// 轮转文件，超出 maxBackups 的旧文件被删除
+func (s *JSONFileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	if s.maxBackups <= 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	var err error
+	for i := s.maxBackups - 1; i > 0 && err == nil; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(s.path, s.path+".1")
+	}
+	//轮转失败时继续写入原文件
+	if oerr := s.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
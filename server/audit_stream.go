@@ -0,0 +1,71 @@
+package spaserver
+
+import (
+	"errors"
+	"sync"
+)
+
+var errAuditStreamClosed = errors.New("audit stream closed")
+
+// 管理接口的实时审计事件订阅，订阅者处理不及时时丢弃事件
+type auditStream struct {
+	locker      sync.Mutex
+	subscribers map[chan *AuditEvent]struct{}
+	closed      bool
+}
+
+func newAuditStream() *auditStream {
+	return &auditStream{subscribers: map[chan *AuditEvent]struct{}{}}
+}
+
+// Audit 分发审计事件
+func (s *auditStream) Audit(event *AuditEvent) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for ch := range s.subscribers {
+		e := *event
+		select {
+		case ch <- &e:
+		default:
+		}
+	}
+	return nil
+}
+
+// 订阅审计事件，停止服务时关闭返回的通道
+func (s *auditStream) subscribe() (chan *AuditEvent, error) {
+	if s == nil {
+		return nil, errAuditStreamClosed
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.closed {
+		return nil, errAuditStreamClosed
+	}
+	ch := make(chan *AuditEvent, 64)
+	s.subscribers[ch] = struct{}{}
+	return ch, nil
+}
+
+func (s *auditStream) unsubscribe(ch chan *AuditEvent) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if _, ok := s.subscribers[ch]; ok {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// 关闭所有订阅，使管理接口可以停止
+func (s *auditStream) close() {
+	if s == nil {
+		return
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.closed = true
+	for ch := range s.subscribers {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
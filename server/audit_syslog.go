@@ -0,0 +1,263 @@
+package spaserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LOG_AUTHPRIV
+	syslogFacility = 10
+	// 结构化数据ID，32473 为文档示例保留的企业编号
+	syslogSDID = "spa@32473"
+
+	syslogSeverityWarning = 4
+	syslogSeverityNotice  = 5
+	syslogSeverityInfo    = 6
+
+	syslogDialTimeout  = 2 * time.Second
+	syslogWriteTimeout = time.Second
+	//重连失败后的重试间隔
+	syslogRetryInterval = 5 * time.Second
+	//待发送事件的队列长度
+	syslogQueueSize = 1024
+)
+
+var (
+	// ErrSyslogUnavailable syslog 服务不可用，事件被丢弃
+	ErrSyslogUnavailable = errors.New("syslog server unavailable")
+	// ErrSyslogQueueFull 待发送事件过多，事件被丢弃
+	ErrSyslogQueueFull = errors.New("syslog queue is full")
+)
+
+// SyslogSink 以 RFC 5424 格式发送审计事件，tcp 使用 RFC 6587 octet-counting 分帧
+// 结构化数据包含主要字段，MSG 为完整的 JSON 事件
+// 事件由后台goroutine发送，不阻塞认证流程
+type SyslogSink struct {
+	network  string
+	addr     string
+	appName  string
+	hostname string
+	queue    chan []byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	locker  sync.Mutex
+	conn    net.Conn
+	dialing bool
+	retry   time.Time
+	closed  bool
+}
+
+// NewSyslogSink 连接 syslog 服务，network 为 udp/tcp/unix/unixgram
+func NewSyslogSink(network, addr, appName string) (*SyslogSink, error) {
+	hostname, _ := os.Hostname()
+	s := &SyslogSink{
+		network:  network,
+		addr:     addr,
+		appName:  syslogName(appName, 48),
+		hostname: syslogName(hostname, 255),
+		queue:    make(chan []byte, syslogQueueSize),
+		done:     make(chan struct{}),
+	}
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// Audit 将审计事件加入发送队列，连接断开时在后台重连，重连成功前丢弃事件并返回 ErrSyslogUnavailable
+// 队列已满时丢弃事件并返回 ErrSyslogQueueFull
+func (s *SyslogSink) Audit(event *AuditEvent) error {
+	msg, err := s.format(event)
+	if err != nil {
+		return err
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.conn == nil || s.closed {
+		s.reconnect()
+		return ErrSyslogUnavailable
+	}
+	select {
+	case s.queue <- msg:
+		return nil
+	default:
+		return ErrSyslogQueueFull
+	}
+}
+
+// Close 发送队列中剩余的事件后关闭连接
+func (s *SyslogSink) Close() error {
+	s.locker.Lock()
+	if s.closed {
+		s.locker.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.locker.Unlock()
+	s.wg.Wait()
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// 串行发送队列中的事件，tcp 分帧需串行写入
+func (s *SyslogSink) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case msg := <-s.queue:
+			s.write(msg)
+		case <-s.done:
+			for {
+				select {
+				case msg := <-s.queue:
+					s.write(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// 写入一条消息，写超时避免连接阻塞时队列无法消费，失败时丢弃并在后台重连
+func (s *SyslogSink) write(msg []byte) {
+	s.locker.Lock()
+	conn := s.conn
+	s.locker.Unlock()
+	if conn == nil {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := conn.Write(msg); err != nil {
+		s.locker.Lock()
+		defer s.locker.Unlock()
+		if s.conn == conn {
+			s.conn.Close()
+			s.conn = nil
+			s.reconnect()
+		}
+	}
+}
+
+func (s *SyslogSink) dial() error {
+	conn, err := net.DialTimeout(s.network, s.addr, syslogDialTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// 在后台重连，调用时需持有锁
+func (s *SyslogSink) reconnect() {
+	if s.dialing || s.closed || time.Now().Before(s.retry) {
+		return
+	}
+	s.dialing = true
+	go func() {
+		conn, err := net.DialTimeout(s.network, s.addr, syslogDialTimeout)
+		s.locker.Lock()
+		defer s.locker.Unlock()
+		s.dialing = false
+		switch {
+		case err != nil:
+			s.retry = time.Now().Add(syslogRetryInterval)
+		case s.closed:
+			conn.Close()
+		default:
+			s.conn = conn
+		}
+	}()
+}
+
+// 格式化为 RFC 5424 消息
+func (s *SyslogSink) format(event *AuditEvent) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "<%d>1 %s %s %s %d %s ",
+		syslogFacility*8+syslogSeverity(event),
+		event.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.appName, os.Getpid(), syslogName(event.Type, 32))
+
+	b.WriteString("[" + syslogSDID)
+	params := [][2]string{
+		{"source_ip", event.SourceIP},
+		{"device_id", event.DeviceID},
+		{"user", event.User},
+		{"method", event.Method},
+		{"decision", event.Decision},
+		{"grant_ip", event.GrantIP},
+		{"ports", strings.Join(event.Ports, ",")},
+		{"error", event.Error},
+	}
+	if event.Expires != nil {
+		params = append(params, [2]string{"expires", event.Expires.UTC().Format(time.RFC3339)})
+	}
+	for _, p := range params {
+		if p[1] != "" {
+			b.WriteString(" " + p[0] + "=\"" + syslogEscape(p[1]) + "\"")
+		}
+	}
+	b.WriteString("] ")
+	b.Write(data)
+
+	msg := b.String()
+	if s.network == "tcp" || s.network == "tcp4" || s.network == "tcp6" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	return []byte(msg), nil
+}
+
+func syslogSeverity(event *AuditEvent) int {
+	switch {
+	case event.Error != "" || event.Type == AuditBan:
+		return syslogSeverityWarning
+	case event.Decision == DecisionBlock || event.Decision == DecisionBanned || event.Decision == DecisionRateLimited:
+		return syslogSeverityNotice
+	}
+	return syslogSeverityInfo
+}
+
+// 头部字段仅允许可见ASCII字符，为空时使用 NILVALUE
+func syslogName(s string, max int) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+	if len(name) > max {
+		name = name[:max]
+	}
+	if name == "" {
+		return "-"
+	}
+	return name
+}
+
+// 结构化数据值需转义 " \ ]
+func syslogEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
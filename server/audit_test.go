@@ -0,0 +1,278 @@
+package spaserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录审计事件
+type memorySink struct {
+	locker sync.Mutex
+	events []AuditEvent
+}
+
+func (s *memorySink) Audit(event *AuditEvent) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.events = append(s.events, *event)
+	return nil
+}
+
+func TestHandler_Audit(t *testing.T) {
+	srv, h := newTestServer(t)
+	sink := &memorySink{}
+	srv.AuditSinks = []AuditSink{sink}
+	srv.Firewall = &recordFirewall{}
+	srv.audit = nil
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	h.allow = &Allow{TcpPorts: []int{22}, UdpPorts: []int{53}, User: "alice"}
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	packet := newTestPacket(t, firstDevice)
+	handler.authority(conn, packet)
+	handler.authority(conn, packet)
+	handler.authority(conn, []byte("garbage"))
+
+	if len(sink.events) != 5 {
+		t.Fatalf("expect 5 events, got %+v", sink.events)
+	}
+	for i, typ := range []string{AuditGrant, AuditGrant, AuditKnock} {
+		if sink.events[i].Type != typ {
+			t.Fatalf("event %d: expect %s, got %s", i, typ, sink.events[i].Type)
+		}
+	}
+	knock := sink.events[2]
+	if knock.Decision != DecisionAllow || knock.User != "alice" || knock.DeviceID != firstDevice ||
+		knock.Method != "aes-256-cfb" || knock.KeyID != testKey.ID || knock.SourceIP != "127.0.0.1" ||
+		strings.Join(knock.Ports, ",") != "tcp/22,udp/53" || knock.Expires == nil {
+		t.Fatalf("unexpected knock event %+v", knock)
+	}
+	if replay := sink.events[3]; replay.Decision != DecisionInvalid || replay.Error != CodeReplay {
+		t.Fatalf("unexpected replay event %+v", replay)
+	}
+	if garbage := sink.events[4]; garbage.Error != CodeBadStartCode || garbage.DeviceID != "" {
+		t.Fatalf("unexpected garbage event %+v", garbage)
+	}
+}
+
+// 被限速或封禁丢弃的spa报同样记录审计事件
+func TestHandler_AuditDropped(t *testing.T) {
+	srv, _ := newTestServer(t)
+	sink := &memorySink{}
+	srv.AuditSinks = []AuditSink{sink}
+	srv.RateLimits.Device = RateLimit{Rate: 0.001, Burst: 1}
+	srv.Ban = BanPolicy{MaxFailures: 1}
+	srv.audit, srv.limits, srv.bans = nil, nil, nil
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	packet := newTestPacket(t, firstDevice)
+	handler.authority(conn, packet)
+	handler.authority(conn, newTestPacket(t, firstDevice))
+	//重放后来源IP被封禁
+	handler.authority(conn, packet)
+	handler.authority(conn, newTestPacket(t, replayedDevice))
+
+	sink.locker.Lock()
+	defer sink.locker.Unlock()
+	if n := len(sink.events); n < 3 {
+		t.Fatalf("unexpected events %+v", sink.events)
+	}
+	limited := sink.events[1]
+	if limited.Decision != DecisionRateLimited || limited.Error != CodeRateLimited || limited.DeviceID != firstDevice {
+		t.Fatalf("unexpected rate limited event %+v", limited)
+	}
+	banned := sink.events[len(sink.events)-1]
+	if banned.Type != AuditKnock || banned.Decision != DecisionBanned || banned.SourceIP != "127.0.0.1" || banned.Protocol != "udp" {
+		t.Fatalf("unexpected banned event %+v", banned)
+	}
+}
+
+// handler 忽略或包装解析错误时仍记录为无效报文
+func TestHandler_AuditParseError(t *testing.T) {
+	srv, _ := newTestServer(t)
+	sink := &memorySink{}
+	srv.AuditSinks = []AuditSink{sink}
+	srv.audit = nil
+	srv.Use(func(next AuthorityFunc) AuthorityFunc {
+		return func(req *Request) (*Allow, error) {
+			if req.Raw[0] == 'w' {
+				return nil, fmt.Errorf("wrapped: %w", req.Err)
+			}
+			return nil, nil
+		}
+	})
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	handler.authority(conn, []byte("garbage"))
+	handler.authority(conn, []byte("wrapped"))
+
+	if len(sink.events) != 2 {
+		t.Fatalf("expect 2 events, got %+v", sink.events)
+	}
+	for _, event := range sink.events {
+		if event.Decision != DecisionInvalid || event.Error != CodeBadStartCode {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	}
+}
+
+func TestJSONFileSink_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewJSONFileSink(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	for i := 0; i < 10; i++ {
+		if err := sink.Audit(&AuditEvent{Time: time.Unix(1700000000, 0).UTC(), Type: AuditKnock, DeviceID: firstDevice}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 || info.Mode().Perm() != 0600 {
+			t.Fatalf("%s: unexpected size %d mode %v", name, info.Size(), info.Mode())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("expect old backups to be removed")
+	}
+
+	file, err := os.Open(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			t.Fatal(err)
+		}
+		if event.DeviceID != firstDevice {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink, err := NewSyslogSink("udp", pc.LocalAddr().String(), "spa server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	expires := time.Unix(1700000030, 0)
+	err = sink.Audit(&AuditEvent{
+		Time:     time.Unix(1700000000, 0).UTC(),
+		Type:     AuditKnock,
+		SourceIP: "192.0.2.1",
+		User:     `a"b]c\d`,
+		Decision: DecisionBlock,
+		Ports:    []string{"tcp/22", "udp/53"},
+		Expires:  &expires,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	header := regexp.MustCompile(`^<85>1 2023-11-14T22:13:20\.000000Z \S+ spaserver \d+ knock \[spa@32473 `)
+	if !header.MatchString(msg) {
+		t.Fatal("unexpected syslog header", msg)
+	}
+	for _, want := range []string{
+		`source_ip="192.0.2.1"`,
+		`user="a\"b\]c\\d"`,
+		`ports="tcp/22,udp/53"`,
+		`expires="2023-11-14T22:13:50Z"`,
+		`] {"time":"2023-11-14T22:13:20Z"`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("expect %s in %s", want, msg)
+		}
+	}
+	if strings.Contains(msg, "device_id=") {
+		t.Fatal("empty params must be omitted", msg)
+	}
+}
+
+// 连接断开时丢弃事件并在后台重连
+func TestSyslogSink_Reconnect(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink, err := NewSyslogSink("udp", pc.LocalAddr().String(), "spa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.locker.Lock()
+	sink.conn.Close()
+	sink.conn = nil
+	sink.locker.Unlock()
+
+	event := &AuditEvent{Time: time.Now(), Type: AuditKnock, DeviceID: firstDevice}
+	if err := sink.Audit(event); err != ErrSyslogUnavailable {
+		t.Fatal("expect ErrSyslogUnavailable, got", err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for sink.Audit(event) == ErrSyslogUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("syslog sink did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf[:n]), firstDevice) {
+		t.Fatal("unexpected syslog message", string(buf[:n]))
+	}
+}
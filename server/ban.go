@@ -0,0 +1,273 @@
+package spaserver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/1uLang/libspa"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrBanNotFound = errors.New("ban not found")
+
+// BanPolicy 自动封禁配置，窗口内无效spa报数量达到 MaxFailures 后封禁来源IP
+// 同一IP再次被封禁时封禁时长加倍，直至 MaxBanTime
+//
+// udp 来源地址可被伪造，攻击者可借此封禁网关、管理员或DNS服务器等地址，
+// 因此起始码或头部错误的数据报不计入封禁，防火墙封禁仅丢弃发往spa监听的流量，
+// 重要的地址应加入 Allowlist
+type BanPolicy struct {
+	//窗口内允许的无效spa报数量，为0时不启用
+	MaxFailures int
+	//统计窗口，为0时为1分钟
+	Window time.Duration
+	//首次封禁时长，为0时为10分钟
+	BanTime time.Duration
+	//封禁时长上限，为0时为24小时，距上次封禁结束超过该时长后重新计算
+	MaxBanTime time.Duration
+	//不封禁的IP或网段
+	Allowlist []string
+}
+
+// Ban 封禁记录
+type Ban struct {
+	IP string `json:"ip"`
+	//封禁时间
+	Since time.Time `json:"since"`
+	//解除时间
+	Until time.Time `json:"until"`
+	//连续被封禁的次数
+	Count int `json:"count"`
+}
+
+// 封禁列表
+type banList struct {
+	policy    BanPolicy
+	allowlist []*net.IPNet
+	firewall  BanFirewall
+	audit     *auditor
+	metrics   *metrics
+
+	locker    sync.Mutex
+	listeners []Listener
+	failures  map[string][]time.Time
+	bans      map[string]*Ban
+	lastSweep time.Time
+}
+
+// 未启用时返回空
+func newBanList(policy BanPolicy, firewall Firewall, audit *auditor) (*banList, error) {
+	if policy.MaxFailures <= 0 {
+		return nil, nil
+	}
+	allowlist, err := parseCIDRs(policy.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Window <= 0 {
+		policy.Window = time.Minute
+	}
+	if policy.BanTime <= 0 {
+		policy.BanTime = 10 * time.Minute
+	}
+	if policy.MaxBanTime <= 0 {
+		policy.MaxBanTime = 24 * time.Hour
+	}
+	if policy.MaxBanTime < policy.BanTime {
+		policy.MaxBanTime = policy.BanTime
+	}
+	l := &banList{
+		policy:    policy,
+		allowlist: allowlist,
+		audit:     audit,
+		failures:  map[string][]time.Time{},
+		bans:      map[string]*Ban{},
+	}
+	l.firewall, _ = firewall.(BanFirewall)
+	return l, nil
+}
+
+// 设置防火墙封禁的spa监听
+func (l *banList) setListeners(listeners []Listener) {
+	if l == nil {
+		return
+	}
+	l.locker.Lock()
+	l.listeners = listeners
+	l.locker.Unlock()
+}
+
+// 无效spa报是否计入封禁，起始码或头部错误的数据报可能为伪造来源的垃圾数据，不计入
+func banFailure(err error) bool {
+	return !errors.Is(err, libspa.InvalidStartCodePacket) && !errors.Is(err, libspa.InvalidHeaderPacket)
+}
+
+// 判断IP是否被封禁
+func (l *banList) banned(ip net.IP, now time.Time) bool {
+	if l == nil || ip == nil {
+		return false
+	}
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	ban, ok := l.bans[ip.String()]
+	return ok && now.Before(ban.Until)
+}
+
+// 记录无效spa报，达到阈值时封禁
+func (l *banList) fail(ip net.IP, now time.Time) {
+	if l == nil || ip == nil || containsIP(l.allowlist, ip) {
+		return
+	}
+	key := ip.String()
+	l.locker.Lock()
+	l.sweep(now)
+	if ban, ok := l.bans[key]; ok && now.Before(ban.Until) {
+		l.locker.Unlock()
+		return
+	}
+	failures := append(l.recent(l.failures[key], now), now)
+	if len(failures) < l.policy.MaxFailures {
+		l.failures[key] = failures
+		l.locker.Unlock()
+		return
+	}
+	delete(l.failures, key)
+	ban := &Ban{IP: key, Since: now, Count: 1}
+	duration := l.policy.BanTime
+	if last, ok := l.bans[key]; ok && now.Sub(last.Until) < l.policy.MaxBanTime {
+		ban.Count = last.Count + 1
+		for i := 1; i < ban.Count && duration < l.policy.MaxBanTime; i++ {
+			duration *= 2
+		}
+		if duration > l.policy.MaxBanTime {
+			duration = l.policy.MaxBanTime
+		}
+	}
+	ban.Until = now.Add(duration)
+	l.bans[key] = ban
+	listeners := l.listeners
+	l.locker.Unlock()
+
+	message := fmt.Sprintf("banned for %s after %d invalid packets", duration, l.policy.MaxFailures)
+	log.Warn(fmt.Sprintf("[%s] %s", key, message))
+	event := &AuditEvent{Time: now, Type: AuditBan, SourceIP: key, GrantIP: key, Expires: &ban.Until, Message: message}
+	if l.firewall != nil {
+		if err := l.firewall.Ban(key, int(duration/time.Second), listeners); err != nil {
+			log.Error(fmt.Sprintf("ban %s err:", key), err)
+			event.Error, event.Message = CodeFirewall, err.Error()
+			l.metrics.firewallFailure("ban")
+		}
+	}
+	l.audit.emit(event)
+}
+
+// 解除封禁事件
+func (l *banList) unbanEvent(ip string, err error) {
+	event := &AuditEvent{Type: AuditUnban, GrantIP: ip}
+	if err != nil {
+		l.metrics.firewallFailure("unban")
+		event.Error, event.Message = CodeFirewall, err.Error()
+	}
+	l.audit.emit(event)
+}
+
+// 窗口内的失败记录
+func (l *banList) recent(failures []time.Time, now time.Time) []time.Time {
+	for len(failures) > 0 && now.Sub(failures[0]) > l.policy.Window {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+// 清理过期记录，每秒最多执行一次
+// 封禁记录在解除后保留 MaxBanTime 用于计算下次封禁时长
+func (l *banList) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Second {
+		return
+	}
+	l.lastSweep = now
+	for key, failures := range l.failures {
+		if failures = l.recent(failures, now); len(failures) == 0 {
+			delete(l.failures, key)
+		} else {
+			l.failures[key] = failures
+		}
+	}
+	for key, ban := range l.bans {
+		if now.Sub(ban.Until) >= l.policy.MaxBanTime {
+			delete(l.bans, key)
+		}
+	}
+}
+
+// 当前生效的封禁，按解除时间排序
+func (l *banList) list(now time.Time) []Ban {
+	if l == nil {
+		return nil
+	}
+	l.locker.Lock()
+	bans := make([]Ban, 0, len(l.bans))
+	for _, ban := range l.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	l.locker.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// 解除封禁，同时清除失败记录及封禁次数
+func (l *banList) unban(ip string) error {
+	if l == nil {
+		return ErrBanNotFound
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return errors.New("invalid ip " + ip)
+	}
+	key := parsed.String()
+	l.locker.Lock()
+	_, ok := l.bans[key]
+	delete(l.bans, key)
+	delete(l.failures, key)
+	l.locker.Unlock()
+	if !ok {
+		return ErrBanNotFound
+	}
+	var err error
+	if l.firewall != nil {
+		err = l.firewall.Unban(key)
+	}
+	l.unbanEvent(key, err)
+	return err
+}
+
+// 解除所有封禁
+func (l *banList) clear() error {
+	if l == nil {
+		return nil
+	}
+	l.locker.Lock()
+	bans := l.bans
+	l.bans = map[string]*Ban{}
+	l.failures = map[string][]time.Time{}
+	l.locker.Unlock()
+	var err error
+	for key := range bans {
+		var e error
+		if l.firewall != nil {
+			e = l.firewall.Unban(key)
+		}
+		l.unbanEvent(key, e)
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
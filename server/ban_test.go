@@ -0,0 +1,154 @@
+package spaserver
+
+import (
+	"github.com/1uLang/libspa"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 记录封禁的防火墙
+type banFirewall struct {
+	recordFirewall
+	bans      map[string]int
+	listeners []Listener
+}
+
+func (f *banFirewall) Ban(ip string, timeout int, listeners []Listener) error {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.bans[ip] = timeout
+	f.listeners = listeners
+	return nil
+}
+
+func (f *banFirewall) Unban(ip string) error {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	delete(f.bans, ip)
+	return nil
+}
+
+func TestBanList(t *testing.T) {
+	firewall := &banFirewall{bans: map[string]int{}}
+	l, err := newBanList(BanPolicy{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		BanTime:     time.Minute,
+		MaxBanTime:  3 * time.Minute,
+		Allowlist:   []string{"10.0.0.0/8"},
+	}, firewall, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	ip := net.ParseIP("192.0.2.1")
+
+	//窗口外的失败不计入
+	l.fail(ip, now)
+	l.fail(ip, now.Add(2*time.Minute))
+	l.fail(ip, now.Add(2*time.Minute))
+	if l.banned(ip, now.Add(2*time.Minute)) {
+		t.Fatal("failures outside window must not count")
+	}
+	now = now.Add(2 * time.Minute)
+	l.fail(ip, now)
+	if !l.banned(ip, now) || firewall.bans[ip.String()] != 60 {
+		t.Fatal("expect ip to be banned for 60s", firewall.bans)
+	}
+	if bans := l.list(now); len(bans) != 1 || bans[0].Count != 1 || !bans[0].Until.Equal(now.Add(time.Minute)) {
+		t.Fatal("unexpected bans", bans)
+	}
+
+	//再次封禁时长加倍，直至上限
+	for i, want := range []int{120, 180, 180} {
+		now = now.Add(210 * time.Second)
+		if l.banned(ip, now) {
+			t.Fatal("ban must expire", i)
+		}
+		for j := 0; j < 3; j++ {
+			l.fail(ip, now)
+		}
+		if firewall.bans[ip.String()] != want {
+			t.Fatalf("%d: expect ban for %ds, got %d", i, want, firewall.bans[ip.String()])
+		}
+	}
+
+	//允许列表中的IP不封禁
+	allowed := net.ParseIP("10.1.2.3")
+	for j := 0; j < 5; j++ {
+		l.fail(allowed, now)
+	}
+	if l.banned(allowed, now) {
+		t.Fatal("allowlisted ip must not be banned")
+	}
+
+	if err := l.unban("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if l.banned(ip, now) || len(firewall.bans) != 0 {
+		t.Fatal("expect ban to be cleared")
+	}
+	if err := l.unban("192.0.2.1"); err != ErrBanNotFound {
+		t.Fatal("expect ErrBanNotFound, got", err)
+	}
+	for j := 0; j < 3; j++ {
+		l.fail(net.ParseIP("2001:db8::1"), now)
+	}
+	if err := l.clear(); err != nil || len(l.list(now)) != 0 || len(firewall.bans) != 0 {
+		t.Fatal("expect all bans to be cleared", err)
+	}
+}
+
+func TestHandler_Ban(t *testing.T) {
+	srv, h := newTestServer(t)
+	srv.Ban = BanPolicy{MaxFailures: 2}
+	srv.Firewall = &banFirewall{bans: map[string]int{}}
+	srv.bans = nil
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	listeners := []Listener{{Protocol: "udp", Addr: "0.0.0.0:62201"}}
+	srv.bans.setListeners(listeners)
+	//起始码错误的数据报可能为伪造来源，不计入封禁
+	for i := 0; i < 3; i++ {
+		handler.authority(conn, []byte("junk"))
+		h.wait(t)
+	}
+	if len(srv.Bans()) != 0 {
+		t.Fatal("invalid start code must not count toward a ban")
+	}
+	packet := newTestPacket(t, firstDevice)
+	handler.authority(conn, packet)
+	//重放两次后被封禁，之后不再回调
+	for i := 0; i < 2; i++ {
+		if reply := handler.authority(conn, packet); reply.Code != libspa.ReplyInvalid {
+			t.Fatal("unexpected reply", reply)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		h.wait(t)
+	}
+	if reply := handler.authority(conn, newTestPacket(t, replayedDevice)); reply.Code != libspa.ReplyBlocked {
+		t.Fatal("unexpected reply", reply)
+	}
+	if bans := srv.Bans(); len(bans) != 1 || bans[0].IP != "127.0.0.1" {
+		t.Fatal("unexpected bans", bans)
+	}
+	if firewall := srv.Firewall.(*banFirewall); !reflect.DeepEqual(firewall.listeners, listeners) {
+		t.Fatal("ban must be limited to the spa listeners", firewall.listeners)
+	}
+	if len(h.called) != 0 {
+		t.Fatal("banned source must not reach OnAuthority")
+	}
+	if err := srv.ClearBans(); err != nil || len(srv.Bans()) != 0 {
+		t.Fatal("expect bans to be cleared", err)
+	}
+}
@@ -0,0 +1,79 @@
+package spaserver
+
+import (
+	"net"
+)
+
+// Conn spa连接，udp 服务中每个数据报对应一个 Conn
+type Conn struct {
+	protocol   string
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	//tcp 连接
+	conn net.Conn
+	//udp 监听
+	packetConn net.PacketConn
+}
+
+func newTCPConn(conn net.Conn) *Conn {
+	return &Conn{protocol: "tcp", localAddr: conn.LocalAddr(), remoteAddr: conn.RemoteAddr(), conn: conn}
+}
+
+func newUDPConn(packetConn net.PacketConn, remoteAddr net.Addr) *Conn {
+	return &Conn{protocol: "udp", localAddr: packetConn.LocalAddr(), remoteAddr: remoteAddr, packetConn: packetConn}
+}
+
+// Protocol 连接协议 tcp/udp
+func (c *Conn) Protocol() string {
+	return c.protocol
+}
+
+// LocalAddr 本地地址
+func (c *Conn) LocalAddr() string {
+	return c.localAddr.String()
+}
+
+// RemoteAddr 客户端地址
+func (c *Conn) RemoteAddr() string {
+	return c.remoteAddr.String()
+}
+
+// RemoteIP 客户端IP
+func (c *Conn) RemoteIP() net.IP {
+	return addrIP(c.remoteAddr)
+}
+
+// LocalIP 本地IP，监听地址未指定时udp连接返回未指定地址
+func (c *Conn) LocalIP() net.IP {
+	return addrIP(c.localAddr)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Write 向客户端写入数据
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.conn != nil {
+		return c.conn.Write(b)
+	}
+	return c.packetConn.WriteTo(b, c.remoteAddr)
+}
+
+// Close 关闭tcp连接，udp 连接无需关闭
+func (c *Conn) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package spaserver
+
+import (
+	"errors"
+	"github.com/1uLang/libspa"
+)
+
+// 错误码，用于审计日志及监控指标
+const (
+	CodeBadStartCode     = "bad_start_code"
+	CodeBadHeader        = "bad_header"
+	CodeBadVersion       = "bad_version"
+	CodeBadMethod        = "bad_method"
+	CodeBadKey           = "bad_key"
+	CodeBadSecret        = "bad_secret"
+	CodeBadMAC           = "bad_mac"
+	CodeBadBody          = "bad_body"
+	CodeStale            = "stale"
+	CodeReplay           = "replay"
+	CodeBadSession       = "bad_session"
+	CodeClientIPMismatch = "client_ip_mismatch"
+	CodeServerIPMismatch = "server_ip_mismatch"
+	CodeUnknownSource    = "unknown_source"
+	CodeRateLimited      = "rate_limited"
+	CodeBanned           = "banned"
+	CodeFirewall         = "firewall"
+	CodePolicyDenied     = "policy_denied"
+	// 其他错误，如 OnAuthority 返回的错误
+	CodeError = "error"
+)
+
+var errorCodes = map[error]string{
+	libspa.InvalidStartCodePacket: CodeBadStartCode,
+	libspa.InvalidHeaderPacket:    CodeBadHeader,
+	libspa.VersionLowPacket:       CodeBadVersion,
+	libspa.InvalidMethodPacket:    CodeBadMethod,
+	libspa.InvalidKeyPacket:       CodeBadKey,
+	libspa.InvalidMethodSecret:    CodeBadSecret,
+	libspa.InvalidSignPacket:      CodeBadMAC,
+	libspa.InvalidBodyPacket:      CodeBadBody,
+	libspa.InvalidTimestampPacket: CodeStale,
+	libspa.ReplayedPacket:         CodeReplay,
+	libspa.InvalidSessionHello:    CodeBadSession,
+	libspa.InvalidSessionRecord:   CodeBadSession,
+	libspa.InvalidRecordLength:    CodeBadSession,
+	ErrAddressMismatch:            CodeClientIPMismatch,
+	ErrServerAddressMismatch:      CodeServerIPMismatch,
+	ErrUnknownSource:              CodeUnknownSource,
+	ErrRateLimited:                CodeRateLimited,
+	ErrPolicyDenied:               CodePolicyDenied,
+}
+
+// ErrorCode 获取错误对应的错误码，err 为空时返回空
+// 包装的错误按 errors.Is 匹配，实现 ErrorCode() string 的错误使用其返回的错误码
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if code, ok := errorCodes[err]; ok {
+		return code
+	}
+	var coder interface{ ErrorCode() string }
+	if errors.As(err, &coder) && coder.ErrorCode() != "" {
+		return coder.ErrorCode()
+	}
+	for e, code := range errorCodes {
+		if errors.Is(err, e) {
+			return code
+		}
+	}
+	return CodeError
+}
@@ -0,0 +1,120 @@
+package spaserver
+
+import (
+	"fmt"
+	"github.com/1uLang/libspa"
+	"github.com/1uLang/libspa/iptables"
+	"net"
+	"strconv"
+)
+
+// Rule 防火墙放行规则
+type Rule struct {
+	//放行的客户端IP或网段（CIDR）
+	IP string
+	//协议 tcp/udp/sctp/icmp/icmpv6
+	Protocol string
+	//放行端口，icmp/icmpv6 为0
+	Port int
+	//端口范围的结束端口，为0时仅放行 Port
+	PortEnd int
+	//目标地址，放行转发到该地址的流量，为空时放行本机端口
+	Destination string
+	//放行时间（秒）
+	Timeout int
+}
+
+func (r *Rule) String() string {
+	s := r.IP + " " + r.service()
+	if r.Destination != "" {
+		s += " -> " + r.Destination
+	}
+	return s
+}
+
+// 协议及端口，如 tcp/22、tcp/8000-8100、icmp
+func (r *Rule) service() string {
+	switch {
+	case !hasPorts(r.Protocol):
+		return r.Protocol
+	case r.PortEnd > r.Port:
+		return fmt.Sprintf("%s/%d-%d", r.Protocol, r.Port, r.PortEnd)
+	}
+	return fmt.Sprintf("%s/%d", r.Protocol, r.Port)
+}
+
+// 检查协议及端口
+func (r *Rule) valid() bool {
+	switch r.Protocol {
+	case "tcp", "udp", "sctp":
+		return libspa.CheckPort(r.Port) && (r.PortEnd == 0 || r.PortEnd >= r.Port && libspa.CheckPort(r.PortEnd))
+	case "icmp", "icmpv6":
+		return r.Port == 0 && r.PortEnd == 0
+	}
+	return false
+}
+
+// 协议是否使用端口
+func hasPorts(protocol string) bool {
+	return protocol != "icmp" && protocol != "icmpv6"
+}
+
+// Firewall 防火墙接口，用于设置及撤销放行规则，需支持并发调用
+type Firewall interface {
+	Open(rule *Rule) error
+	Close(rule *Rule) error
+}
+
+// BanFirewall 可选接口，Firewall 实现时自动封禁的IP同时加入防火墙拒绝集合
+// 未实现时仅在进程内丢弃被封禁IP的spa报
+// listeners 为spa服务的实际监听，封禁应仅丢弃发往这些监听的流量，不影响该IP的其他服务
+type BanFirewall interface {
+	Ban(ip string, timeout int, listeners []Listener) error
+	Unban(ip string) error
+}
+
+// IptablesFirewall 使用 iptables + ipset 实现的防火墙，放行及封禁到期后由 ipset 自动删除
+type IptablesFirewall struct{}
+
+// Open 设置放行
+func (f *IptablesFirewall) Open(rule *Rule) error {
+	return iptables.Open(iptablesRule(rule))
+}
+
+// Close 撤销放行
+func (f *IptablesFirewall) Close(rule *Rule) error {
+	return iptables.Close(iptablesRule(rule))
+}
+
+func iptablesRule(rule *Rule) *iptables.Rule {
+	return &iptables.Rule{
+		Addr:    rule.IP,
+		Proto:   rule.Protocol,
+		Port:    rule.Port,
+		PortEnd: rule.PortEnd,
+		Dest:    rule.Destination,
+		Timeout: rule.Timeout,
+	}
+}
+
+// Ban 封禁IP发往spa服务监听的流量
+func (f *IptablesFirewall) Ban(ip string, timeout int, listeners []Listener) error {
+	ports := make([]iptables.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		_, port, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			return err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return err
+		}
+		ports = append(ports, iptables.Listener{Proto: l.Protocol, Port: p})
+	}
+	return iptables.BanAddr(ip, timeout, ports)
+}
+
+// Unban 解除封禁
+func (f *IptablesFirewall) Unban(ip string) error {
+	return iptables.UnbanAddr(ip)
+}
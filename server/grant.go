@@ -0,0 +1,300 @@
+package spaserver
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrGrantNotFound = errors.New("grant not found")
+	//放行已达到 MaxGrantLifetime，不能再延长
+	ErrGrantMaxLifetime = errors.New("grant reached max lifetime")
+)
+
+// 恢复失败的放行的重试间隔
+var grantRetryInterval = 10 * time.Second
+
+// Grant 本进程设置的放行
+type Grant struct {
+	//放行的客户端IP或网段
+	IP string `json:"ip"`
+	//协议 tcp/udp/sctp/icmp/icmpv6
+	Protocol string `json:"protocol"`
+	//放行端口及端口范围的结束端口
+	Port    int `json:"port"`
+	PortEnd int `json:"port_end,omitempty"`
+	//目标地址
+	Destination string `json:"destination,omitempty"`
+	//spa报中的设备ID
+	DeviceID string `json:"device_id,omitempty"`
+	//认证的用户
+	User string `json:"user,omitempty"`
+	//首次放行时间，续期时不变
+	Created time.Time `json:"created"`
+	//续期次数
+	Renewals int `json:"renewals,omitempty"`
+	//到期时间
+	Expires time.Time `json:"expires"`
+}
+
+// 到期前剩余时间对应的防火墙规则，不足1秒按1秒计
+func (g *Grant) rule(now time.Time) *Rule {
+	timeout := int(math.Ceil(g.Expires.Sub(now).Seconds()))
+	if timeout < 1 {
+		timeout = 1
+	}
+	return &Rule{IP: g.IP, Protocol: g.Protocol, Port: g.Port, PortEnd: g.PortEnd, Destination: g.Destination, Timeout: timeout}
+}
+
+func (g *Grant) key() grantKey {
+	return grantKey{g.IP, g.Protocol, g.Port, g.PortEnd, g.Destination}
+}
+
+func (r *Rule) key() grantKey {
+	return grantKey{r.IP, r.Protocol, r.Port, r.PortEnd, r.Destination}
+}
+
+// GrantFilter 放行筛选条件，为零值的字段匹配所有放行
+type GrantFilter struct {
+	IP       string
+	Protocol string
+	Port     int
+	DeviceID string
+}
+
+func (f *GrantFilter) match(g *Grant) bool {
+	return (f.IP == "" || f.IP == g.IP) &&
+		(f.Protocol == "" || f.Protocol == g.Protocol) &&
+		(f.Port == 0 || f.Port == g.Port) &&
+		(f.DeviceID == "" || f.DeviceID == g.DeviceID)
+}
+
+// 放行记录的键，同一IP、协议、端口及目标地址只保留一条
+type grantKey struct {
+	ip          string
+	protocol    string
+	port        int
+	portEnd     int
+	destination string
+}
+
+// 本进程设置的放行记录
+type grantTable struct {
+	locker sync.Mutex
+	grants map[grantKey]*Grant
+	//放行记录文件，为空时不持久化
+	store *grantStore
+}
+
+func newGrantTable() *grantTable {
+	return &grantTable{grants: map[grantKey]*Grant{}}
+}
+
+// 记录放行，重复放行时更新设备、用户及到期时间
+// 未到期的放行视为续期，保留首次放行时间并累计续期次数
+func (t *grantTable) add(rule *Rule, deviceID, user string, now time.Time) {
+	grant := &Grant{
+		IP:          rule.IP,
+		Protocol:    rule.Protocol,
+		Port:        rule.Port,
+		PortEnd:     rule.PortEnd,
+		Destination: rule.Destination,
+		DeviceID:    deviceID,
+		User:        user,
+		Created:     now,
+		Expires:     now.Add(time.Duration(rule.Timeout) * time.Second),
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if old, ok := t.grants[grant.key()]; ok && old.Expires.After(now) {
+		grant.Created, grant.Renewals = old.Created, old.Renewals+1
+	}
+	t.grants[grant.key()] = grant
+	t.persist(grantStoreAdd, grant)
+}
+
+// 获取IP、协议及起始端口对应的未到期放行，有多个目标地址时返回其中之一
+func (t *grantTable) get(ip, protocol string, port int, now time.Time) (Grant, error) {
+	if t == nil {
+		return Grant{}, ErrGrantNotFound
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	for key, grant := range t.grants {
+		if key.ip == ip && key.protocol == protocol && key.port == port && grant.Expires.After(now) {
+			return *grant, nil
+		}
+	}
+	return Grant{}, ErrGrantNotFound
+}
+
+// 获取规则对应的未到期放行
+func (t *grantTable) find(key grantKey, now time.Time) (Grant, bool) {
+	if t == nil {
+		return Grant{}, false
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	grant, ok := t.grants[key]
+	if !ok || !grant.Expires.After(now) {
+		return Grant{}, false
+	}
+	return *grant, true
+}
+
+// 设备是否已有放行该IP的未到期放行，放行网段包含该IP时同样视为续期
+func (t *grantTable) renewal(ip net.IP, deviceID string, now time.Time) bool {
+	if t == nil || ip == nil {
+		return false
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	for _, grant := range t.grants {
+		if grant.DeviceID != deviceID || !grant.Expires.After(now) {
+			continue
+		}
+		if grant.IP == ip.String() {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(grant.IP); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 匹配的未到期放行，按IP、协议及端口排序，同时清理已到期的记录
+func (t *grantTable) list(filter GrantFilter, now time.Time) []Grant {
+	if t == nil {
+		return nil
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	grants := []Grant{}
+	var expired []*Grant
+	for key, grant := range t.grants {
+		if !grant.Expires.After(now) {
+			delete(t.grants, key)
+			expired = append(expired, grant)
+		} else if filter.match(grant) {
+			grants = append(grants, *grant)
+		}
+	}
+	t.persist(grantStoreDel, expired...)
+	sortGrants(grants)
+	return grants
+}
+
+// 删除匹配的放行记录，返回其中未到期的放行
+func (t *grantTable) remove(filter GrantFilter, now time.Time) []Grant {
+	if t == nil {
+		return nil
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	grants := []Grant{}
+	var removed []*Grant
+	for key, grant := range t.grants {
+		if !filter.match(grant) {
+			continue
+		}
+		delete(t.grants, key)
+		removed = append(removed, grant)
+		if grant.Expires.After(now) {
+			grants = append(grants, *grant)
+		}
+	}
+	t.persist(grantStoreDel, removed...)
+	sortGrants(grants)
+	return grants
+}
+
+// 取出所有未到期的放行并清空记录
+func (t *grantTable) take(now time.Time) []Grant {
+	return t.remove(GrantFilter{}, now)
+}
+
+// 未到期的放行数量
+func (t *grantTable) active(now time.Time) int {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	count := 0
+	for _, grant := range t.grants {
+		if grant.Expires.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// 使用放行记录文件并恢复其中的放行，文件以恢复的放行重写
+func (t *grantTable) restore(store *grantStore, grants []Grant) error {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	for i := range grants {
+		grant := grants[i]
+		t.grants[grant.key()] = &grant
+	}
+	t.store = store
+	if err := t.compact(); err != nil {
+		t.store = nil
+		return err
+	}
+	return nil
+}
+
+// 关闭放行记录文件，之后的变更不再持久化
+func (t *grantTable) close() error {
+	if t == nil {
+		return nil
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	err := t.store.close()
+	t.store = nil
+	return err
+}
+
+// 写入放行记录文件，记录过多时压缩，写入失败仅记录日志
+func (t *grantTable) persist(op string, grants ...*Grant) {
+	if t.store == nil || len(grants) == 0 {
+		return
+	}
+	err := t.store.append(op, grants...)
+	if err == nil && t.store.needCompact(len(t.grants)) {
+		err = t.compact()
+	}
+	if err != nil {
+		log.Error("grant store err:", err)
+	}
+}
+
+// 以当前放行重写放行记录文件
+func (t *grantTable) compact() error {
+	grants := make([]*Grant, 0, len(t.grants))
+	for _, grant := range t.grants {
+		grants = append(grants, grant)
+	}
+	return t.store.compact(grants)
+}
+
+func sortGrants(grants []Grant) {
+	sort.Slice(grants, func(i, j int) bool {
+		a, b := grants[i], grants[j]
+		if a.IP != b.IP {
+			return a.IP < b.IP
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Destination < b.Destination
+	})
+}
@@ -0,0 +1,151 @@
+package spaserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+)
+
+// 放行记录文件的操作
+const (
+	grantStoreAdd = "add"
+	grantStoreDel = "del"
+)
+
+// 记录数超过有效放行数2倍且不少于该值时压缩文件
+const grantStoreCompactMin = 1000
+
+// 放行记录文件的一行
+type grantRecord struct {
+	Op    string `json:"op"`
+	Grant Grant  `json:"grant"`
+}
+
+// 放行记录文件，JSON lines 格式的预写日志，每行为一次新增或删除
+// 写入不调用 fsync，进程退出时已写入的记录不丢失
+type grantStore struct {
+	path    string
+	file    *os.File
+	records int
+}
+
+// 打开放行记录文件，返回按记录重放后的所有放行（包括已到期的放行）
+// 进程异常退出时最后一行可能不完整，解析失败的行被忽略
+func openGrantStore(path string) (*grantStore, []Grant, error) {
+	s := &grantStore{path: path}
+	grants := map[grantKey]Grant{}
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var record grantRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				log.Warn(fmt.Sprintf("grant store %s line %d ignored:", path, line), err)
+				continue
+			}
+			key := record.Grant.key()
+			switch record.Op {
+			case grantStoreAdd:
+				grants[key] = record.Grant
+			case grantStoreDel:
+				delete(grants, key)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	list := make([]Grant, 0, len(grants))
+	for _, grant := range grants {
+		list = append(list, grant)
+	}
+	sortGrants(list)
+	return s, list, nil
+}
+
+// 追加记录
+func (s *grantStore) append(op string, grants ...*Grant) error {
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	var data []byte
+	for _, grant := range grants {
+		line, err := json.Marshal(&grantRecord{Op: op, Grant: *grant})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	_, err := s.file.Write(data)
+	s.records += len(grants)
+	return err
+}
+
+// 记录数是否需要压缩
+func (s *grantStore) needCompact(active int) bool {
+	return s.records >= grantStoreCompactMin && s.records > 2*active
+}
+
+// 以当前的放行重写文件，写入临时文件后替换
+func (s *grantStore) compact(grants []*Grant) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, grant := range grants {
+		line, err := json.Marshal(&grantRecord{Op: grantStoreAdd, Grant: *grant})
+		if err == nil {
+			_, err = w.Write(append(line, '\n'))
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, s.records = file, len(grants)
+	return nil
+}
+
+// 关闭文件
+func (s *grantStore) close() error {
+	if s == nil || s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,194 @@
+package spaserver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrantStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grants.json")
+	store, grants, err := openGrantStore(path)
+	if err != nil || len(grants) != 0 {
+		t.Fatal("unexpected open", grants, err)
+	}
+	table := newGrantTable()
+	if err := table.restore(store, nil); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	table.add(&Rule{IP: "192.0.2.1", Protocol: "tcp", Port: 22, Timeout: 60}, firstDevice, "alice", now)
+	table.add(&Rule{IP: "192.0.2.2", Protocol: "udp", Port: 53, Timeout: 60}, firstDevice, "", now)
+	table.add(&Rule{IP: "192.0.2.3", Protocol: "tcp", Port: 8000, PortEnd: 8100, Destination: "10.0.0.5", Timeout: 60}, "", "", now)
+	table.remove(GrantFilter{IP: "192.0.2.2"}, now)
+	if err := table.close(); err != nil {
+		t.Fatal(err)
+	}
+	//进程异常退出时最后一行不完整
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"add","grant":{"ip":"192.0.2`)
+	file.Close()
+
+	store, grants, err = openGrantStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if len(grants) != 2 || grants[0].IP != "192.0.2.1" || grants[0].User != "alice" ||
+		grants[1].PortEnd != 8100 || grants[1].Destination != "10.0.0.5" {
+		t.Fatal("unexpected grants", grants)
+	}
+	if err := newGrantTable().restore(store, grants[:1]); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 || store.records != 1 {
+		t.Fatal("store should be compacted on restore, lines", lines)
+	}
+}
+
+func TestGrantStore_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grants.json")
+	store, _, err := openGrantStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newGrantTable()
+	if err := table.restore(store, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	now := time.Now()
+	for i := 0; i < grantStoreCompactMin; i++ {
+		table.add(&Rule{IP: "192.0.2.1", Protocol: "tcp", Port: 22, Timeout: 60}, firstDevice, "", now)
+	}
+	if store.records >= grantStoreCompactMin {
+		t.Fatal("store was not compacted, records", store.records)
+	}
+}
+
+func TestServer_GrantStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grants.json")
+	srv, h := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	srv.GrantStore = path
+	srv.Firewall = &recordFirewall{}
+	h.allow = &Allow{TcpPorts: []int{22}, Duration: time.Hour}
+	errs, listeners := runTestServer(t, srv, context.Background())
+	sendTestPacket(t, listeners[0], firstDevice)
+	h.wait(t)
+	deadline := time.Now().Add(3 * time.Second)
+	for len(srv.Grants(GrantFilter{})) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("grant was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-errs
+
+	//已到期的放行在启动时撤销
+	store, grants, err := openGrantStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := Grant{IP: "192.0.2.9", Protocol: "udp", Port: 53, Expires: time.Now().Add(-time.Minute)}
+	if err := newGrantTable().restore(store, append(grants, stale)); err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	next, _ := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	firewall := &recordFirewall{}
+	next.GrantStore = path
+	next.Firewall = firewall
+	if err := next.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer next.Shutdown(context.Background())
+	grants = next.Grants(GrantFilter{})
+	if len(grants) != 1 || grants[0].IP != "127.0.0.1" || grants[0].Port != 22 || grants[0].DeviceID != firstDevice {
+		t.Fatal("unexpected restored grants", grants)
+	}
+	if len(firewall.opened) != 1 || firewall.opened[0].Timeout < 3500 {
+		t.Fatal("grant should be reopened with remaining timeout", firewall.opened)
+	}
+	if len(firewall.closed) != 1 || firewall.closed[0].IP != "192.0.2.9" {
+		t.Fatal("expired grant should be closed", firewall.closed)
+	}
+}
+
+// 先失败指定次数的防火墙
+type flakyFirewall struct {
+	recordFirewall
+	failures int
+}
+
+func (f *flakyFirewall) Open(rule *Rule) error {
+	f.locker.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.locker.Unlock()
+		return errors.New("ipset unavailable")
+	}
+	f.locker.Unlock()
+	return f.recordFirewall.Open(rule)
+}
+
+func (f *flakyFirewall) openedCount() int {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	return len(f.opened)
+}
+
+// 恢复失败的放行保留在记录中并在后台重试
+func TestServer_GrantStoreRetry(t *testing.T) {
+	interval := grantRetryInterval
+	grantRetryInterval = 10 * time.Millisecond
+	defer func() { grantRetryInterval = interval }()
+
+	path := filepath.Join(t.TempDir(), "grants.json")
+	store, _, err := openGrantStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant := Grant{IP: "192.0.2.9", Protocol: "tcp", Port: 22, DeviceID: firstDevice, Created: time.Now(), Expires: time.Now().Add(time.Hour)}
+	if err := newGrantTable().restore(store, []Grant{grant}); err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	srv, _ := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	firewall := &flakyFirewall{failures: 2}
+	srv.GrantStore = path
+	srv.Firewall = firewall
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	if grants := srv.Grants(GrantFilter{}); len(grants) != 1 || grants[0].IP != grant.IP {
+		t.Fatal("failed grant should be kept", grants)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for firewall.openedCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed grant was not retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if opened := firewall.opened[0]; opened.IP != grant.IP || opened.Timeout < 3500 {
+		t.Fatal("unexpected retried rule", opened)
+	}
+}
@@ -3,11 +3,13 @@ package spaserver
 import (
 	"errors"
 	"fmt"
-	"github.com/1uLang/libnet"
-	"github.com/1uLang/libnet/options"
 	"github.com/1uLang/libspa"
-	"github.com/1uLang/libspa/iptables"
+	"github.com/1uLang/libspa/encrypt"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"sync"
+	"time"
 )
 
 // 处理 通信的handler
@@ -15,59 +17,332 @@ type handler struct {
 	//spa 放行时间
 	timeout int
 	handler Handler
-	options *options.Options
+	//密钥集合
+	keys *encrypt.KeySet
+	//限定的加密方式，为空时接受所有加密方式
+	method encrypt.MethodInterface
+	//防重放缓存，所有监听共享
+	replay *libspa.ReplayCache
+	//防火墙
+	firewall Firewall
+	//本进程设置的放行记录
+	grants *grantTable
+	//放行的最长时间
+	maxLifetime time.Duration
+	//限速
+	limits *rateLimiter
+	//自动封禁
+	bans *banList
+	//审计
+	audit *auditor
+	//监控指标
+	metrics *metrics
+	//密钥使用统计
+	usage *keyUsage
+	//认证处理链，由中间件及 Handler 组成
+	chain AuthorityFunc
+	//放行IP选择策略
+	policy SourcePolicy
+	relays []*net.IPNet
+	//服务器地址，用于校验 ServerPublicIP
+	publicIPs    []net.IP
+	hostIPs      []net.IP
+	skipServerIP bool
+	requireIP    bool
+
+	locker   sync.Mutex
+	sessions map[*Conn]*libspa.Session
 }
 
-// OnConnect 当TCP长连接建立成功是回调
-func (c *handler) OnConnect(conn *libnet.Connection) {
+// OnConnect 当TCP长连接建立成功或收到UDP数据报时回调
+func (c *handler) OnConnect(conn *Conn) {
 	if c.handler != nil {
 		c.handler.OnConnect(conn)
 	}
 }
 
-// OnMessage 当客户端有数据写入是回调
-func (c *handler) OnMessage(conn *libnet.Connection, buf []byte) {
+// OnMessage 当客户端有数据写入是回调，返回错误时关闭连接
+func (c *handler) OnMessage(conn *Conn, buf []byte) error {
 	c.print(fmt.Sprintf("data length:%d,addr:%v", len(buf), conn.RemoteAddr()))
-	//解析udp spa 认证包
-	if c.handler != nil {
-		allow, err := c.handler.OnAuthority(libspa.ParsePacket(buf, c.options.PrivateKey, c.options.PublicKey))
+	//tcp 加密会话，一个连接可携带多个spa报
+	if session := c.session(conn, buf); session != nil {
+		records, err := session.Feed(buf)
+		for _, record := range records {
+			reply := c.authority(conn, record)
+			if err := session.WriteRecord(reply.Encode()); err != nil {
+				c.print("write session reply,err", err)
+			}
+		}
 		if err != nil {
-			c.print("parse packet,err", err)
-			return
+			c.print("session,err", err)
+			c.metrics.parseFailure(err)
+			c.bans.fail(conn.RemoteIP(), time.Now())
+		}
+		return err
+	}
+	//解析udp spa 认证包
+	c.authority(conn, buf)
+	return nil
+}
+
+// 认证spa报并设置放行，返回会话应答
+// 被封禁或按来源限速丢弃的spa报不解析，仅记录来源的 banned/rate_limited 审计事件
+func (c *handler) authority(conn *Conn, buf []byte) *libspa.Reply {
+	if c.handler == nil {
+		return &libspa.Reply{Code: libspa.ReplyBlocked}
+	}
+	now := time.Now()
+	c.metrics.packet(conn.Protocol())
+	if c.bans.banned(conn.RemoteIP(), now) {
+		c.audit.emit(dropEvent(conn, now, DecisionBanned))
+		return &libspa.Reply{Code: libspa.ReplyBlocked}
+	}
+	if !c.limits.allowSource(conn.RemoteIP(), now) {
+		c.audit.emit(dropEvent(conn, now, DecisionRateLimited))
+		return &libspa.Reply{Code: libspa.ReplyRateLimited}
+	}
+	req := c.request(conn, buf, now)
+	event := requestEvent(req)
+	if req.Err != nil {
+		if banFailure(req.Err) {
+			c.bans.fail(conn.RemoteIP(), now)
+		}
+	} else if !c.limits.allowDevice(req.Body.ClientDeviceId, now) {
+		event.Decision, event.Error = DecisionRateLimited, CodeRateLimited
+		c.audit.emit(event)
+		return &libspa.Reply{Code: libspa.ReplyRateLimited}
+	}
+	if req.Err == nil {
+		req.Err = c.checkServerIP(conn, req.Body)
+	}
+	if req.Err == nil {
+		req.GrantIP, req.Err = c.grantIP(conn, req.Body)
+	}
+	if req.Err == nil {
+		req.Renewal = c.grants.renewal(req.GrantIP, req.Body.ClientDeviceId, now)
+		event.Renewal = req.Renewal
+	}
+	req.ErrCode = ErrorCode(req.Err)
+	c.metrics.parseFailure(req.Err)
+	start := time.Now()
+	allow, err := c.chain(req)
+	c.metrics.authorityLatencyDone(start)
+	defer func() {
+		c.metrics.authorityDone(event.Decision)
+	}()
+	if err != nil {
+		c.print("parse packet,err", err)
+		event.Decision, event.Error, event.Message = DecisionInvalid, ErrorCode(err), err.Error()
+		if !errors.Is(err, req.Err) {
+			//handler 或中间件拒绝
+			event.Decision = DecisionBlock
+			c.metrics.authorityFailure(err)
+		}
+		c.audit.emit(event)
+		//应答仅返回结果码，错误详情只记录于日志及审计，避免泄露给客户端
+		switch {
+		case err == ErrServerAddressMismatch:
+			return &libspa.Reply{Code: libspa.ReplyServerMismatch}
+		case errors.Is(err, ErrRateLimited):
+			return &libspa.Reply{Code: libspa.ReplyRateLimited}
+		}
+		return &libspa.Reply{Code: libspa.ReplyInvalid}
+	}
+	ip := req.GrantIP
+	if allow == nil || ip == nil {
+		c.print(fmt.Sprintf("[%s] is block", conn.RemoteAddr()))
+		event.Decision = DecisionBlock
+		if req.Err != nil {
+			//handler 忽略了解析错误，仍按无效报文记录
+			event.Decision, event.Error, event.Message = DecisionInvalid, req.ErrCode, req.Err.Error()
+		}
+		c.audit.emit(event)
+		return &libspa.Reply{Code: libspa.ReplyBlocked}
+	}
+	event.Decision, event.User, event.GrantIP = DecisionAllow, allow.User, ip.String()
+	ports, timeout := c.doAllow(ip.String(), req.Body.ClientDeviceId, allow)
+	event.Ports = ports
+	if len(event.Ports) > 0 {
+		expires := now.Add(time.Duration(timeout) * time.Second)
+		event.Expires = &expires
+	}
+	c.audit.emit(event)
+	return &libspa.Reply{Code: libspa.ReplyAllowed}
+}
+
+// 解析spa报并生成认证请求，头部可解析时即使解密失败也记录加密方式及密钥ID
+func (c *handler) request(conn *Conn, buf []byte, now time.Time) *Request {
+	req := &Request{
+		Conn:     conn,
+		Listener: Listener{Protocol: conn.Protocol(), Addr: conn.LocalAddr()},
+		SourceIP: conn.RemoteIP(),
+		Received: now,
+		Raw:      buf,
+	}
+	if header, err := libspa.ParseHeader(buf); err == nil {
+		req.Method, req.KeyId = header.Method, header.KeyId
+	}
+	req.Packet, req.Err = c.parse(buf)
+	if req.Err == nil {
+		req.Body = &req.Packet.Body
+	}
+	return req
+}
+
+// 按策略选择放行IP，不一致时通知handler
+func (c *handler) grantIP(conn *Conn, body *libspa.Body) (net.IP, error) {
+	source := conn.RemoteIP()
+	ip, mismatch, err := c.policy.grantIP(body, source, c.relays)
+	if mismatch {
+		c.print(fmt.Sprintf("[%s] client public ip %s mismatch, policy %s", source, body.ClientPublicIP, c.policy))
+		if h, ok := c.handler.(AddressMismatchHandler); ok {
+			h.OnAddressMismatch(body, source, ip)
+		}
+	}
+	return ip, err
+}
+
+// 获取连接对应的加密会话，首个数据为会话握手时创建
+func (c *handler) session(conn *Conn, buf []byte) *libspa.Session {
+	if conn.Protocol() != "tcp" {
+		return nil
+	}
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if session, ok := c.sessions[conn]; ok {
+		return session
+	}
+	if !libspa.IsSessionHello(buf) {
+		return nil
+	}
+	if c.sessions == nil {
+		c.sessions = map[*Conn]*libspa.Session{}
+	}
+	session := libspa.NewServerSession(conn, c.keys)
+	c.sessions[conn] = session
+	return session
+}
+
+// 使用报文中密钥ID对应的有效密钥解析spa报
+func (c *handler) parse(buf []byte) (*libspa.Packet, error) {
+	start := time.Now()
+	packet, err := libspa.ParseKeyedPacket(buf, c.keys)
+	if c.metrics != nil {
+		method := "unknown"
+		if header, herr := libspa.ParseHeader(buf); herr == nil {
+			if name, ok := encrypt.MethodName(header.Method); ok {
+				method = name
+			}
 		}
-		if allow != nil {
-			c.doAllow(libspa.GetIP(conn.RemoteAddr()), allow)
-		} else {
-			c.print("[%s] is block", libspa.GetIP(conn.RemoteAddr()))
+		c.metrics.decrypt(method, start)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.method != nil && packet.Method != c.method.Method() {
+		return nil, libspa.InvalidMethodPacket
+	}
+	if c.replay != nil {
+		if err := c.replay.Check(packet, time.Now()); err != nil {
+			return nil, err
 		}
 	}
+	c.usage.use(packet.KeyId, time.Now())
+	return packet, nil
 }
 
 // OnClose 当客户端主动断开链接或者超时时回调,err返回关闭的原因
-func (c *handler) OnClose(conn *libnet.Connection, reason string) {
+func (c *handler) OnClose(conn *Conn, err error) {
+	c.locker.Lock()
+	delete(c.sessions, conn)
+	c.locker.Unlock()
 	if c.handler != nil {
-		c.handler.OnClose(conn, errors.New(reason))
+		c.handler.OnClose(conn, err)
 	}
 }
 
-// 设置IP放行
-func (c *handler) doAllow(ip string, allow *Allow) {
+// 设置IP放行，返回放行成功的端口及放行时间（秒）
+func (c *handler) doAllow(ip, deviceID string, allow *Allow) ([]string, int) {
+	timeout := c.timeout
+	if allow.Duration > 0 {
+		timeout = int(math.Ceil(allow.Duration.Seconds()))
+	}
+	source := allowSource(ip, allow.SourcePrefix)
+	var destination string
+	if allow.Destination != nil {
+		destination = allow.Destination.String()
+	}
+	ranges := make([]PortRange, 0, len(allow.TcpPorts)+len(allow.UdpPorts)+len(allow.Ranges))
 	for _, port := range allow.TcpPorts {
-		if libspa.CheckPort(port) {
-			err := iptables.OpenAddrPort(ip, "tcp", port, c.timeout)
-			if err != nil {
-				c.print("set allow %s err:", ip)
-			}
-		}
+		ranges = append(ranges, PortRange{Protocol: "tcp", From: port})
 	}
 	for _, port := range allow.UdpPorts {
-		if libspa.CheckPort(port) {
-			err := iptables.OpenAddrPort(ip, "udp", port, c.timeout)
-			if err != nil {
-				c.print("set allow %s err:", ip)
+		ranges = append(ranges, PortRange{Protocol: "udp", From: port})
+	}
+	ranges = append(ranges, allow.Ranges...)
+	var ports []string
+	expires := 0
+	for _, r := range ranges {
+		rule := &Rule{IP: source, Protocol: r.Protocol, Port: r.From, PortEnd: r.To, Destination: destination, Timeout: timeout}
+		if c.open(rule, deviceID, allow.User) {
+			ports = append(ports, rule.service())
+			if rule.Timeout > expires {
+				expires = rule.Timeout
 			}
 		}
 	}
+	if expires == 0 {
+		expires = timeout
+	}
+	return ports, expires
+}
+
+// 放行的来源地址，prefix 有效时为来源IP所在的网段
+func allowSource(ip string, prefix int) string {
+	addr := net.ParseIP(ip)
+	if addr == nil || prefix <= 0 {
+		return ip
+	}
+	bits := 128
+	if ip4 := addr.To4(); ip4 != nil {
+		addr, bits = ip4, 32
+	}
+	if prefix >= bits {
+		return ip
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return (&net.IPNet{IP: addr.Mask(mask), Mask: mask}).String()
+}
+
+// 设置放行并记录，续期时放行时间不超过 maxLifetime 的剩余时间，已达到时不再续期
+func (c *handler) open(rule *Rule, deviceID, user string) bool {
+	if !rule.valid() {
+		return false
+	}
+	grant, renewal := c.grants.find(rule.key(), time.Now())
+	if renewal && c.maxLifetime > 0 && !grant.Created.IsZero() {
+		remaining := int(grant.Created.Add(c.maxLifetime).Sub(time.Now()) / time.Second)
+		if remaining < 1 {
+			c.print(fmt.Sprintf("%s reached max lifetime", rule))
+			return false
+		}
+		if rule.Timeout > remaining {
+			rule.Timeout = remaining
+		}
+	}
+	err := c.firewall.Open(rule)
+	event := ruleEvent(AuditGrant, rule, err)
+	if renewal {
+		event.Message = "renew"
+	}
+	c.audit.emit(event)
+	if err != nil {
+		c.print(fmt.Sprintf("set allow %s err:", rule.IP), err)
+		c.metrics.firewallFailure("open")
+		return false
+	}
+	c.grants.add(rule, deviceID, user, time.Now())
+	return true
 }
 
 // 打印调试信息
@@ -1,13 +1,30 @@
 package spaserver
 
 import (
-	"github.com/1uLang/libnet"
 	"github.com/1uLang/libspa"
 )
 
 // Handler 处理spa服务的handler
+//
+// tcp 监听在连接建立及断开时各回调一次 OnConnect/OnClose；
+// udp 没有连接，每个数据报都会回调一次 OnConnect 及 OnClose（err 为nil），
+// 且数据报由多个goroutine并发处理，回调需支持并发调用
+//
+// 不兼容变更：OnConnect/OnClose 的参数已由 *libnet.Connection 改为 *Conn，旧的实现需修改方法签名，
+// 仅实现认证的旧 Handler 可通过 HandlerFunc(h.OnAuthority) 迁移
 type Handler interface {
-	OnConnect(conn *libnet.Connection)                        // 新连接回调
+	OnConnect(conn *Conn)                                     // 新连接或udp数据报回调
 	OnAuthority(body *libspa.Body, err error) (*Allow, error) //设备认证回调
-	OnClose(conn *libnet.Connection, err error)               // 连接断开回调
+	OnClose(conn *Conn, err error)                            // 连接断开或udp数据报处理完成回调
 }
+
+// HandlerFunc 将认证回调适配为 Handler，不处理连接的建立及断开
+type HandlerFunc func(body *libspa.Body, err error) (*Allow, error)
+
+func (f HandlerFunc) OnConnect(conn *Conn) {}
+
+func (f HandlerFunc) OnAuthority(body *libspa.Body, err error) (*Allow, error) {
+	return f(body, err)
+}
+
+func (f HandlerFunc) OnClose(conn *Conn, err error) {}
@@ -0,0 +1,111 @@
+package spaserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 内置http服务，用于监控指标及管理接口
+type httpServer struct {
+	name string
+	ln   net.Listener
+	srv  *http.Server
+}
+
+// 创建http监听，addr 为 "unix:/path/to.sock" 时监听unix socket，否则监听tcp host:port
+func listenHTTP(name, addr string, handler http.Handler) (*httpServer, error) {
+	ln, err := listenHTTPAddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s %s error:%v", name, addr, err)
+	}
+	return &httpServer{
+		name: name,
+		ln:   ln,
+		srv:  &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second},
+	}, nil
+}
+
+// unix socket 仅允许属主访问，启动前删除上次遗留的socket文件
+// socket 先在仅属主可访问的临时目录中创建并设置权限，再移动到目标路径，避免权限设置前被连接
+func listenHTTPAddr(addr string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("socket is in use")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".spa")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	//关闭时删除移动后的socket文件
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: ln, path: path}, nil
+}
+
+// 关闭时删除socket文件的监听
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	if rerr := os.Remove(l.path); err == nil && !os.IsNotExist(rerr) {
+		err = rerr
+	}
+	return err
+}
+
+// 解析 "unix:" 前缀的地址
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, "unix:"), true
+}
+
+func (s *httpServer) serve() {
+	if s == nil {
+		return
+	}
+	if err := s.srv.Serve(s.ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error(fmt.Sprintf("serve %s err:", s.name), err)
+	}
+}
+
+func (s *httpServer) shutdown(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
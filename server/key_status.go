@@ -0,0 +1,97 @@
+package spaserver
+
+import (
+	"sync"
+	"time"
+)
+
+// KeyStatus 密钥的有效期及使用情况，不包含密钥内容
+type KeyStatus struct {
+	ID        uint32     `json:"id"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	//当前是否有效
+	Valid bool `json:"valid"`
+	//是否为最新的有效密钥
+	Newest bool `json:"newest"`
+	//本进程解析成功的spa报数量
+	Packets uint64 `json:"packets"`
+	//最后一次解析成功的时间
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// 各密钥解析成功的spa报统计
+type keyUsage struct {
+	locker sync.Mutex
+	keys   map[uint32]*keyUse
+}
+
+type keyUse struct {
+	packets uint64
+	last    time.Time
+}
+
+func newKeyUsage() *keyUsage {
+	return &keyUsage{keys: map[uint32]*keyUse{}}
+}
+
+func (u *keyUsage) use(id uint32, now time.Time) {
+	if u == nil {
+		return
+	}
+	u.locker.Lock()
+	defer u.locker.Unlock()
+	use, ok := u.keys[id]
+	if !ok {
+		use = &keyUse{}
+		u.keys[id] = use
+	}
+	use.packets++
+	use.last = now
+}
+
+func (u *keyUsage) get(id uint32) (keyUse, bool) {
+	if u == nil {
+		return keyUse{}, false
+	}
+	u.locker.Lock()
+	defer u.locker.Unlock()
+	use, ok := u.keys[id]
+	if !ok {
+		return keyUse{}, false
+	}
+	return *use, true
+}
+
+// KeyStatus 按ID顺序返回所有密钥的状态
+func (c *Server) KeyStatus() []KeyStatus {
+	c.locker.Lock()
+	keys := c.Keys
+	c.locker.Unlock()
+	if keys == nil {
+		return nil
+	}
+	now := time.Now()
+	var newest uint32
+	hasNewest := false
+	if key, err := keys.Newest(now); err == nil {
+		newest, hasNewest = key.ID, true
+	}
+	status := []KeyStatus{}
+	for _, key := range keys.Keys() {
+		s := KeyStatus{ID: key.ID, Valid: key.Valid(now), Newest: hasNewest && key.ID == newest}
+		if !key.NotBefore.IsZero() {
+			notBefore := key.NotBefore
+			s.NotBefore = &notBefore
+		}
+		if !key.NotAfter.IsZero() {
+			notAfter := key.NotAfter
+			s.NotAfter = &notAfter
+		}
+		if use, ok := c.usage.get(key.ID); ok {
+			s.Packets, s.LastUsed = use.packets, &use.last
+		}
+		status = append(status, s)
+	}
+	return status
+}
@@ -0,0 +1,206 @@
+package spaserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxDatagramSize = 65535
+
+// DefaultUDPWorkers udp 监听默认同时处理的数据报数量
+const DefaultUDPWorkers = 64
+
+// DefaultRawTimeout tcp 连接默认读超时时间，避免空闲连接一直占用goroutine
+const DefaultRawTimeout = 30 * time.Second
+
+// Listener 监听配置
+type Listener struct {
+	//协议 tcp/udp
+	Protocol string
+	//监听地址 host:port，host 为空时监听所有地址
+	Addr string
+}
+
+func (l Listener) String() string {
+	return l.Protocol + "/" + l.Addr
+}
+
+// 检测监听配置是否正确
+func (l *Listener) check() error {
+	l.Protocol = strings.ToLower(l.Protocol)
+	if l.Protocol != "tcp" && l.Protocol != "udp" {
+		return fmt.Errorf("listener %s: please set protocol tcp or udp", l)
+	}
+	if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+		return fmt.Errorf("listener %s: %v", l, err)
+	}
+	return nil
+}
+
+// 正在运行的监听
+type listener interface {
+	addr() net.Addr
+	serve() error
+	close() error
+}
+
+// 创建监听，udp 监听最多同时处理 udpWorkers 个数据报
+func (l Listener) listen(h *handler, readTimeout time.Duration, udpWorkers int) (listener, error) {
+	switch l.Protocol {
+	case "tcp":
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if readTimeout <= 0 {
+			readTimeout = DefaultRawTimeout
+		}
+		return &tcpListener{ln: ln, handler: h, readTimeout: readTimeout, conns: map[net.Conn]struct{}{}}, nil
+	case "udp":
+		conn, err := net.ListenPacket("udp", l.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if udpWorkers <= 0 {
+			udpWorkers = DefaultUDPWorkers
+		}
+		return &udpListener{conn: conn, handler: h, workers: make(chan struct{}, udpWorkers)}, nil
+	}
+	return nil, errors.New("unsupported protocol " + l.Protocol)
+}
+
+// udp 监听，数据报由有限数量的goroutine并发处理，均在处理中时暂停读取
+type udpListener struct {
+	conn    net.PacketConn
+	handler *handler
+	workers chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (l *udpListener) serve() error {
+	defer l.wg.Wait()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		l.workers <- struct{}{}
+		l.wg.Add(1)
+		go l.serveDatagram(newUDPConn(l.conn, addr), data)
+	}
+}
+
+func (l *udpListener) serveDatagram(conn *Conn, data []byte) {
+	defer func() {
+		<-l.workers
+		l.wg.Done()
+	}()
+	l.handler.OnConnect(conn)
+	_ = l.handler.OnMessage(conn, data)
+	l.handler.OnClose(conn, nil)
+}
+
+func (l *udpListener) addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *udpListener) close() error {
+	return l.conn.Close()
+}
+
+// tcp 监听，每个连接一个goroutine
+type tcpListener struct {
+	ln          net.Listener
+	handler     *handler
+	readTimeout time.Duration
+
+	locker sync.Mutex
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+func (l *tcpListener) serve() error {
+	defer l.wg.Wait()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		l.locker.Lock()
+		l.conns[conn] = struct{}{}
+		l.locker.Unlock()
+		l.wg.Add(1)
+		go l.serveConn(conn)
+	}
+}
+
+func (l *tcpListener) serveConn(raw net.Conn) {
+	defer l.wg.Done()
+	conn := newTCPConn(raw)
+	l.handler.OnConnect(conn)
+	buf := make([]byte, 4096)
+	var err error
+	for {
+		_ = raw.SetReadDeadline(time.Now().Add(l.readTimeout))
+		var n int
+		n, err = raw.Read(buf)
+		if n > 0 {
+			if herr := l.handler.OnMessage(conn, buf[:n]); herr != nil {
+				err = herr
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	_ = raw.Close()
+	l.locker.Lock()
+	delete(l.conns, raw)
+	l.locker.Unlock()
+	if err == io.EOF || isClosed(err) {
+		err = nil
+	}
+	l.handler.OnClose(conn, err)
+}
+
+func (l *tcpListener) addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// 关闭监听及所有连接
+func (l *tcpListener) close() error {
+	err := l.ln.Close()
+	l.locker.Lock()
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+	l.locker.Unlock()
+	return err
+}
+
+// 判断是否为关闭监听或连接导致的错误
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,149 @@
+package spaserver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const metricsNamespace = "spa"
+
+// 监控指标，为空时不记录
+type metrics struct {
+	packets          *prometheus.CounterVec
+	parseFailures    *prometheus.CounterVec
+	decryptLatency   *prometheus.HistogramVec
+	authorityLatency prometheus.Histogram
+	authority        *prometheus.CounterVec
+	authorityErrors  *prometheus.CounterVec
+	firewallFailures *prometheus.CounterVec
+}
+
+// 创建并注册监控指标，grants 及 limits 在采集时读取
+func newMetrics(registry prometheus.Registerer, grants *grantTable, limits *rateLimiter) (*metrics, error) {
+	if registry == nil {
+		return nil, nil
+	}
+	m := &metrics{
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "packets_received_total",
+			Help:      "SPA packets received, by protocol.",
+		}, []string{"protocol"}),
+		parseFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "packet_errors_total",
+			Help:      "SPA packets rejected before OnAuthority, by error code.",
+		}, []string{"code"}),
+		decryptLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "decrypt_duration_seconds",
+			Help:      "Time spent parsing and decrypting SPA packets, by method.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"method"}),
+		authorityLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "authority_duration_seconds",
+			Help:      "Time spent in the OnAuthority callback.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		authority: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "authority_total",
+			Help:      "OnAuthority outcomes, by decision.",
+		}, []string{"decision"}),
+		authorityErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "authority_errors_total",
+			Help:      "Errors returned by OnAuthority or middleware, by error code.",
+		}, []string{"code"}),
+		firewallFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "firewall_errors_total",
+			Help:      "Failed firewall commands, by operation.",
+		}, []string{"operation"}),
+	}
+	collectors := []prometheus.Collector{
+		m.packets, m.parseFailures, m.decryptLatency, m.authorityLatency, m.authority, m.authorityErrors, m.firewallFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_grants",
+			Help:      "Unexpired firewall grants created by this process.",
+		}, func() float64 {
+			return float64(grants.active(time.Now()))
+		}),
+	}
+	for name, count := range map[string]func(RateLimitDrops) uint64{
+		"global": func(d RateLimitDrops) uint64 { return d.Global },
+		"source": func(d RateLimitDrops) uint64 { return d.Source },
+		"prefix": func(d RateLimitDrops) uint64 { return d.Prefix },
+		"device": func(d RateLimitDrops) uint64 { return d.Device },
+	} {
+		count := count
+		collectors = append(collectors, prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "rate_limit_drops_total",
+			Help:        "SPA packets dropped by rate limits, by limit.",
+			ConstLabels: prometheus.Labels{"limit": name},
+		}, func() float64 {
+			return float64(count(limits.stats()))
+		}))
+	}
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *metrics) packet(protocol string) {
+	if m != nil {
+		m.packets.WithLabelValues(protocol).Inc()
+	}
+}
+
+func (m *metrics) parseFailure(err error) {
+	if m != nil && err != nil {
+		m.parseFailures.WithLabelValues(ErrorCode(err)).Inc()
+	}
+}
+
+func (m *metrics) decrypt(method string, start time.Time) {
+	if m != nil {
+		m.decryptLatency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// 记录认证回调及中间件的耗时，不含放行、持久化及审计
+func (m *metrics) authorityLatencyDone(start time.Time) {
+	if m != nil {
+		m.authorityLatency.Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *metrics) authorityDone(decision string) {
+	if m != nil {
+		m.authority.WithLabelValues(decision).Inc()
+	}
+}
+
+func (m *metrics) authorityFailure(err error) {
+	if m != nil && err != nil {
+		m.authorityErrors.WithLabelValues(ErrorCode(err)).Inc()
+	}
+}
+
+func (m *metrics) firewallFailure(operation string) {
+	if m != nil {
+		m.firewallFailures.WithLabelValues(operation).Inc()
+	}
+}
+
+// 创建 /metrics 监听
+func listenMetrics(addr string, gatherer prometheus.Gatherer) (*httpServer, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	return listenHTTP("metrics", addr, mux)
+}
@@ -0,0 +1,93 @@
+package spaserver
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandler_Metrics(t *testing.T) {
+	srv, h := newTestServer(t)
+	registry := prometheus.NewRegistry()
+	srv.MetricsRegistry = registry
+	srv.Firewall = &recordFirewall{}
+	srv.RateLimits.Device = RateLimit{Rate: 0.001, Burst: 1}
+	srv.limits = nil
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	h.allow = &Allow{TcpPorts: []int{22}}
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	packet := newTestPacket(t, firstDevice)
+	handler.authority(conn, packet)
+	handler.authority(conn, packet)
+	handler.authority(conn, []byte("garbage"))
+
+	m := srv.metrics
+	if v := testutil.ToFloat64(m.packets.WithLabelValues("udp")); v != 3 {
+		t.Fatal("unexpected packets", v)
+	}
+	if v := testutil.ToFloat64(m.parseFailures.WithLabelValues(CodeBadStartCode)); v != 1 {
+		t.Fatal("unexpected bad start code failures", v)
+	}
+	if v := testutil.ToFloat64(m.authority.WithLabelValues(DecisionAllow)); v != 1 {
+		t.Fatal("unexpected allow outcomes", v)
+	}
+	if n := testutil.CollectAndCount(m.decryptLatency); n != 2 {
+		t.Fatal("expect aes-256-cfb and unknown decrypt latency, got", n)
+	}
+
+	expected := `
+# HELP spa_active_grants Unexpired firewall grants created by this process.
+# TYPE spa_active_grants gauge
+spa_active_grants 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "spa_active_grants"); err != nil {
+		t.Fatal(err)
+	}
+	//第二个spa报为重放，在设备限速前被拒绝，因此不计入限速
+	expected = `
+# HELP spa_rate_limit_drops_total SPA packets dropped by rate limits, by limit.
+# TYPE spa_rate_limit_drops_total counter
+spa_rate_limit_drops_total{limit="device"} 0
+spa_rate_limit_drops_total{limit="global"} 0
+spa_rate_limit_drops_total{limit="prefix"} 0
+spa_rate_limit_drops_total{limit="source"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "spa_rate_limit_drops_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_MetricsAddr(t *testing.T) {
+	srv, _ := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	srv.MetricsAddr = "127.0.0.1:0"
+	errs, _ := runTestServer(t, srv, context.Background())
+
+	resp, err := http.Get("http://" + srv.metricsSrv.ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "spa_active_grants 0") {
+		t.Fatal("unexpected metrics", string(data))
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-errs
+}
@@ -0,0 +1,90 @@
+package spaserver
+
+import (
+	"errors"
+	"github.com/1uLang/libspa"
+)
+
+var (
+	ErrRateLimited  = errors.New("rate limited")
+	ErrPolicyDenied = errors.New("denied by policy")
+)
+
+// RequireValid 解析或校验失败的请求直接返回错误，不调用后续处理
+func RequireValid() Middleware {
+	return func(next AuthorityFunc) AuthorityFunc {
+		return func(req *Request) (*Allow, error) {
+			if req.Err != nil {
+				return nil, req.Err
+			}
+			return next(req)
+		}
+	}
+}
+
+// RateLimitMiddleware 按设备ID限速，超出时返回 ErrRateLimited
+func RateLimitMiddleware(limit RateLimit) Middleware {
+	limiter := newBucketLimiter(limit)
+	return func(next AuthorityFunc) AuthorityFunc {
+		return func(req *Request) (*Allow, error) {
+			if req.Body != nil && !limiter.allow(req.Body.ClientDeviceId, req.Received) {
+				return nil, ErrRateLimited
+			}
+			return next(req)
+		}
+	}
+}
+
+// ReplayMiddleware 使用独立的防重放缓存检查spa报，用于在服务端检查之外按监听或用途区分
+func ReplayMiddleware(cache *libspa.ReplayCache) Middleware {
+	return func(next AuthorityFunc) AuthorityFunc {
+		return func(req *Request) (*Allow, error) {
+			if req.Packet != nil {
+				if err := cache.Check(req.Packet, req.Received); err != nil {
+					return nil, err
+				}
+			}
+			return next(req)
+		}
+	}
+}
+
+// PolicyMiddleware 策略拒绝或无匹配规则时返回 ErrPolicyDenied，允许时由后续处理决定放行
+func PolicyMiddleware(h *PolicyHandler) Middleware {
+	return func(next AuthorityFunc) AuthorityFunc {
+		return func(req *Request) (*Allow, error) {
+			if req.Body == nil {
+				return next(req)
+			}
+			decision := h.Evaluate(&PolicyRequest{DeviceID: req.Body.ClientDeviceId, SourceIP: req.SourceIP, Time: req.Received})
+			if !decision.Allow {
+				return nil, ErrPolicyDenied
+			}
+			return next(req)
+		}
+	}
+}
+
+// AuditMiddleware 将后续处理的结果输出到审计接口，用于在服务端审计之外单独记录某个处理链
+func AuditMiddleware(sink AuditSink) Middleware {
+	audit := newAuditor([]AuditSink{sink})
+	return func(next AuthorityFunc) AuthorityFunc {
+		return func(req *Request) (*Allow, error) {
+			allow, err := next(req)
+			event := requestEvent(req)
+			switch {
+			case err != nil:
+				event.Decision, event.Error, event.Message = DecisionBlock, ErrorCode(err), err.Error()
+				if err == req.Err {
+					event.Decision = DecisionInvalid
+				}
+			case allow == nil:
+				event.Decision = DecisionBlock
+			default:
+				event.Decision, event.User = DecisionAllow, allow.User
+			}
+			audit.emit(event)
+			return allow, err
+		}
+	}
+}
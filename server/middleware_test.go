@@ -0,0 +1,123 @@
+package spaserver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/1uLang/libspa"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next AuthorityFunc) AuthorityFunc {
+			return func(req *Request) (*Allow, error) {
+				order = append(order, name)
+				return next(req)
+			}
+		}
+	}
+	h := Chain(func(req *Request) (*Allow, error) {
+		order = append(order, "handler")
+		return &Allow{}, nil
+	}, mw("first"), mw("second"))
+	if allow, err := h(&Request{}); err != nil || allow == nil {
+		t.Fatal("unexpected result", allow, err)
+	}
+	if !reflect.DeepEqual(order, []string{"first", "second", "handler"}) {
+		t.Fatal("unexpected order", order)
+	}
+}
+
+// 返回自定义错误码的错误
+type codeError string
+
+func (e codeError) Error() string     { return string(e) }
+func (e codeError) ErrorCode() string { return "device_disabled" }
+
+func TestServer_Middleware(t *testing.T) {
+	srv, h := newTestServer(t)
+	sink := &memorySink{}
+	srv.AuditSinks = []AuditSink{sink}
+	srv.Firewall = &recordFirewall{}
+	srv.MetricsRegistry = prometheus.NewRegistry()
+	srv.audit = nil
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	h.allow = &Allow{TcpPorts: []int{22}}
+	var requests []*Request
+	srv.Use(func(next AuthorityFunc) AuthorityFunc {
+		return func(req *Request) (*Allow, error) {
+			requests = append(requests, req)
+			if req.Body != nil && req.Body.ClientDeviceId == replayedDevice {
+				return nil, codeError("device disabled")
+			}
+			return next(req)
+		}
+	}, RateLimitMiddleware(RateLimit{Rate: 0.001, Burst: 1}))
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+
+	if reply := handler.authority(conn, newTestPacket(t, firstDevice)); reply.Code != libspa.ReplyAllowed {
+		t.Fatal("unexpected reply", reply.Code)
+	}
+	req := requests[0]
+	if req.KeyId != testKey.ID || req.Method == 0 || req.Listener.Protocol != "udp" || req.Listener.Addr != "127.0.0.1:62201" ||
+		!req.SourceIP.Equal(net.ParseIP("127.0.0.1")) || req.Received.IsZero() || req.Err != nil || req.ErrCode != "" {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	//同一设备再次认证被中间件限速
+	if reply := handler.authority(conn, newTestPacket(t, firstDevice)); reply.Code != libspa.ReplyRateLimited {
+		t.Fatal("expect rate limited, got", reply.Code)
+	}
+	if reply := handler.authority(conn, newTestPacket(t, replayedDevice)); reply.Code != libspa.ReplyInvalid {
+		t.Fatal("expect invalid, got", reply.Code)
+	}
+	//解析失败时 handler 同样经过中间件
+	handler.authority(conn, []byte("garbage"))
+	if req := requests[len(requests)-1]; req.Err == nil || req.ErrCode != CodeBadStartCode || req.Body != nil {
+		t.Fatalf("unexpected request %+v", req)
+	}
+
+	sink.locker.Lock()
+	events := append([]AuditEvent(nil), sink.events...)
+	sink.locker.Unlock()
+	var codes []string
+	for _, event := range events {
+		if event.Type == AuditKnock {
+			codes = append(codes, event.Decision+"/"+event.Error)
+		}
+	}
+	expected := []string{"allow/", "block/rate_limited", "block/device_disabled", "invalid/bad_start_code"}
+	if !reflect.DeepEqual(codes, expected) {
+		t.Fatal("unexpected audit events", codes)
+	}
+	m := srv.metrics
+	if v := testutil.ToFloat64(m.authorityErrors.WithLabelValues("device_disabled")); v != 1 {
+		t.Fatal("unexpected device_disabled errors", v)
+	}
+	if v := testutil.ToFloat64(m.authorityErrors.WithLabelValues(CodeRateLimited)); v != 1 {
+		t.Fatal("unexpected rate_limited errors", v)
+	}
+	if n := testutil.CollectAndCount(m.authorityErrors); n != 2 {
+		t.Fatal("parse failures must not be counted as authority errors, got", n)
+	}
+}
+
+func TestErrorCode_Wrapped(t *testing.T) {
+	if code := ErrorCode(errors.New("other")); code != CodeError {
+		t.Fatal("unexpected code", code)
+	}
+	if code := ErrorCode(fmt.Errorf("device 1:%w", ErrPolicyDenied)); code != CodePolicyDenied {
+		t.Fatal("unexpected code", code)
+	}
+}
@@ -0,0 +1,389 @@
+package spaserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy 声明式放行策略，按顺序匹配规则，第一条匹配的规则决定结果，无匹配时拒绝
+//
+//	users:
+//	  alice: ["6ba7b810-9dad-11d1-80b4-00c04fd430c8"]
+//	rules:
+//	  - name: office-ssh
+//	    users: [alice]
+//	    sources: [10.0.0.0/8]
+//	    schedules:
+//	      - days: [mon, tue, wed, thu, fri]
+//	        from: "08:00"
+//	        to: "20:00"
+//	        timezone: Asia/Shanghai
+//	    tcp_ports: [22]
+//	    duration: 1h
+//	  - name: default-deny
+//	    action: deny
+type Policy struct {
+	//用户及其设备ID，设备ID支持 * ? 通配，设备匹配多个用户时按用户名排序取第一个
+	Users map[string][]string `yaml:"users" toml:"users" json:"users"`
+	//规则列表
+	Rules []*PolicyRule `yaml:"rules" toml:"rules" json:"rules"`
+
+	//排序后的用户名，保证匹配结果确定
+	userNames []string
+}
+
+// PolicyRule 放行规则，未设置的匹配条件匹配所有请求
+type PolicyRule struct {
+	Name string `yaml:"name" toml:"name" json:"name"`
+	//设备ID，支持 * ? 通配，不区分大小写
+	Devices []string `yaml:"devices" toml:"devices" json:"devices"`
+	//用户
+	Users []string `yaml:"users" toml:"users" json:"users"`
+	//来源网段，支持单个IP
+	Sources []string `yaml:"sources" toml:"sources" json:"sources"`
+	//生效时间，满足任一时间段即可
+	Schedules []PolicySchedule `yaml:"schedules" toml:"schedules" json:"schedules"`
+	//动作 allow/deny，默认 allow
+	Action string `yaml:"action" toml:"action" json:"action"`
+	//放行的端口，请求指定端口时须全部在其中，并只放行请求的端口
+	TcpPorts []int `yaml:"tcp_ports" toml:"tcp_ports" json:"tcp_ports"`
+	UdpPorts []int `yaml:"udp_ports" toml:"udp_ports" json:"udp_ports"`
+	//放行时间，如 "30m"，为空时使用 Server.SPATimeout
+	Duration string `yaml:"duration" toml:"duration" json:"duration"`
+	//转发服务的目标地址
+	Destination string `yaml:"destination" toml:"destination" json:"destination"`
+
+	deny        bool
+	sources     []*net.IPNet
+	duration    time.Duration
+	destination net.IP
+}
+
+// PolicySchedule 生效时间段，To 早于 From 时跨越午夜
+type PolicySchedule struct {
+	//星期 mon/tue/wed/thu/fri/sat/sun，为空时每天生效
+	Days []string `yaml:"days" toml:"days" json:"days"`
+	//开始及结束时间 HH:MM，为空时全天生效
+	From string `yaml:"from" toml:"from" json:"from"`
+	To   string `yaml:"to" toml:"to" json:"to"`
+	//时区，为空时使用本地时区
+	Timezone string `yaml:"timezone" toml:"timezone" json:"timezone"`
+
+	days     map[time.Weekday]bool
+	from, to int
+	location *time.Location
+}
+
+// PolicyRequest 策略评估的输入
+type PolicyRequest struct {
+	DeviceID string `json:"device_id"`
+	//用户，为空时按 Policy.Users 由设备ID确定
+	User string `json:"user,omitempty"`
+	//来源IP
+	SourceIP net.IP `json:"source_ip,omitempty"`
+	//请求的端口，为空时放行规则的所有端口
+	TcpPorts []int `json:"tcp_ports,omitempty"`
+	UdpPorts []int `json:"udp_ports,omitempty"`
+	//请求时间，为零值时使用当前时间
+	Time time.Time `json:"time"`
+}
+
+// PolicyDecision 策略评估的结果
+type PolicyDecision struct {
+	Allow bool `json:"allow"`
+	//匹配的规则，无匹配时为空
+	Rule string `json:"rule,omitempty"`
+	User string `json:"user,omitempty"`
+	//放行的端口
+	TcpPorts []int `json:"tcp_ports,omitempty"`
+	UdpPorts []int `json:"udp_ports,omitempty"`
+	//放行时间，为0时使用 Server.SPATimeout
+	Duration time.Duration `json:"duration,omitempty"`
+	//转发服务的目标地址
+	Destination net.IP `json:"destination,omitempty"`
+	//结果说明
+	Reason string `json:"reason"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// LoadPolicy 读取策略文件，按扩展名解析 YAML（.yaml/.yml）、TOML（.toml）或 JSON（.json）
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParsePolicy(data, strings.TrimPrefix(filepath.Ext(file), "."))
+	if err != nil {
+		return nil, fmt.Errorf("policy %s error:%v", file, err)
+	}
+	return policy, nil
+}
+
+// ParsePolicy 解析并校验策略，format 为 yaml/yml/toml/json
+func ParsePolicy(data []byte, format string) (*Policy, error) {
+	policy := &Policy{}
+	var err error
+	switch strings.ToLower(format) {
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, policy)
+	case "toml":
+		_, err = toml.Decode(string(data), policy)
+	case "json":
+		err = json.Unmarshal(data, policy)
+	default:
+		return nil, errors.New("unsupported policy format " + format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// 校验策略并预先解析网段、时间等字段
+func (p *Policy) compile() error {
+	p.userNames = make([]string, 0, len(p.Users))
+	for user := range p.Users {
+		p.userNames = append(p.userNames, user)
+	}
+	sort.Strings(p.userNames)
+	for _, user := range p.userNames {
+		for _, device := range p.Users[user] {
+			if _, err := path.Match(device, ""); err != nil {
+				return fmt.Errorf("user %s device %q: %v", user, device, err)
+			}
+		}
+	}
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) compile() (err error) {
+	switch strings.ToLower(r.Action) {
+	case "", "allow":
+		r.deny = false
+	case "deny":
+		r.deny = true
+	default:
+		return errors.New("invalid action " + r.Action)
+	}
+	for _, device := range r.Devices {
+		if _, err := path.Match(device, ""); err != nil {
+			return fmt.Errorf("device %q: %v", device, err)
+		}
+	}
+	if r.sources, err = parseCIDRs(r.Sources); err != nil {
+		return err
+	}
+	for i := range r.Schedules {
+		if err := r.Schedules[i].compile(); err != nil {
+			return err
+		}
+	}
+	for _, port := range append(append([]int{}, r.TcpPorts...), r.UdpPorts...) {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	r.duration = 0
+	if r.Duration != "" {
+		if r.duration, err = time.ParseDuration(r.Duration); err != nil || r.duration <= 0 {
+			return errors.New("invalid duration " + r.Duration)
+		}
+	}
+	r.destination = nil
+	if r.Destination != "" {
+		if r.destination = net.ParseIP(r.Destination); r.destination == nil {
+			return errors.New("invalid destination " + r.Destination)
+		}
+	}
+	return nil
+}
+
+func (s *PolicySchedule) compile() (err error) {
+	s.days = map[time.Weekday]bool{}
+	for _, day := range s.Days {
+		key := strings.ToLower(day)
+		if len(key) > 3 {
+			key = key[:3]
+		}
+		weekday, ok := weekdays[key]
+		if !ok {
+			return errors.New("invalid day " + day)
+		}
+		s.days[weekday] = true
+	}
+	if s.from, err = parseClock(s.From, 0); err != nil {
+		return err
+	}
+	if s.to, err = parseClock(s.To, 24*60); err != nil {
+		return err
+	}
+	s.location = time.Local
+	if s.Timezone != "" {
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 解析 HH:MM 为当天的分钟数
+func parseClock(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New("invalid time " + s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// 判断时间是否在时间段内
+func (s *PolicySchedule) match(t time.Time) bool {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if s.from > s.to && minute < s.to {
+		//跨越午夜的时间段，凌晨部分属于前一天
+		day = (day + 6) % 7
+	}
+	if len(s.days) > 0 && !s.days[day] {
+		return false
+	}
+	if s.from <= s.to {
+		return minute >= s.from && minute < s.to
+	}
+	return minute >= s.from || minute < s.to
+}
+
+// Evaluate 评估请求，返回第一条匹配规则的结果
+func (p *Policy) Evaluate(req *PolicyRequest) *PolicyDecision {
+	at := req.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	user := req.User
+	if user == "" {
+		user = p.user(req.DeviceID)
+	}
+	for _, rule := range p.Rules {
+		if !rule.match(req, user, at) {
+			continue
+		}
+		decision := &PolicyDecision{Rule: rule.Name, User: user}
+		if rule.deny {
+			decision.Reason = "denied by rule " + rule.Name
+			return decision
+		}
+		decision.Allow = true
+		decision.TcpPorts, decision.UdpPorts = rule.TcpPorts, rule.UdpPorts
+		if len(req.TcpPorts) > 0 || len(req.UdpPorts) > 0 {
+			decision.TcpPorts, decision.UdpPorts = req.TcpPorts, req.UdpPorts
+		}
+		decision.Duration, decision.Destination = rule.duration, rule.destination
+		decision.Reason = "allowed by rule " + rule.Name
+		return decision
+	}
+	return &PolicyDecision{User: user, Reason: "no rule matched"}
+}
+
+// 设备所属的用户，按用户名顺序匹配
+func (p *Policy) user(device string) string {
+	for _, user := range p.userNames {
+		if matchDevice(p.Users[user], device) {
+			return user
+		}
+	}
+	return ""
+}
+
+func (r *PolicyRule) match(req *PolicyRequest, user string, at time.Time) bool {
+	if len(r.Devices) > 0 && !matchDevice(r.Devices, req.DeviceID) {
+		return false
+	}
+	if len(r.Users) > 0 && !containsString(r.Users, user) {
+		return false
+	}
+	if len(r.sources) > 0 && (req.SourceIP == nil || !containsIP(r.sources, req.SourceIP)) {
+		return false
+	}
+	if len(r.Schedules) > 0 {
+		matched := false
+		for i := range r.Schedules {
+			if r.Schedules[i].match(at) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	//拒绝规则不检查端口
+	if r.deny {
+		return true
+	}
+	return containsPorts(r.TcpPorts, req.TcpPorts) && containsPorts(r.UdpPorts, req.UdpPorts)
+}
+
+// 设备ID匹配，支持 * ? 通配，不区分大小写
+func matchDevice(patterns []string, device string) bool {
+	device = strings.ToLower(device)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), device); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求的端口是否全部允许
+func containsPorts(allowed, requested []int) bool {
+	for _, port := range requested {
+		found := false
+		for _, p := range allowed {
+			if p == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package spaserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/1uLang/libspa"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// PolicyHandler 按声明式策略认证的 Handler，策略文件可在运行中重新加载
+// 来源IP匹配连接的实际来源地址
+type PolicyHandler struct {
+	file string
+
+	locker  sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+}
+
+// NewPolicyHandler 从策略文件创建 Handler
+func NewPolicyHandler(file string) (*PolicyHandler, error) {
+	h := &PolicyHandler{file: file}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload 重新加载策略文件，加载失败时保留原策略
+func (h *PolicyHandler) Reload() error {
+	if h.file == "" {
+		return errors.New("policy file is not set")
+	}
+	info, err := os.Stat(h.file)
+	if err != nil {
+		return err
+	}
+	policy, err := LoadPolicy(h.file)
+	if err != nil {
+		return err
+	}
+	h.locker.Lock()
+	h.policy, h.modTime = policy, info.ModTime()
+	h.locker.Unlock()
+	return nil
+}
+
+// Watch 定期检查策略文件，修改后重新加载，阻塞至 ctx 取消
+func (h *PolicyHandler) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(h.file)
+		if err != nil {
+			log.Error("stat policy file err:", err)
+			continue
+		}
+		h.locker.RLock()
+		modified := !info.ModTime().Equal(h.modTime)
+		h.locker.RUnlock()
+		if !modified {
+			continue
+		}
+		if err := h.Reload(); err != nil {
+			log.Error("reload policy err:", err)
+			continue
+		}
+		log.Info(fmt.Sprintf("policy %s reloaded", h.file))
+	}
+}
+
+// SetPolicy 替换策略
+func (h *PolicyHandler) SetPolicy(policy *Policy) error {
+	if err := policy.compile(); err != nil {
+		return err
+	}
+	h.locker.Lock()
+	h.policy = policy
+	h.locker.Unlock()
+	return nil
+}
+
+// Policy 当前策略
+func (h *PolicyHandler) Policy() *Policy {
+	h.locker.RLock()
+	defer h.locker.RUnlock()
+	return h.policy
+}
+
+// Evaluate 评估请求在当前策略下的结果，不修改防火墙
+func (h *PolicyHandler) Evaluate(req *PolicyRequest) *PolicyDecision {
+	policy := h.Policy()
+	if policy == nil {
+		return &PolicyDecision{Reason: "no policy loaded"}
+	}
+	return policy.Evaluate(req)
+}
+
+func (h *PolicyHandler) OnConnect(conn *Conn) {}
+
+// OnAuthority 未通过 Server 调用时没有来源地址，spa报中的 ClientPublicIP 由客户端填写不可信，
+// 因此限制来源网段的规则均不匹配
+func (h *PolicyHandler) OnAuthority(body *libspa.Body, err error) (*Allow, error) {
+	if err != nil {
+		return nil, err
+	}
+	return h.allow(body, nil)
+}
+
+// OnRequest 通过 Server 调用时使用连接的来源IP
+func (h *PolicyHandler) OnRequest(req *Request) (*Allow, error) {
+	if req.Err != nil {
+		return nil, req.Err
+	}
+	return h.allow(req.Body, req.SourceIP)
+}
+
+func (h *PolicyHandler) allow(body *libspa.Body, source net.IP) (*Allow, error) {
+	decision := h.Evaluate(&PolicyRequest{DeviceID: body.ClientDeviceId, SourceIP: source})
+	log.Debug(fmt.Sprintf("policy device %s source %s: %s", body.ClientDeviceId, source, decision.Reason))
+	if !decision.Allow {
+		return nil, nil
+	}
+	return &Allow{
+		TcpPorts:    decision.TcpPorts,
+		UdpPorts:    decision.UdpPorts,
+		Duration:    decision.Duration,
+		Destination: decision.Destination,
+		User:        decision.User,
+	}, nil
+}
+
+func (h *PolicyHandler) OnClose(conn *Conn, err error) {}
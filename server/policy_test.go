@@ -0,0 +1,256 @@
+package spaserver
+
+import (
+	"context"
+	"github.com/1uLang/libspa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+users:
+  alice: ["00000000-0000-0000-0000-0000000000a*"]
+rules:
+  - name: block-guest
+    sources: [192.0.2.0/24]
+    action: deny
+  - name: office-ssh
+    users: [alice]
+    sources: [10.0.0.0/8]
+    schedules:
+      - days: [mon, tue, wed, thu, fri]
+        from: "08:00"
+        to: "20:00"
+        timezone: UTC
+    tcp_ports: [22, 443]
+    duration: 1h
+  - name: night-backup
+    devices: ["00000000-0000-0000-0000-0000000000B?"]
+    schedules:
+      - days: [sat]
+        from: "22:00"
+        to: "02:00"
+        timezone: UTC
+    udp_ports: [873]
+    destination: 10.1.1.1
+`
+
+func TestPolicy_Evaluate(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//2022-11-07 为星期一
+	monday := time.Date(2022, 11, 7, 9, 30, 0, 0, time.UTC)
+	alice := "00000000-0000-0000-0000-0000000000a1"
+	backup := "00000000-0000-0000-0000-0000000000b2"
+	cases := []struct {
+		name string
+		req  PolicyRequest
+		rule string
+		tcp  []int
+		udp  []int
+	}{
+		{"office hours", PolicyRequest{DeviceID: alice, SourceIP: net.ParseIP("10.2.3.4"), Time: monday}, "office-ssh", []int{22, 443}, nil},
+		{"requested port", PolicyRequest{DeviceID: alice, SourceIP: net.ParseIP("10.2.3.4"), TcpPorts: []int{443}, Time: monday}, "office-ssh", []int{443}, nil},
+		{"port not allowed", PolicyRequest{DeviceID: alice, SourceIP: net.ParseIP("10.2.3.4"), TcpPorts: []int{3389}, Time: monday}, "", nil, nil},
+		{"after hours", PolicyRequest{DeviceID: alice, SourceIP: net.ParseIP("10.2.3.4"), Time: monday.Add(11 * time.Hour)}, "", nil, nil},
+		{"weekend", PolicyRequest{DeviceID: alice, SourceIP: net.ParseIP("10.2.3.4"), Time: monday.Add(-48 * time.Hour)}, "", nil, nil},
+		{"outside source", PolicyRequest{DeviceID: alice, SourceIP: net.ParseIP("172.16.0.1"), Time: monday}, "", nil, nil},
+		{"denied source", PolicyRequest{DeviceID: alice, SourceIP: net.ParseIP("192.0.2.1"), Time: monday}, "block-guest", nil, nil},
+		{"unknown user", PolicyRequest{DeviceID: backup, SourceIP: net.ParseIP("10.2.3.4"), Time: monday}, "", nil, nil},
+		//星期六 22:00 至星期日 02:00
+		{"saturday night", PolicyRequest{DeviceID: backup, Time: time.Date(2022, 11, 12, 23, 0, 0, 0, time.UTC)}, "night-backup", nil, []int{873}},
+		{"sunday early", PolicyRequest{DeviceID: backup, Time: time.Date(2022, 11, 13, 1, 0, 0, 0, time.UTC)}, "night-backup", nil, []int{873}},
+		{"friday early", PolicyRequest{DeviceID: backup, Time: time.Date(2022, 11, 12, 1, 0, 0, 0, time.UTC)}, "", nil, nil},
+	}
+	for _, c := range cases {
+		decision := policy.Evaluate(&c.req)
+		allow := c.rule != "" && c.rule != "block-guest"
+		if decision.Allow != allow || decision.Rule != c.rule || !reflect.DeepEqual(decision.TcpPorts, c.tcp) || !reflect.DeepEqual(decision.UdpPorts, c.udp) {
+			t.Fatalf("%s: unexpected decision %+v", c.name, decision)
+		}
+	}
+	decision := policy.Evaluate(&PolicyRequest{DeviceID: alice, SourceIP: net.ParseIP("10.2.3.4"), Time: monday})
+	if decision.User != "alice" || decision.Duration != time.Hour {
+		t.Fatalf("unexpected decision %+v", decision)
+	}
+	decision = policy.Evaluate(&PolicyRequest{DeviceID: backup, Time: time.Date(2022, 11, 12, 23, 0, 0, 0, time.UTC)})
+	if !decision.Destination.Equal(net.ParseIP("10.1.1.1")) {
+		t.Fatalf("unexpected destination %+v", decision)
+	}
+}
+
+// 设备匹配多个用户时结果确定
+func TestPolicy_OverlappingUsers(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+users:
+  carol: ["00000000-0000-0000-0000-00000000000*"]
+  bob: ["00000000-0000-0000-0000-0000000000*"]
+  alice: ["00000000-0000-0000-0000-000000000001"]
+rules:
+  - name: bob-only
+    users: [bob]
+    tcp_ports: [22]
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		decision := policy.Evaluate(&PolicyRequest{DeviceID: firstDevice})
+		if decision.User != "alice" || decision.Allow {
+			t.Fatalf("unexpected decision %+v", decision)
+		}
+		decision = policy.Evaluate(&PolicyRequest{DeviceID: "00000000-0000-0000-0000-000000000002"})
+		if decision.User != "bob" || !decision.Allow {
+			t.Fatalf("unexpected decision %+v", decision)
+		}
+	}
+}
+
+func TestParsePolicy_Invalid(t *testing.T) {
+	for _, data := range []string{
+		"rules: [{action: maybe}]",
+		"rules: [{sources: [10.0.0.0/33]}]",
+		"rules: [{tcp_ports: [70000]}]",
+		"rules: [{duration: soon}]",
+		"rules: [{schedules: [{days: [someday]}]}]",
+		"rules: [{schedules: [{from: '25:00'}]}]",
+		"rules: [{devices: ['[']}]",
+	} {
+		if _, err := ParsePolicy([]byte(data), "yaml"); err == nil {
+			t.Fatal("expect invalid policy", data)
+		}
+	}
+	toml := `
+[users]
+alice = ["00000000-0000-0000-0000-0000000000a*"]
+
+[[rules]]
+name = "ssh"
+users = ["alice"]
+tcp_ports = [22]
+`
+	policy, err := ParsePolicy([]byte(toml), "toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision := policy.Evaluate(&PolicyRequest{DeviceID: "00000000-0000-0000-0000-0000000000a1"}); !decision.Allow || decision.Rule != "ssh" {
+		t.Fatalf("unexpected decision %+v", decision)
+	}
+}
+
+func TestPolicyHandler_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(file, []byte("rules: [{name: ssh, tcp_ports: [22]}]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewPolicyHandler(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Watch(ctx, 10*time.Millisecond)
+
+	//加载失败时保留原策略
+	if err := ioutil.WriteFile(file, []byte("rules: [{action: maybe}]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err == nil {
+		t.Fatal("expect invalid policy")
+	}
+	if decision := h.Evaluate(&PolicyRequest{}); decision.Rule != "ssh" {
+		t.Fatalf("old policy should be kept %+v", decision)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("rules: [{name: https, tcp_ports: [443]}]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, future, future); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for h.Evaluate(&PolicyRequest{}).Rule != "https" {
+		if time.Now().After(deadline) {
+			t.Fatal("policy was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 没有来源地址时不使用客户端填写的 ClientPublicIP 匹配来源网段
+func TestPolicyHandler_OnAuthority(t *testing.T) {
+	policy, err := ParsePolicy([]byte("rules: [{name: office, sources: [10.0.0.0/8], tcp_ports: [22]}, {name: web, tcp_ports: [443]}]"), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &PolicyHandler{}
+	if err := h.SetPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	body := &libspa.Body{ClientDeviceId: firstDevice, ClientPublicIP: net.ParseIP("10.1.2.3")}
+	allow, err := h.OnAuthority(body, nil)
+	if err != nil || allow == nil || !reflect.DeepEqual(allow.TcpPorts, []int{443}) {
+		t.Fatal("rule with sources must not match client reported ip", allow, err)
+	}
+	allow, err = h.OnRequest(&Request{Body: body, SourceIP: net.ParseIP("10.1.2.3")})
+	if err != nil || allow == nil || !reflect.DeepEqual(allow.TcpPorts, []int{22}) {
+		t.Fatal("rule with sources should match peer address", allow, err)
+	}
+}
+
+func TestServer_PolicyHandler(t *testing.T) {
+	srv, _ := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	h := &PolicyHandler{}
+	policy := &Policy{
+		Users: map[string][]string{"alice": {firstDevice}},
+		Rules: []*PolicyRule{{Name: "local", Sources: []string{"127.0.0.0/8"}, TcpPorts: []int{22}, Duration: "2m", Destination: "10.0.0.5"}},
+	}
+	if err := h.SetPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	firewall := &recordFirewall{}
+	sink := &memorySink{}
+	srv.SetHandler(h)
+	srv.Firewall = firewall
+	srv.AuditSinks = []AuditSink{sink}
+	srv.audit = nil
+	errs, listeners := runTestServer(t, srv, context.Background())
+	sendTestPacket(t, listeners[0], firstDevice)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		firewall.locker.Lock()
+		opened := append([]Rule{}, firewall.opened...)
+		firewall.locker.Unlock()
+		if len(opened) > 0 {
+			if opened[0].IP != "127.0.0.1" || opened[0].Port != 22 || opened[0].Timeout != 120 || opened[0].Destination != "10.0.0.5" {
+				t.Fatal("unexpected grant", opened)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("policy did not grant access")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-errs
+	sink.locker.Lock()
+	defer sink.locker.Unlock()
+	if len(sink.events) == 0 || sink.events[len(sink.events)-1].Type != AuditKnock {
+		t.Fatal("unexpected audit events", sink.events)
+	}
+	if event := sink.events[len(sink.events)-1]; event.User != "alice" || event.Decision != DecisionAllow {
+		t.Fatal("unexpected audit event", event)
+	}
+}
@@ -0,0 +1,197 @@
+package spaserver
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 丢弃日志的采样间隔
+const dropLogInterval = 10 * time.Second
+
+// RateLimit 令牌桶限速，Rate 为每秒补充的令牌数，为0时不限速
+// Burst 为桶容量，为0时使用 Rate 向上取整且至少为1
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits spa报限速配置，源地址相关的限速在解密前执行
+type RateLimits struct {
+	//全局限速
+	Global RateLimit
+	//每个来源IP
+	Source RateLimit
+	//每个来源网段，IPv4 为/24，IPv6 为/64
+	Prefix RateLimit
+	//每个设备ID，在解密后执行，用于限制密钥泄露后的放行操作
+	Device RateLimit
+}
+
+// RateLimitDrops 各限速丢弃的spa报数量
+type RateLimitDrops struct {
+	Global uint64
+	Source uint64
+	Prefix uint64
+	Device uint64
+}
+
+// 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 按键区分的令牌桶集合
+type bucketLimiter struct {
+	rate  float64
+	burst float64
+
+	locker    sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// 未设置 Rate 时返回空，表示不限速
+func newBucketLimiter(limit RateLimit) *bucketLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &bucketLimiter{rate: limit.Rate, burst: burst, buckets: map[string]*tokenBucket{}}
+}
+
+// 消耗一个令牌，令牌不足时返回false
+func (l *bucketLimiter) allow(key string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else if now.After(b.last) {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 清理已补满的令牌桶，每秒最多执行一次
+func (l *bucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Second {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration((l.burst / l.rate) * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// spa报限速
+type rateLimiter struct {
+	global *bucketLimiter
+	source *bucketLimiter
+	prefix *bucketLimiter
+	device *bucketLimiter
+
+	drops RateLimitDrops
+
+	locker   sync.Mutex
+	lastLog  time.Time
+	unlogged uint64
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		global: newBucketLimiter(limits.Global),
+		source: newBucketLimiter(limits.Source),
+		prefix: newBucketLimiter(limits.Prefix),
+		device: newBucketLimiter(limits.Device),
+	}
+}
+
+// 解密前按来源IP、网段及全局限速
+func (r *rateLimiter) allowSource(ip net.IP, now time.Time) bool {
+	if r == nil {
+		return true
+	}
+	if ip != nil {
+		if !r.source.allow(string(ip.To16()), now) {
+			r.drop(&r.drops.Source, "source", ip.String(), now)
+			return false
+		}
+		prefix := sourcePrefix(ip)
+		if !r.prefix.allow(prefix.String(), now) {
+			r.drop(&r.drops.Prefix, "prefix", prefix.String(), now)
+			return false
+		}
+	}
+	if !r.global.allow("", now) {
+		r.drop(&r.drops.Global, "global", ip.String(), now)
+		return false
+	}
+	return true
+}
+
+// 解密后按设备ID限速
+func (r *rateLimiter) allowDevice(deviceId string, now time.Time) bool {
+	if r == nil || r.device.allow(deviceId, now) {
+		return true
+	}
+	r.drop(&r.drops.Device, "device", deviceId, now)
+	return false
+}
+
+// 统计丢弃数量并按采样间隔输出日志
+func (r *rateLimiter) drop(counter *uint64, reason, key string, now time.Time) {
+	atomic.AddUint64(counter, 1)
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if now.Sub(r.lastLog) < dropLogInterval {
+		r.unlogged++
+		return
+	}
+	log.Warn(fmt.Sprintf("spa packet rate limited by %s limit [%s], %d more dropped since last report", reason, key, r.unlogged))
+	r.lastLog, r.unlogged = now, 0
+}
+
+// 丢弃统计
+func (r *rateLimiter) stats() RateLimitDrops {
+	if r == nil {
+		return RateLimitDrops{}
+	}
+	return RateLimitDrops{
+		Global: atomic.LoadUint64(&r.drops.Global),
+		Source: atomic.LoadUint64(&r.drops.Source),
+		Prefix: atomic.LoadUint64(&r.drops.Prefix),
+		Device: atomic.LoadUint64(&r.drops.Device),
+	}
+}
+
+// 来源IP所在网段，IPv4 为/24，IPv6 为/64
+func sourcePrefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(64, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
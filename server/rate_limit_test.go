@@ -0,0 +1,97 @@
+package spaserver
+
+import (
+	"github.com/1uLang/libspa"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBucketLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newBucketLimiter(RateLimit{Rate: 2, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", now) {
+			t.Fatal("expect burst to be allowed", i)
+		}
+	}
+	if l.allow("a", now) {
+		t.Fatal("expect bucket to be empty")
+	}
+	if !l.allow("b", now) {
+		t.Fatal("buckets must be independent")
+	}
+	//每秒补充2个令牌
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow("a", now) || l.allow("a", now) {
+		t.Fatal("expect one token after 500ms")
+	}
+	//补满后被清理
+	now = now.Add(10 * time.Second)
+	l.allow("c", now)
+	if len(l.buckets) != 1 {
+		t.Fatal("expect full buckets to be swept, left", len(l.buckets))
+	}
+	if newBucketLimiter(RateLimit{}) != nil || !(*bucketLimiter)(nil).allow("a", now) {
+		t.Fatal("zero rate must not limit")
+	}
+	if l := newBucketLimiter(RateLimit{Rate: 0.5}); l.burst != 1 {
+		t.Fatal("unexpected default burst", l.burst)
+	}
+}
+
+func TestRateLimiter_Source(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := newRateLimiter(RateLimits{
+		Source: RateLimit{Rate: 1, Burst: 1},
+		Prefix: RateLimit{Rate: 1, Burst: 2},
+		Global: RateLimit{Rate: 1, Burst: 3},
+	})
+	if !r.allowSource(net.ParseIP("192.0.2.1"), now) || r.allowSource(net.ParseIP("192.0.2.1"), now) {
+		t.Fatal("expect source limit")
+	}
+	if !r.allowSource(net.ParseIP("192.0.2.2"), now) || r.allowSource(net.ParseIP("192.0.2.3"), now) {
+		t.Fatal("expect /24 prefix limit")
+	}
+	if !r.allowSource(net.ParseIP("2001:db8::1"), now) || r.allowSource(net.ParseIP("2001:db8::2"), now) {
+		t.Fatal("expect global limit")
+	}
+	want := RateLimitDrops{Global: 1, Source: 1, Prefix: 1}
+	if r.stats() != want {
+		t.Fatal("unexpected drops", r.stats())
+	}
+	if p := sourcePrefix(net.ParseIP("2001:db8:1:2:3::1")).String(); p != "2001:db8:1:2::/64" {
+		t.Fatal("unexpected ipv6 prefix", p)
+	}
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	srv, h := newTestServer(t)
+	srv.RateLimits.Device = RateLimit{Rate: 0.001, Burst: 1}
+	srv.limits = nil
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	if reply := handler.authority(conn, newTestPacket(t, firstDevice)); reply.Code != libspa.ReplyBlocked {
+		t.Fatal("unexpected reply", reply)
+	}
+	if _, err := h.wait(t); err != nil {
+		t.Fatal(err)
+	}
+	//同一设备超出限速时不再回调
+	if reply := handler.authority(conn, newTestPacket(t, firstDevice)); reply.Code != libspa.ReplyRateLimited {
+		t.Fatal("unexpected reply", reply)
+	}
+	if reply := handler.authority(conn, newTestPacket(t, replayedDevice)); reply.Code != libspa.ReplyBlocked {
+		t.Fatal("unexpected reply", reply)
+	}
+	if drops := srv.RateLimitDrops(); drops.Device != 1 {
+		t.Fatal("unexpected drops", drops)
+	}
+}
@@ -0,0 +1,114 @@
+package spaserver
+
+import (
+	"context"
+	"github.com/1uLang/libspa"
+	"github.com/1uLang/libspa/encrypt"
+	"net"
+	"time"
+)
+
+// Request 认证请求上下文
+type Request struct {
+	//连接
+	Conn *Conn
+	//接收spa报的监听，Addr 为实际监听地址
+	Listener Listener
+	//来源IP
+	SourceIP net.IP
+	//接收时间
+	Received time.Time
+	//原始spa报，仅在回调期间有效
+	Raw []byte
+	//报文头部中的加密方式ID及密钥ID，头部无法解析时为0
+	Method uint8
+	KeyId  uint32
+	//解析后的spa报，解析失败时为空
+	Packet *libspa.Packet
+	Body   *libspa.Body
+	//解析或校验失败的原因及错误码，见 ErrorCode
+	Err     error
+	ErrCode string
+	//按 SourcePolicy 选择的放行IP，校验失败时为空
+	GrantIP net.IP
+	//设备已有该IP未到期的放行，本次认证为续期
+	Renewal bool
+
+	ctx context.Context
+}
+
+// Context 请求的 context，未设置时为 context.Background()
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext 返回使用 ctx 的请求副本，用于中间件向后续处理传递数据
+func (r *Request) WithContext(ctx context.Context) *Request {
+	req := *r
+	req.ctx = ctx
+	return &req
+}
+
+// RequestHandler 可选接口，Handler 实现时代替 OnAuthority 接收完整的请求上下文
+type RequestHandler interface {
+	OnRequest(req *Request) (*Allow, error)
+}
+
+// RenewalHandler 可选接口，未实现 RequestHandler 的 Handler 实现时，续期的认证代替 OnAuthority 回调 OnRenewal
+// 用于对续期采用与首次认证不同的策略，如拒绝续期或缩短放行时间
+type RenewalHandler interface {
+	OnRenewal(body *libspa.Body) (*Allow, error)
+}
+
+// AuthorityFunc 认证函数，返回的错误记录于审计事件及监控指标
+type AuthorityFunc func(req *Request) (*Allow, error)
+
+// Middleware 认证中间件，可在调用 next 前后检查请求或修改结果
+type Middleware func(next AuthorityFunc) AuthorityFunc
+
+// Chain 组合中间件，第一个中间件最先执行
+func Chain(h AuthorityFunc, middlewares ...Middleware) AuthorityFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// 将 Handler 转换为认证函数，实现 RequestHandler 时使用 OnRequest，实现 RenewalHandler 时续期使用 OnRenewal
+func handlerAuthority(h Handler) AuthorityFunc {
+	if rh, ok := h.(RequestHandler); ok {
+		return rh.OnRequest
+	}
+	rh, renewal := h.(RenewalHandler)
+	return func(req *Request) (*Allow, error) {
+		if renewal && req.Renewal && req.Err == nil {
+			return rh.OnRenewal(req.Body)
+		}
+		return h.OnAuthority(req.Body, req.Err)
+	}
+}
+
+// 未解析即丢弃的spa报的审计事件
+func dropEvent(conn *Conn, now time.Time, decision string) *AuditEvent {
+	event := &AuditEvent{Time: now, Type: AuditKnock, Protocol: conn.Protocol(), Decision: decision}
+	if ip := conn.RemoteIP(); ip != nil {
+		event.SourceIP = ip.String()
+	}
+	return event
+}
+
+// 认证请求对应的审计事件
+func requestEvent(req *Request) *AuditEvent {
+	event := &AuditEvent{Time: req.Received, Type: AuditKnock, Protocol: req.Listener.Protocol, KeyID: req.KeyId}
+	if req.SourceIP != nil {
+		event.SourceIP = req.SourceIP.String()
+	}
+	if req.Body != nil {
+		event.DeviceID = req.Body.ClientDeviceId
+	}
+	event.Method, _ = encrypt.MethodName(req.Method)
+	return event
+}
@@ -1,19 +1,23 @@
 package spaserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/1uLang/libnet"
-	"github.com/1uLang/libnet/options"
 	"github.com/1uLang/libspa"
 	"github.com/1uLang/libspa/encrypt"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
+	ErrServerClosed      = errors.New("spa server closed")
 	InvalidConfigPort    = errors.New("invalid port")
 	InvalidConfigPortUse = errors.New("set port occupied")
 	InvalidConfigTimeout = errors.New("invalid timeout")
@@ -24,28 +28,112 @@ type Server struct {
 	KEY string
 	//加密iv
 	IV string
+	//密钥来源，为空时使用KEY/IV作为ID为0的密钥
+	KeyProvider encrypt.KeyProvider
+	//密钥集合，为空时从KeyProvider加载
+	Keys *encrypt.KeySet
 	//加密方式
 	Method string
-	//协议
+	//协议，未设置 Listeners 时使用
 	Protocol string
-	//监听端口
+	//监听端口，未设置 Listeners 及 ListenAddr 时使用，为0时随机选择端口，监听后为实际端口
 	Port int
+	//监听地址 host:port，如 "0.0.0.0:62201"、"[::]:62201"、"192.168.1.1:62201"，未设置 Listeners 时使用
+	ListenAddr string
+	//监听列表，所有监听共享handler、密钥集合及防重放缓存，并同时启动和停止
+	Listeners []Listener
 	//测试模式
 	Test bool
 	//spa 放行时间
 	SPATimeout int
-	//读超时时间
+	//tcp 连接读超时时间（秒），为0时使用 DefaultRawTimeout
 	RawTimeout int
+	//udp 监听同时处理的数据报数量，为0时使用 DefaultUDPWorkers
+	UDPWorkers int
+	//spa报时间戳允许的偏差，为0时使用 libspa.DefaultReplayWindow
+	ReplayWindow time.Duration
+	//限速配置，默认不限速
+	RateLimits RateLimits
+	//自动封禁发送无效spa报的来源IP，默认不启用
+	Ban BanPolicy
+	//放行IP选择策略，默认放行报文来源IP
+	SourcePolicy SourcePolicy
+	//可信中继网段，RelayIPPolicy 下来源IP属于其中时放行spa报中的 ClientPublicIP
+	TrustedRelays []string
+	//服务器公网地址，用于校验spa报中的 ServerPublicIP，为空时使用连接的本地地址
+	PublicIPs []string
+	//不校验 ServerPublicIP，用于anycast等多个网关共享地址及密钥的部署
+	SkipServerIPCheck bool
+	//要求spa报携带 ServerPublicIP，默认不携带（为空或未指定地址）的spa报不校验，兼容旧客户端
+	RequireServerIP bool
+	//审计事件输出，与 Test 模式及日志级别无关
+	AuditSinks []AuditSink
+	//监控指标注册表，设置时注册监控指标
+	MetricsRegistry prometheus.Registerer
+	//监控指标http监听地址，如 ":9100"，设置时在 /metrics 提供监控指标，未设置 MetricsRegistry 时使用独立的注册表
+	MetricsAddr string
+	//防火墙，为空时使用 iptables
+	Firewall Firewall
+	//停止服务时撤销本进程设置的所有放行
+	RevokeOnShutdown bool
+	//放行的最长时间，重复认证续期时到期时间不超过首次放行后该时间，为0时不限制
+	MaxGrantLifetime time.Duration
+	//放行记录文件，设置时持久化本进程设置的放行，启动时恢复防火墙中缺失的放行并撤销已到期的放行
+	GrantStore string
+	//管理接口监听地址，如 "unix:/run/spa/admin.sock"、"127.0.0.1:62280"，为空时不启用
+	AdminAddr string
+	//管理接口令牌，请求需携带 "Authorization: Bearer <token>"，监听tcp地址时必须设置
+	AdminToken string
 	//连接处理接口
 	handler Handler
+	//认证中间件
+	middlewares []Middleware
 
-	options *options.Options
-	method  encrypt.MethodInterface
+	method    encrypt.MethodInterface
+	relays    []*net.IPNet
+	publicIPs []net.IP
+	hostIPs   []net.IP
+	replay    *libspa.ReplayCache
+	limits    *rateLimiter
+	bans      *banList
+	audit     *auditor
+	metrics   *metrics
+	gatherer  prometheus.Gatherer
+	usage     *keyUsage
+	stream    *auditStream
+	grants    *grantTable
+	locker    sync.Mutex
+
+	//运行状态
+	listeners  []listener
+	metricsSrv *httpServer
+	adminSrv   *httpServer
+	done       chan struct{}
+	closed     bool
+	//监听由 Protocol/Port 或 ListenAddr 生成
+	single bool
 }
 
 type Allow struct {
 	TcpPorts []int
 	UdpPorts []int
+	//端口范围及其他协议，如 {Protocol: "tcp", From: 8000, To: 8100}、{Protocol: "icmp"}
+	Ranges []PortRange
+	//放行时间，为0时使用 SPATimeout，不足1秒按1秒计
+	Duration time.Duration
+	//目标地址，放行转发到该地址的内部服务的流量，为空时放行本机端口
+	Destination net.IP
+	//放行来源IP所在网段的前缀长度，如24时放行来源IP所在的/24网段，为0时仅放行来源IP
+	SourcePrefix int
+	//认证的用户，记录于审计事件
+	User string
+}
+
+// PortRange 放行的协议及端口范围，协议为 tcp/udp/sctp/icmp/icmpv6，icmp 不使用端口，To 为0时仅放行 From
+type PortRange struct {
+	Protocol string
+	From     int
+	To       int
 }
 
 // New 创建spa服务
@@ -56,84 +144,625 @@ func New() *Server {
 	}
 }
 
-// Run 启动spa服务
+// Run 启动spa服务，阻塞至服务停止
+// 调用 Shutdown 停止时返回 ErrServerClosed，监听失败时返回对应错误
 func (c *Server) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext 启动spa服务，ctx 取消时等待处理中的请求完成后停止
+func (c *Server) RunContext(ctx context.Context) error {
+	if err := c.Listen(); err != nil {
+		return err
+	}
+	c.locker.Lock()
+	if c.closed {
+		c.locker.Unlock()
+		return ErrServerClosed
+	}
+	if c.done != nil {
+		c.locker.Unlock()
+		return errors.New("spa server is already running")
+	}
+	done := make(chan struct{})
+	listeners, metricsSrv, adminSrv := c.listeners, c.metricsSrv, c.adminSrv
+	c.done = done
+	c.locker.Unlock()
+	go metricsSrv.serve()
+	go adminSrv.serve()
+
+	var serveErr error
+	go func() {
+		serveErr = serve(listeners)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		_ = c.Shutdown(context.Background())
+	}
+	<-done
+
+	c.locker.Lock()
+	closed := c.closed
+	c.locker.Unlock()
+	if closed {
+		return ErrServerClosed
+	}
+	//监听失败，服务同样停止
+	_ = metricsSrv.shutdown(context.Background())
+	c.stream.close()
+	_ = adminSrv.shutdown(context.Background())
+	if c.RevokeOnShutdown {
+		c.revoke(context.Background())
+	}
+	return serveErr
+}
+
+// Listen 检测配置并创建所有监听，绑定失败时返回实际的错误
+// 调用后可通过 Addrs 获取实际监听地址，未调用时由 Run/RunContext 调用
+func (c *Server) Listen() error {
+	c.locker.Lock()
+	closed, listening := c.closed, c.listeners != nil
+	c.locker.Unlock()
+	if closed {
+		return ErrServerClosed
+	}
+	if listening {
+		return nil
+	}
+	if err := c.Check(); err != nil {
+		return err
+	}
+	if err := c.restoreGrants(); err != nil {
+		return err
+	}
+	listeners, err := c.listen()
+	if err != nil {
+		return err
+	}
+	var metricsSrv, adminSrv *httpServer
+	if c.MetricsAddr != "" {
+		metricsSrv, err = listenMetrics(c.MetricsAddr, c.gatherer)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+	}
+	if c.AdminAddr != "" {
+		adminSrv, err = listenHTTP("admin", c.AdminAddr, c.adminHandler())
+		if err != nil {
+			closeListeners(listeners)
+			_ = metricsSrv.shutdown(context.Background())
+			return err
+		}
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if c.closed || c.listeners != nil {
+		closeListeners(listeners)
+		_ = metricsSrv.shutdown(context.Background())
+		_ = adminSrv.shutdown(context.Background())
+		if c.closed {
+			return ErrServerClosed
+		}
+		return nil
+	}
+	c.listeners, c.metricsSrv, c.adminSrv = listeners, metricsSrv, adminSrv
+	//封禁仅丢弃发往实际监听的流量
+	actual := make([]Listener, 0, len(listeners))
+	for i, ln := range listeners {
+		actual = append(actual, Listener{Protocol: c.Listeners[i].Protocol, Addr: ln.addr().String()})
+	}
+	c.bans.setListeners(actual)
+	//随机端口时记录实际监听的端口
+	if c.single {
+		addr := listeners[0].addr().String()
+		c.Listeners[0].Addr = addr
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			c.Port, _ = strconv.Atoi(port)
+		}
+	}
+	return nil
+}
+
+// Check 检测配置是否正确，不创建监听
+func (c *Server) Check() error {
 	if err := c.check(); err != nil {
 		return errors.New("config error:" + err.Error())
 	}
+	return nil
+}
+
+// Addrs 实际监听的地址，未监听时返回空
+func (c *Server) Addrs() []net.Addr {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	addrs := make([]net.Addr, 0, len(c.listeners))
+	for _, ln := range c.listeners {
+		addrs = append(addrs, ln.addr())
+	}
+	return addrs
+}
+
+// Shutdown 停止接收spa报，等待处理中的认证回调及防火墙操作完成
+// 设置 RevokeOnShutdown 时撤销本进程设置的所有放行，ctx 到期时返回 ctx.Err()
+func (c *Server) Shutdown(ctx context.Context) error {
+	c.locker.Lock()
+	c.closed = true
+	listeners, metricsSrv, adminSrv, done := c.listeners, c.metricsSrv, c.adminSrv, c.done
+	c.locker.Unlock()
+
+	closeListeners(listeners)
+	if err := metricsSrv.shutdown(ctx); err != nil {
+		return err
+	}
+	c.stream.close()
+	if err := adminSrv.shutdown(ctx); err != nil {
+		return err
+	}
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var err error
+	if c.RevokeOnShutdown {
+		err = c.revoke(ctx)
+	}
+	if cerr := c.grants.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// 打开放行记录文件，按记录恢复未到期的放行并撤销已到期的放行
+// 恢复失败的放行仍保留在记录中，并在后台定期重试
+func (c *Server) restoreGrants() error {
+	if c.GrantStore == "" || c.grants.store != nil {
+		return nil
+	}
+	store, grants, err := openGrantStore(c.GrantStore)
+	if err != nil {
+		return errors.New("grant store error:" + err.Error())
+	}
+	now := time.Now()
+	var restored, expired, failed []Grant
+	for _, grant := range grants {
+		if !grant.Expires.After(now) {
+			expired = append(expired, grant)
+			continue
+		}
+		restored = append(restored, grant)
+		if err := c.openGrant(&grant, now, "restore"); err != nil {
+			failed = append(failed, grant)
+		}
+	}
+	_ = c.revokeGrants(context.Background(), expired)
+	if len(grants) > 0 {
+		log.Info(fmt.Sprintf("grant store %s: %d restored, %d failed, %d expired", c.GrantStore, len(restored)-len(failed), len(failed), len(expired)))
+	}
+	if err := c.grants.restore(store, restored); err != nil {
+		return errors.New("grant store error:" + err.Error())
+	}
+	if len(failed) > 0 {
+		go c.retryGrants(failed)
+	}
+	return nil
+}
+
+// 按剩余时间设置放行并记录审计事件
+func (c *Server) openGrant(grant *Grant, now time.Time, message string) error {
+	rule := grant.rule(now)
+	err := c.firewall().Open(rule)
+	event := ruleEvent(AuditGrant, rule, err)
+	event.DeviceID, event.User, event.Message = grant.DeviceID, grant.User, message
+	c.audit.emit(event)
+	if err != nil {
+		c.metrics.firewallFailure("open")
+		log.Error(fmt.Sprintf("%s %s err:", message, rule), err)
+	}
+	return err
+}
+
+// 重试恢复失败的放行，放行到期、被撤销或服务停止时不再重试
+func (c *Server) retryGrants(grants []Grant) {
+	ticker := time.NewTicker(grantRetryInterval)
+	defer ticker.Stop()
+	for len(grants) > 0 {
+		<-ticker.C
+		c.locker.Lock()
+		closed := c.closed
+		c.locker.Unlock()
+		if closed {
+			return
+		}
+		now := time.Now()
+		pending := grants[:0]
+		for _, grant := range grants {
+			current, ok := c.grants.find(grant.key(), now)
+			if !ok {
+				continue
+			}
+			if err := c.openGrant(&current, now, "restore retry"); err != nil {
+				pending = append(pending, grant)
+			}
+		}
+		grants = pending
+	}
+}
+
+// 撤销本进程设置的所有未到期放行
+func (c *Server) revoke(ctx context.Context) error {
+	return c.revokeGrants(ctx, c.grants.take(time.Now()))
+}
 
-	opts := []options.Option{}
-	if c.method != nil {
-		opts = append(opts, options.WithEncryptMethod(c.method),
-			options.WithPrivateKey([]byte(c.KEY)),
-			options.WithPublicKey([]byte(c.IV)))
-		if c.RawTimeout > 0 {
-			opts = append(opts, options.WithTimeout(time.Duration(c.RawTimeout)))
+// 撤销放行，返回第一个失败的错误
+func (c *Server) revokeGrants(ctx context.Context, grants []Grant) error {
+	var err error
+	now := time.Now()
+	for i := range grants {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rule := grants[i].rule(now)
+		e := c.firewall().Close(rule)
+		event := ruleEvent(AuditRevoke, rule, e)
+		event.DeviceID, event.User = grants[i].DeviceID, grants[i].User
+		c.audit.emit(event)
+		if e != nil {
+			c.metrics.firewallFailure("close")
+			log.Error(fmt.Sprintf("revoke %s err:", rule), e)
+			if err == nil {
+				err = e
+			}
 		}
 	}
-	c.options = options.GetOptions(opts...)
-	//初始化加密通用key,iv
-	switch c.Protocol {
-	case "tcp":
-		return c.listenTCP(opts...)
-	case "udp":
-		return c.listenUDP(opts...)
+	return err
+}
+
+// 获取防火墙，未设置时使用 iptables
+func (c *Server) firewall() Firewall {
+	if c.Firewall == nil {
+		return &IptablesFirewall{}
+	}
+	return c.Firewall
+}
+
+// 创建所有监听，任一监听失败时关闭已创建的监听
+// 报文头部需明文传输以读取密钥ID，加解密由spa报自身完成
+func (c *Server) listen() ([]listener, error) {
+	h := c.newHandler()
+	listeners := make([]listener, 0, len(c.Listeners))
+	for _, l := range c.Listeners {
+		ln, err := l.listen(h, time.Duration(c.RawTimeout)*time.Second, c.UDPWorkers)
+		if err != nil {
+			closeListeners(listeners)
+			if errors.Is(err, syscall.EADDRINUSE) {
+				return nil, fmt.Errorf("listen %s error:%w", l, InvalidConfigPortUse)
+			}
+			return nil, fmt.Errorf("listen %s error:%v", l, err)
+		}
+		c.print("listen " + l.String())
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// 注册监控指标，未设置注册表时使用独立的注册表
+func (c *Server) registerMetrics() (err error) {
+	registry := c.MetricsRegistry
+	if registry == nil {
+		r := prometheus.NewRegistry()
+		registry, c.gatherer = r, r
+	} else if gatherer, ok := registry.(prometheus.Gatherer); ok {
+		c.gatherer = gatherer
+	} else if c.MetricsAddr != "" {
+		return errors.New("MetricsRegistry must implement prometheus.Gatherer to serve MetricsAddr")
+	}
+	c.metrics, err = newMetrics(registry, c.grants, c.limits)
+	if err != nil {
+		return err
+	}
+	if c.bans != nil {
+		c.bans.metrics = c.metrics
 	}
 	return nil
 }
 
+// RateLimitDrops 因限速丢弃的spa报数量
+func (c *Server) RateLimitDrops() RateLimitDrops {
+	return c.limits.stats()
+}
+
+// Bans 当前生效的自动封禁
+func (c *Server) Bans() []Ban {
+	return c.bans.list(time.Now())
+}
+
+// Unban 解除指定IP的封禁
+func (c *Server) Unban(ip string) error {
+	return c.bans.unban(ip)
+}
+
+// ClearBans 解除所有封禁
+func (c *Server) ClearBans() error {
+	return c.bans.clear()
+}
+
+// Grants 本进程设置的未到期放行
+func (c *Server) Grants(filter GrantFilter) []Grant {
+	return c.grants.list(filter, time.Now())
+}
+
+// RevokeGrants 撤销匹配的放行，返回撤销的数量，空的筛选条件撤销所有放行
+func (c *Server) RevokeGrants(filter GrantFilter) (int, error) {
+	grants := c.grants.remove(filter, time.Now())
+	return len(grants), c.revokeGrants(context.Background(), grants)
+}
+
+// FlushGrants 撤销本进程设置的所有放行
+func (c *Server) FlushGrants() (int, error) {
+	return c.RevokeGrants(GrantFilter{})
+}
+
+// ExtendGrant 将未到期的放行延长d，返回延长后的放行
+// 设置 MaxGrantLifetime 时到期时间不超过首次放行后该时间，已达到时返回 ErrGrantMaxLifetime
+func (c *Server) ExtendGrant(ip, protocol string, port int, d time.Duration) (*Grant, error) {
+	if d <= 0 {
+		return nil, InvalidConfigTimeout
+	}
+	now := time.Now()
+	grant, err := c.grants.get(ip, protocol, port, now)
+	if err != nil {
+		return nil, err
+	}
+	grant.Expires = grant.Expires.Add(d)
+	//与续期相同，到期时间不超过首次放行后 MaxGrantLifetime
+	if c.MaxGrantLifetime > 0 && !grant.Created.IsZero() {
+		limit := grant.Created.Add(c.MaxGrantLifetime)
+		if limit.Sub(now) < time.Second {
+			return nil, ErrGrantMaxLifetime
+		}
+		if grant.Expires.After(limit) {
+			grant.Expires = limit
+		}
+	}
+	rule := grant.rule(now)
+	err = c.firewall().Open(rule)
+	event := ruleEvent(AuditGrant, rule, err)
+	event.DeviceID, event.User, event.Message = grant.DeviceID, grant.User, "extend"
+	c.audit.emit(event)
+	if err != nil {
+		c.metrics.firewallFailure("open")
+		return nil, err
+	}
+	c.grants.add(rule, grant.DeviceID, grant.User, now)
+	grant.Expires = now.Add(time.Duration(rule.Timeout) * time.Second)
+	return &grant, nil
+}
+
 // SetHandler 设置连接处理接口
 func (c *Server) SetHandler(h Handler) {
 	c.handler = h
 }
 
-// 检测配置是否正确
-func (c *Server) check() (err error) {
-	c.Protocol = strings.ToLower(c.Protocol)
-	if c.Protocol != "tcp" && c.Protocol != "udp" {
-		return errors.New("please set server protocol tcp or udp")
+// Use 添加认证中间件，先添加的中间件先执行，需在 Listen 前调用
+func (c *Server) Use(middlewares ...Middleware) {
+	c.middlewares = append(c.middlewares, middlewares...)
+}
+
+// AddKey 添加密钥，可在服务运行中调用
+func (c *Server) AddKey(key *encrypt.Key) error {
+	if err := encrypt.CheckMagicKey(key, c.Test); err != nil {
+		log.Error(err)
+		return err
 	}
-	if c.Port < 0 {
-		return InvalidConfigPort
+	keys, err := c.keySet()
+	if err != nil {
+		return err
+	}
+	return keys.Add(key)
+}
+
+// RetireKey 在指定时间停用密钥，可在服务运行中调用
+func (c *Server) RetireKey(id uint32, at time.Time) error {
+	keys, err := c.keySet()
+	if err != nil {
+		return err
 	}
-	if c.Port == 0 {
-		//未设置端口随机设置一个未暂用的端口
-		c.Port, err = libspa.GetPort()
+	return keys.Retire(id, at)
+}
+
+// 获取密钥集合，未设置时从密钥来源加载
+func (c *Server) keySet() (*encrypt.KeySet, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if c.Keys == nil {
+		provider := c.KeyProvider
+		if provider == nil {
+			provider = encrypt.NewKeyProvider(c.KEY, c.IV, c.Test)
+		}
+		keys, err := encrypt.LoadKeySet(provider, c.Test)
 		if err != nil {
-			return errors.New("random set listen port error:" + err.Error())
+			if err == encrypt.ErrMagicKeyInUse {
+				log.Error("refusing to start: ", err)
+			}
+			return nil, errors.New("load keys error:" + err.Error())
 		}
+		c.Keys = keys
 	}
-	ln, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", c.Port))
-	if err != nil {
-		return InvalidConfigPortUse
+	return c.Keys, nil
+}
+
+// 检测配置是否正确
+func (c *Server) check() (err error) {
+	if len(c.Listeners) == 0 {
+		if err := c.checkPort(); err != nil {
+			return err
+		}
+		addr := c.ListenAddr
+		if addr == "" {
+			addr = fmt.Sprintf(":%d", c.Port)
+		}
+		c.Listeners = []Listener{{Protocol: c.Protocol, Addr: addr}}
+		c.single = true
+	}
+	for i := range c.Listeners {
+		if err := c.Listeners[i].check(); err != nil {
+			return err
+		}
 	}
-	ln.Close()
 	if c.SPATimeout <= 0 {
 		return InvalidConfigTimeout
 	}
+	keys, err := c.keySet()
+	if err != nil {
+		return err
+	}
 	if c.Method != "" {
-		c.method, err = encrypt.NewMethodInstance(c.Method, c.KEY, c.IV)
+		key, err := keys.Newest(time.Now())
+		if err != nil {
+			return err
+		}
+		c.method, err = encrypt.NewMethodInstance(c.Method, string(key.Key), string(key.IV))
 		if err != nil {
 			return err
 		}
 	}
+	if c.SourcePolicy < SourceIPPolicy || c.SourcePolicy > RelayIPPolicy {
+		return errors.New("invalid source policy")
+	}
+	c.relays, err = parseCIDRs(c.TrustedRelays)
+	if err != nil {
+		return errors.New("trusted relays error:" + err.Error())
+	}
+	c.publicIPs, err = parseIPs(c.PublicIPs)
+	if err != nil {
+		return errors.New("public ips error:" + err.Error())
+	}
+	if !c.SkipServerIPCheck && len(c.publicIPs) == 0 {
+		c.hostIPs, err = interfaceIPs()
+		if err != nil {
+			return errors.New("get interface addrs error:" + err.Error())
+		}
+	}
+	if c.replay == nil {
+		c.replay = libspa.NewReplayCache(c.ReplayWindow)
+	}
+	if c.limits == nil {
+		c.limits = newRateLimiter(c.RateLimits)
+	}
+	if err := c.checkAdmin(); err != nil {
+		return err
+	}
+	if c.audit == nil {
+		sinks := c.AuditSinks
+		if c.AdminAddr != "" {
+			//管理接口可订阅实时审计事件
+			c.stream = newAuditStream()
+			sinks = append(append([]AuditSink{}, sinks...), c.stream)
+		}
+		c.audit = newAuditor(sinks)
+	}
+	if c.usage == nil {
+		c.usage = newKeyUsage()
+	}
+	if c.bans == nil {
+		c.bans, err = newBanList(c.Ban, c.firewall(), c.audit)
+		if err != nil {
+			return errors.New("ban allowlist error:" + err.Error())
+		}
+	}
+	if c.grants == nil {
+		c.grants = newGrantTable()
+	}
+	if c.metrics == nil && (c.MetricsRegistry != nil || c.MetricsAddr != "" || c.AdminAddr != "") {
+		if err := c.registerMetrics(); err != nil {
+			return errors.New("metrics error:" + err.Error())
+		}
+	}
 	if c.Test {
 		log.SetLevel(log.DebugLevel)
 	}
 	return nil
 }
 
+// 检测 Protocol/Port 配置是否正确
+// 端口是否可用由实际监听检测，Port 为0时由系统分配端口
+func (c *Server) checkPort() (err error) {
+	c.Protocol = strings.ToLower(c.Protocol)
+	if c.Protocol != "tcp" && c.Protocol != "udp" {
+		return errors.New("please set server protocol tcp or udp")
+	}
+	if c.ListenAddr != "" {
+		return nil
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return InvalidConfigPort
+	}
+	return nil
+}
+
 // 打印调试信息
 func (c *Server) print(a ...interface{}) {
 	log.Debug(a...)
 }
 
-// 开启tcp服务监听端口
-func (c *Server) listenTCP(opts ...options.Option) error {
-	return libnet.NewServe(fmt.Sprintf(":%d", c.Port), &handler{timeout: c.SPATimeout, handler: c.handler, options: c.options}, opts...).RunTCP()
+// 创建通信处理handler，所有监听共享
+func (c *Server) newHandler() *handler {
+	var chain AuthorityFunc
+	if c.handler != nil {
+		chain = Chain(handlerAuthority(c.handler), c.middlewares...)
+	}
+	return &handler{
+		timeout:      c.SPATimeout,
+		handler:      c.handler,
+		keys:         c.Keys,
+		method:       c.method,
+		replay:       c.replay,
+		firewall:     c.firewall(),
+		grants:       c.grants,
+		limits:       c.limits,
+		bans:         c.bans,
+		audit:        c.audit,
+		metrics:      c.metrics,
+		usage:        c.usage,
+		chain:        chain,
+		maxLifetime:  c.MaxGrantLifetime,
+		policy:       c.SourcePolicy,
+		relays:       c.relays,
+		publicIPs:    c.publicIPs,
+		hostIPs:      c.hostIPs,
+		skipServerIP: c.SkipServerIPCheck,
+		requireIP:    c.RequireServerIP,
+	}
 }
 
-// 开启udp服务监听端口
-func (c *Server) listenUDP(opts ...options.Option) error {
-	return libnet.NewServe(fmt.Sprintf(":%d", c.Port), &handler{timeout: c.SPATimeout, handler: c.handler, options: c.options}, opts...).RunUDP()
+// 同时运行所有监听，任一监听退出时关闭其余监听
+func serve(listeners []listener) error {
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln listener) {
+			errs <- ln.serve()
+		}(ln)
+	}
+	err := <-errs
+	closeListeners(listeners)
+	for i := 1; i < len(listeners); i++ {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 关闭所有监听
+func closeListeners(listeners []listener) {
+	for _, ln := range listeners {
+		_ = ln.close()
+	}
 }
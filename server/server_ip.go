@@ -0,0 +1,78 @@
+package spaserver
+
+import (
+	"errors"
+	"github.com/1uLang/libspa"
+	"net"
+)
+
+var ErrServerAddressMismatch = errors.New("packet server public ip is not an address of this server")
+
+// 解析服务器公网地址
+func parseIPs(ips []string) ([]net.IP, error) {
+	list := make([]net.IP, 0, len(ips))
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid ip " + s)
+		}
+		list = append(list, ip)
+	}
+	return list, nil
+}
+
+// 本机所有网卡地址，用于监听地址为 0.0.0.0/[::] 的udp服务
+func interfaceIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, n.IP)
+		}
+	}
+	return ips, nil
+}
+
+func hasIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验spa报中的 ServerPublicIP 为本服务器地址，防止在共享密钥的其他网关重放
+// 未配置公网地址时使用连接的本地地址，本地地址未指定时使用本机所有网卡地址
+// 未携带 ServerPublicIP 的spa报仅在 requireIP 时拒绝
+func (c *handler) checkServerIP(conn *Conn, body *libspa.Body) error {
+	if c.skipServerIP {
+		return nil
+	}
+	ip := body.ServerPublicIP
+	if ip == nil || ip.IsUnspecified() {
+		if c.requireIP {
+			return ErrServerAddressMismatch
+		}
+		return nil
+	}
+	if len(c.publicIPs) > 0 {
+		if hasIP(c.publicIPs, ip) {
+			return nil
+		}
+		return ErrServerAddressMismatch
+	}
+	if local := conn.LocalIP(); local != nil && !local.IsUnspecified() {
+		if local.Equal(ip) {
+			return nil
+		}
+		return ErrServerAddressMismatch
+	}
+	if hasIP(c.hostIPs, ip) {
+		return nil
+	}
+	return ErrServerAddressMismatch
+}
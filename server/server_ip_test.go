@@ -0,0 +1,67 @@
+package spaserver
+
+import (
+	"github.com/1uLang/libspa"
+	"net"
+	"testing"
+)
+
+func TestHandler_CheckServerIP(t *testing.T) {
+	local := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 62201}
+	any := &net.UDPAddr{IP: net.IPv4zero, Port: 62201}
+	remote := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40000}
+	publicIPs, err := parseIPs([]string{"203.0.113.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		handler *handler
+		local   net.Addr
+		ip      string
+		ok      bool
+	}{
+		{&handler{}, local, "192.0.2.1", true},
+		{&handler{}, local, "192.0.2.2", false},
+		{&handler{}, local, "0.0.0.0", true},
+		{&handler{}, local, "", true},
+		{&handler{requireIP: true}, local, "0.0.0.0", false},
+		{&handler{requireIP: true}, local, "", false},
+		{&handler{requireIP: true}, local, "192.0.2.1", true},
+		{&handler{hostIPs: []net.IP{net.ParseIP("192.0.2.9")}}, any, "192.0.2.9", true},
+		{&handler{hostIPs: []net.IP{net.ParseIP("192.0.2.9")}}, any, "192.0.2.1", false},
+		{&handler{publicIPs: publicIPs}, local, "203.0.113.1", true},
+		{&handler{publicIPs: publicIPs}, local, "2001:db8::1", true},
+		{&handler{publicIPs: publicIPs}, local, "192.0.2.1", false},
+		{&handler{skipServerIP: true}, local, "192.0.2.2", true},
+	}
+	for i, tc := range cases {
+		conn := &Conn{protocol: "udp", localAddr: tc.local, remoteAddr: remote}
+		err := tc.handler.checkServerIP(conn, &libspa.Body{ServerPublicIP: net.ParseIP(tc.ip)})
+		if tc.ok && err != nil || !tc.ok && err != ErrServerAddressMismatch {
+			t.Errorf("%d %s: unexpected result %v", i, tc.ip, err)
+		}
+	}
+	if _, err := parseIPs([]string{"203.0.113"}); err == nil {
+		t.Fatal("expect invalid ip error")
+	}
+}
+
+func TestHandler_ServerMismatchReply(t *testing.T) {
+	srv, h := newTestServer(t)
+	srv.PublicIPs = []string{"203.0.113.1"}
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{
+		protocol:   "tcp",
+		localAddr:  &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	reply := srv.newHandler().authority(conn, newTestPacket(t, firstDevice))
+	if reply.Code != libspa.ReplyServerMismatch || reply.Message != "" {
+		t.Fatal("unexpected reply", reply)
+	}
+	if _, err := h.wait(t); err != ErrServerAddressMismatch {
+		t.Fatal("expect ErrServerAddressMismatch, got", err)
+	}
+}
@@ -0,0 +1,567 @@
+package spaserver
+
+import (
+	"context"
+	"errors"
+	"github.com/1uLang/libspa"
+	"github.com/1uLang/libspa/encrypt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录认证结果，认证成功时返回 allow
+type recordHandler struct {
+	locker sync.Mutex
+	bodies []*libspa.Body
+	errs   []error
+	called chan struct{}
+	allow  *Allow
+	//不为空时认证回调阻塞至关闭
+	release chan struct{}
+}
+
+func newRecordHandler() *recordHandler {
+	return &recordHandler{called: make(chan struct{}, 16)}
+}
+
+func (h *recordHandler) OnConnect(conn *Conn) {}
+
+func (h *recordHandler) OnAuthority(body *libspa.Body, err error) (*Allow, error) {
+	h.locker.Lock()
+	h.bodies = append(h.bodies, body)
+	h.errs = append(h.errs, err)
+	h.locker.Unlock()
+	h.called <- struct{}{}
+	if h.release != nil {
+		<-h.release
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h.allow, nil
+}
+
+func (h *recordHandler) OnClose(conn *Conn, err error) {}
+
+func (h *recordHandler) wait(t *testing.T) (*libspa.Body, error) {
+	select {
+	case <-h.called:
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnAuthority was not called")
+	}
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	return h.bodies[len(h.bodies)-1], h.errs[len(h.errs)-1]
+}
+
+// 设备ID解析后为UUID格式
+const (
+	firstDevice    = "00000000-0000-0000-0000-000000000001"
+	replayedDevice = "00000000-0000-0000-0000-000000000002"
+)
+
+var testKey = &encrypt.Key{ID: 1, Key: []byte("server-test-key"), IV: []byte("server-test-iv")}
+
+func newTestServer(t *testing.T, listeners ...Listener) (*Server, *recordHandler) {
+	keys, err := encrypt.NewKeySet(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New()
+	srv.Keys = keys
+	srv.Listeners = listeners
+	h := newRecordHandler()
+	srv.SetHandler(h)
+	if err := srv.check(); err != nil {
+		t.Fatal(err)
+	}
+	return srv, h
+}
+
+func newTestPacket(t *testing.T, deviceId string) []byte {
+	return newTestPacketFrom(t, deviceId, net.ParseIP("127.0.0.1"))
+}
+
+func newTestPacketFrom(t *testing.T, deviceId string, clientIP net.IP) []byte {
+	method, err := encrypt.NewMethodInstance("aes-256-cfb", string(testKey.Key), string(testKey.IV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := libspa.NewKeyedPacket(&libspa.Body{
+		ClientDeviceId: deviceId,
+		ClientPublicIP: clientIP,
+		ServerPublicIP: net.ParseIP("127.0.0.1"),
+	}, testKey.ID, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestServer_MultiListener(t *testing.T) {
+	srv, h := newTestServer(t,
+		Listener{Protocol: "udp", Addr: "127.0.0.1:0"},
+		Listener{Protocol: "TCP", Addr: "127.0.0.1:0"},
+		Listener{Protocol: "udp", Addr: "127.0.0.1:0"},
+	)
+	listeners, err := srv.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(listeners)
+	}()
+
+	//每个监听均可认证，且共享防重放缓存
+	replayed := newTestPacket(t, replayedDevice)
+	for i, ln := range listeners {
+		conn, err := net.Dial(ln.addr().Network(), ln.addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := replayed
+		if i == 0 {
+			data = newTestPacket(t, firstDevice)
+		}
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		body, err := h.wait(t)
+		switch i {
+		case 0:
+			if err != nil || body.ClientDeviceId != firstDevice {
+				t.Fatal("unexpected authority result", body, err)
+			}
+		case 1:
+			if err != nil || body.ClientDeviceId != replayedDevice {
+				t.Fatal("unexpected authority result", body, err)
+			}
+		case 2:
+			if err != libspa.ReplayedPacket {
+				t.Fatal("expect ReplayedPacket, got", err)
+			}
+		}
+		conn.Close()
+	}
+
+	//所有监听同时停止
+	closeListeners(listeners[:1])
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("listeners did not stop together")
+	}
+	for _, ln := range listeners[1:] {
+		if conn, err := net.Dial("tcp", ln.addr().String()); err == nil && ln.addr().Network() == "tcp" {
+			conn.Close()
+			t.Fatal("tcp listener is still accepting")
+		}
+	}
+}
+
+func TestServer_ListenerCheck(t *testing.T) {
+	srv := New()
+	srv.Listeners = []Listener{{Protocol: "sctp", Addr: ":62201"}}
+	if err := srv.check(); err == nil {
+		t.Fatal("expect invalid protocol error")
+	}
+	srv.Listeners = []Listener{{Protocol: "udp", Addr: "62201"}}
+	if err := srv.check(); err == nil {
+		t.Fatal("expect invalid addr error")
+	}
+}
+
+// 记录放行及撤销的防火墙
+type recordFirewall struct {
+	locker sync.Mutex
+	opened []Rule
+	closed []Rule
+}
+
+func (f *recordFirewall) Open(rule *Rule) error {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.opened = append(f.opened, *rule)
+	return nil
+}
+
+func (f *recordFirewall) Close(rule *Rule) error {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.closed = append(f.closed, *rule)
+	return nil
+}
+
+// 创建监听后启动服务
+func runTestServer(t *testing.T, srv *Server, ctx context.Context) (<-chan error, []listener) {
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.RunContext(ctx)
+	}()
+	return errs, srv.listeners
+}
+
+func sendTestPacket(t *testing.T, ln listener, deviceId string) {
+	conn, err := net.Dial(ln.addr().Network(), ln.addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(newTestPacket(t, deviceId)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	srv, h := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	firewall := &recordFirewall{}
+	srv.Firewall = firewall
+	srv.RevokeOnShutdown = true
+	h.allow = &Allow{TcpPorts: []int{22}, UdpPorts: []int{0, 53}}
+	h.release = make(chan struct{})
+
+	errs, listeners := runTestServer(t, srv, context.Background())
+	sendTestPacket(t, listeners[0], firstDevice)
+	if _, err := h.wait(t); err != nil {
+		t.Fatal(err)
+	}
+
+	//认证回调未完成时等待
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expect DeadlineExceeded, got", err)
+	}
+	close(h.release)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != ErrServerClosed {
+		t.Fatal("expect ErrServerClosed, got", err)
+	}
+
+	want := []Rule{
+		{IP: "127.0.0.1", Protocol: "tcp", Port: 22, Timeout: srv.SPATimeout},
+		{IP: "127.0.0.1", Protocol: "udp", Port: 53, Timeout: srv.SPATimeout},
+	}
+	if len(firewall.opened) != len(want) || firewall.opened[0] != want[0] || firewall.opened[1] != want[1] {
+		t.Fatal("unexpected opened rules", firewall.opened)
+	}
+	if len(firewall.closed) != len(want) {
+		t.Fatal("unexpected revoked rules", firewall.closed)
+	}
+	if err := srv.Run(); err != ErrServerClosed {
+		t.Fatal("expect ErrServerClosed after shutdown, got", err)
+	}
+}
+
+// 认证回调阻塞时 udp 监听继续处理其他数据报
+func TestServer_UDPWorkers(t *testing.T) {
+	srv, h := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	srv.Firewall = &recordFirewall{}
+	srv.UDPWorkers = 2
+	h.release = make(chan struct{})
+
+	errs, listeners := runTestServer(t, srv, context.Background())
+	sendTestPacket(t, listeners[0], firstDevice)
+	sendTestPacket(t, listeners[0], replayedDevice)
+	h.wait(t)
+	h.wait(t)
+	close(h.release)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-errs
+}
+
+// RawTimeout 为0时tcp连接使用默认读超时
+func TestListener_DefaultRawTimeout(t *testing.T) {
+	ln, err := Listener{Protocol: "tcp", Addr: "127.0.0.1:0"}.listen(&handler{}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.close()
+	if l := ln.(*tcpListener); l.readTimeout != DefaultRawTimeout {
+		t.Fatal("unexpected read timeout", l.readTimeout)
+	}
+}
+
+// 仅实现认证回调的旧 Handler 通过 HandlerFunc 使用
+func TestHandlerFunc(t *testing.T) {
+	srv, _ := newTestServer(t)
+	srv.Firewall = &recordFirewall{}
+	var devices []string
+	srv.SetHandler(HandlerFunc(func(body *libspa.Body, err error) (*Allow, error) {
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, body.ClientDeviceId)
+		return &Allow{TcpPorts: []int{22}}, nil
+	}))
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	if reply := handler.authority(conn, newTestPacket(t, firstDevice)); reply.Code != libspa.ReplyAllowed {
+		t.Fatal("unexpected reply", reply.Code)
+	}
+	if len(devices) != 1 || devices[0] != firstDevice {
+		t.Fatal("unexpected devices", devices)
+	}
+}
+
+func TestServer_RunContextCancel(t *testing.T) {
+	srv, _ := newTestServer(t, Listener{Protocol: "tcp", Addr: "127.0.0.1:0"})
+	srv.Firewall = &recordFirewall{}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs, listeners := runTestServer(t, srv, ctx)
+	conn, err := net.Dial("tcp", listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != ErrServerClosed {
+			t.Fatal("expect ErrServerClosed, got", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	//已建立的连接同样被关闭
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect connection to be closed")
+	}
+}
+
+func TestServer_ListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv, _ := newTestServer(t,
+		Listener{Protocol: "udp", Addr: "127.0.0.1:0"},
+		Listener{Protocol: "tcp", Addr: ln.Addr().String()},
+	)
+	if err := srv.Run(); err == nil || err == ErrServerClosed {
+		t.Fatal("expect listen error, got", err)
+	}
+}
+
+func TestServer_ListenAddr(t *testing.T) {
+	//udp 服务不受同端口tcp占用影响
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv, _ := newTestServer(t)
+	srv.ListenAddr = ln.Addr().String()
+	srv.Listeners = nil
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := srv.Addrs(); len(addrs) != 1 || addrs[0].String() != ln.Addr().String() || addrs[0].Network() != "udp" {
+		t.Fatal("unexpected listen addrs", addrs)
+	}
+	_ = srv.Shutdown(context.Background())
+
+	//tcp 服务端口被占用时返回实际绑定的错误
+	srv, _ = newTestServer(t)
+	srv.Protocol = "tcp"
+	srv.ListenAddr = ln.Addr().String()
+	srv.Listeners = nil
+	if err := srv.Listen(); !errors.Is(err, InvalidConfigPortUse) {
+		t.Fatal("expect InvalidConfigPortUse, got", err)
+	}
+
+	//随机端口返回实际监听的端口
+	srv, _ = newTestServer(t)
+	srv.Listeners = nil
+	srv.ListenAddr = "127.0.0.1:0"
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	addr := srv.Addrs()[0].(*net.UDPAddr)
+	if addr.Port == 0 || srv.Port != addr.Port {
+		t.Fatalf("expect port %d, got %d", addr.Port, srv.Port)
+	}
+	sendTestPacket(t, srv.listeners[0], firstDevice)
+}
+
+func TestServer_ListenIPv6(t *testing.T) {
+	srv, _ := newTestServer(t)
+	srv.Listeners = nil
+	srv.Protocol = "tcp"
+	srv.ListenAddr = "[::1]:0"
+	if err := srv.Listen(); err != nil {
+		t.Skip("ipv6 is not available:", err)
+	}
+	defer srv.Shutdown(context.Background())
+	if addr := srv.Addrs()[0].(*net.TCPAddr); addr.IP.To4() != nil || addr.Port == 0 {
+		t.Fatal("unexpected listen addr", addr)
+	}
+}
+
+func TestHandler_DoAllow(t *testing.T) {
+	srv, _ := newTestServer(t)
+	firewall := &recordFirewall{}
+	srv.Firewall = firewall
+	handler := srv.newHandler()
+	allow := &Allow{
+		TcpPorts: []int{22},
+		Ranges: []PortRange{
+			{Protocol: "tcp", From: 8000, To: 8100},
+			{Protocol: "sctp", From: 9000},
+			{Protocol: "icmp"},
+			{Protocol: "icmp", From: 8},
+			{Protocol: "gre"},
+			{Protocol: "udp", From: 2000, To: 1000},
+		},
+		Duration:     90500 * time.Millisecond,
+		Destination:  net.ParseIP("10.0.0.5"),
+		SourcePrefix: 24,
+	}
+	ports, timeout := handler.doAllow("203.0.113.7", firstDevice, allow)
+	if timeout != 91 {
+		t.Fatal("unexpected timeout", timeout)
+	}
+	expected := []string{"tcp/22", "tcp/8000-8100", "sctp/9000", "icmp"}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Fatal("unexpected ports", ports)
+	}
+	for _, rule := range firewall.opened {
+		if rule.IP != "203.0.113.0/24" || rule.Destination != "10.0.0.5" || rule.Timeout != 91 {
+			t.Fatal("unexpected rule", rule)
+		}
+	}
+	grants := srv.Grants(GrantFilter{Protocol: "tcp", Port: 8000})
+	if len(grants) != 1 || grants[0].PortEnd != 8100 || grants[0].Destination != "10.0.0.5" {
+		t.Fatal("unexpected grants", grants)
+	}
+
+	//未设置放行时间时使用 SPATimeout
+	if _, timeout := handler.doAllow("203.0.113.7", firstDevice, &Allow{UdpPorts: []int{53}}); timeout != srv.SPATimeout {
+		t.Fatal("unexpected default timeout", timeout)
+	}
+}
+
+func TestAllowSource(t *testing.T) {
+	for _, c := range []struct {
+		ip     string
+		prefix int
+		source string
+	}{
+		{"203.0.113.7", 0, "203.0.113.7"},
+		{"203.0.113.7", 24, "203.0.113.0/24"},
+		{"203.0.113.7", 32, "203.0.113.7"},
+		{"2001:db8::1", 64, "2001:db8::/64"},
+		{"2001:db8::1", 128, "2001:db8::1"},
+	} {
+		if source := allowSource(c.ip, c.prefix); source != c.source {
+			t.Fatal("unexpected source", c.ip, c.prefix, source)
+		}
+	}
+}
+
+func TestHandler_Renewal(t *testing.T) {
+	srv, h := newTestServer(t)
+	firewall := &recordFirewall{}
+	srv.Firewall = firewall
+	srv.MaxGrantLifetime = 45 * time.Second
+	h.allow = &Allow{TcpPorts: []int{22}}
+	var renewals []bool
+	srv.Use(func(next AuthorityFunc) AuthorityFunc {
+		return func(req *Request) (*Allow, error) {
+			renewals = append(renewals, req.Renewal)
+			return next(req)
+		}
+	})
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	for i := 0; i < 2; i++ {
+		if reply := handler.authority(conn, newTestPacket(t, firstDevice)); reply.Code != libspa.ReplyAllowed {
+			t.Fatal("unexpected reply", reply.Code)
+		}
+	}
+	if !reflect.DeepEqual(renewals, []bool{false, true}) {
+		t.Fatal("unexpected renewals", renewals)
+	}
+	grants := srv.Grants(GrantFilter{})
+	if len(grants) != 1 || grants[0].Renewals != 1 || grants[0].Created.After(time.Now()) {
+		t.Fatal("unexpected grants", grants)
+	}
+	if len(firewall.opened) != 2 || firewall.opened[0].Timeout != 30 || firewall.opened[1].Timeout > 45 {
+		t.Fatal("unexpected rules", firewall.opened)
+	}
+
+	//达到最长时间后不再续期
+	handler.maxLifetime = time.Second / 2
+	handler.authority(conn, newTestPacket(t, firstDevice))
+	if len(firewall.opened) != 2 {
+		t.Fatal("grant must not be renewed beyond max lifetime", firewall.opened)
+	}
+	//其他设备为新的放行
+	handler.authority(conn, newTestPacket(t, replayedDevice))
+	if renewals[len(renewals)-1] {
+		t.Fatal("knock from another device is not a renewal")
+	}
+}
+
+// 续期时回调 OnRenewal 代替 OnAuthority
+type renewalHandler struct {
+	*recordHandler
+	renewals int
+}
+
+func (h *renewalHandler) OnRenewal(body *libspa.Body) (*Allow, error) {
+	h.renewals++
+	return &Allow{TcpPorts: []int{22}, Duration: 10 * time.Second}, nil
+}
+
+func TestHandler_RenewalHandler(t *testing.T) {
+	srv, _ := newTestServer(t)
+	firewall := &recordFirewall{}
+	srv.Firewall = firewall
+	h := &renewalHandler{recordHandler: newRecordHandler()}
+	h.allow = &Allow{TcpPorts: []int{22}}
+	srv.SetHandler(h)
+	handler := srv.newHandler()
+	conn := &Conn{
+		protocol:   "udp",
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62201},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	for i := 0; i < 2; i++ {
+		if reply := handler.authority(conn, newTestPacket(t, firstDevice)); reply.Code != libspa.ReplyAllowed {
+			t.Fatal("unexpected reply", reply.Code)
+		}
+	}
+	if len(h.bodies) != 1 || h.renewals != 1 {
+		t.Fatal("unexpected callbacks", len(h.bodies), h.renewals)
+	}
+	if len(firewall.opened) != 2 || firewall.opened[0].Timeout != 30 || firewall.opened[1].Timeout != 10 {
+		t.Fatal("unexpected rules", firewall.opened)
+	}
+}
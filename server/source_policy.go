@@ -0,0 +1,127 @@
+package spaserver
+
+import (
+	"errors"
+	"github.com/1uLang/libspa"
+	"net"
+	"strings"
+)
+
+// SourcePolicy 放行IP选择策略
+type SourcePolicy int
+
+const (
+	// SourceIPPolicy 放行报文的来源IP，默认策略
+	SourceIPPolicy SourcePolicy = iota
+	// PacketIPPolicy 放行spa报中的 ClientPublicIP，用于NAT后的客户端或代替其他主机认证
+	PacketIPPolicy
+	// MatchIPPolicy 要求 ClientPublicIP 与来源IP一致
+	MatchIPPolicy
+	// RelayIPPolicy 来源IP属于 TrustedRelays 时放行 ClientPublicIP，否则放行来源IP
+	RelayIPPolicy
+)
+
+var (
+	ErrAddressMismatch = errors.New("packet client public ip does not match source ip")
+	ErrUnknownSource   = errors.New("unknown source ip")
+)
+
+// AddressMismatchHandler 可选接口，Handler 实现时在 ClientPublicIP 与来源IP不一致时回调
+// grantIP 为按策略选择的放行IP，MatchIPPolicy 下为空，且 OnAuthority 收到 ErrAddressMismatch
+type AddressMismatchHandler interface {
+	OnAddressMismatch(body *libspa.Body, sourceIP, grantIP net.IP)
+}
+
+func (p SourcePolicy) String() string {
+	switch p {
+	case SourceIPPolicy:
+		return "source"
+	case PacketIPPolicy:
+		return "packet"
+	case MatchIPPolicy:
+		return "match"
+	case RelayIPPolicy:
+		return "relay"
+	}
+	return "unknown"
+}
+
+// ParseSourcePolicy 解析放行IP选择策略 source/packet/match/relay
+func ParseSourcePolicy(s string) (SourcePolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "source":
+		return SourceIPPolicy, nil
+	case "packet":
+		return PacketIPPolicy, nil
+	case "match":
+		return MatchIPPolicy, nil
+	case "relay":
+		return RelayIPPolicy, nil
+	}
+	return 0, errors.New("invalid source policy " + s)
+}
+
+// 解析可信中继网段，支持单个IP
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("invalid cidr " + cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按策略选择放行IP，返回是否与来源IP不一致
+// spa报未携带 ClientPublicIP 时视为未声明，除 MatchIPPolicy 外使用来源IP
+func (p SourcePolicy) grantIP(body *libspa.Body, source net.IP, relays []*net.IPNet) (ip net.IP, mismatch bool, err error) {
+	if source == nil {
+		return nil, false, ErrUnknownSource
+	}
+	packet := body.ClientPublicIP
+	if packet == nil || packet.IsUnspecified() {
+		if p == MatchIPPolicy {
+			return nil, true, ErrAddressMismatch
+		}
+		return source, false, nil
+	}
+	mismatch = !packet.Equal(source)
+	switch p {
+	case PacketIPPolicy:
+		return packet, mismatch, nil
+	case MatchIPPolicy:
+		if mismatch {
+			return nil, true, ErrAddressMismatch
+		}
+		return source, false, nil
+	case RelayIPPolicy:
+		if containsIP(relays, source) {
+			return packet, mismatch, nil
+		}
+		return source, mismatch, nil
+	}
+	return source, mismatch, nil
+}
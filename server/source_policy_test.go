@@ -0,0 +1,97 @@
+package spaserver
+
+import (
+	"context"
+	"github.com/1uLang/libspa"
+	"net"
+	"testing"
+)
+
+func TestSourcePolicy_GrantIP(t *testing.T) {
+	relays, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := net.ParseIP("10.1.1.1")
+	untrusted := net.ParseIP("172.16.0.1")
+	packet := net.ParseIP("203.0.113.7")
+	cases := []struct {
+		policy   SourcePolicy
+		source   net.IP
+		packet   net.IP
+		ip       net.IP
+		mismatch bool
+		err      error
+	}{
+		{SourceIPPolicy, source, packet, source, true, nil},
+		{SourceIPPolicy, source, nil, source, false, nil},
+		{PacketIPPolicy, source, packet, packet, true, nil},
+		{PacketIPPolicy, source, net.IPv4zero, source, false, nil},
+		{MatchIPPolicy, source, packet, nil, true, ErrAddressMismatch},
+		{MatchIPPolicy, source, nil, nil, true, ErrAddressMismatch},
+		{MatchIPPolicy, source, net.ParseIP("::ffff:10.1.1.1"), source, false, nil},
+		{RelayIPPolicy, source, packet, packet, true, nil},
+		{RelayIPPolicy, untrusted, packet, untrusted, true, nil},
+		{RelayIPPolicy, net.ParseIP("192.168.1.1"), packet, packet, true, nil},
+		{RelayIPPolicy, net.ParseIP("192.168.1.2"), packet, net.ParseIP("192.168.1.2"), true, nil},
+		{SourceIPPolicy, nil, packet, nil, false, ErrUnknownSource},
+	}
+	for i, tc := range cases {
+		ip, mismatch, err := tc.policy.grantIP(&libspa.Body{ClientPublicIP: tc.packet}, tc.source, relays)
+		if !ip.Equal(tc.ip) || mismatch != tc.mismatch || err != tc.err {
+			t.Errorf("%d %s: got %v %v %v, want %v %v %v", i, tc.policy, ip, mismatch, err, tc.ip, tc.mismatch, tc.err)
+		}
+	}
+	if _, err := parseCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("expect invalid cidr error")
+	}
+	for _, s := range []string{"source", "packet", "match", "relay"} {
+		p, err := ParseSourcePolicy(s)
+		if err != nil || p.String() != s {
+			t.Fatal("unexpected policy", s, p, err)
+		}
+	}
+}
+
+// 记录地址不一致回调
+type mismatchHandler struct {
+	*recordHandler
+	mismatches chan [2]net.IP
+}
+
+func (h *mismatchHandler) OnAddressMismatch(body *libspa.Body, sourceIP, grantIP net.IP) {
+	h.mismatches <- [2]net.IP{sourceIP, grantIP}
+}
+
+func TestServer_AddressMismatch(t *testing.T) {
+	srv, record := newTestServer(t, Listener{Protocol: "udp", Addr: "127.0.0.1:0"})
+	h := &mismatchHandler{recordHandler: record, mismatches: make(chan [2]net.IP, 1)}
+	h.allow = &Allow{TcpPorts: []int{22}}
+	firewall := &recordFirewall{}
+	srv.SetHandler(h)
+	srv.Firewall = firewall
+	srv.SourcePolicy = MatchIPPolicy
+	errs, listeners := runTestServer(t, srv, context.Background())
+
+	conn, err := net.Dial("udp", listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(newTestPacketFrom(t, firstDevice, net.ParseIP("203.0.113.7"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.wait(t); err != ErrAddressMismatch {
+		t.Fatal("expect ErrAddressMismatch, got", err)
+	}
+	if m := <-h.mismatches; !m[0].Equal(net.ParseIP("127.0.0.1")) || m[1] != nil {
+		t.Fatal("unexpected mismatch", m)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-errs
+	if len(firewall.opened) != 0 {
+		t.Fatal("mismatched packet must not be granted", firewall.opened)
+	}
+}
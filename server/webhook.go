@@ -0,0 +1,347 @@
+package spaserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/1uLang/libspa"
+	"github.com/1uLang/libspa/encrypt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrWebhookStatus = errors.New("webhook returned unexpected status")
+
+const (
+	// 缓存数量上限，超过时清理已到期的缓存
+	webhookCacheSize = 10000
+	// 拒绝结果的默认缓存时间上限
+	webhookNegativeCacheTTL = 10 * time.Second
+)
+
+// WebhookConfig 外部IAM回调配置
+type WebhookConfig struct {
+	//回调地址
+	URL string
+	//客户端证书及私钥，用于 mTLS
+	CertFile string
+	KeyFile  string
+	//校验服务端证书的CA，为空时使用系统CA
+	CAFile string
+	//请求签名密钥，设置时请求头携带 X-SPA-Timestamp 及
+	//X-SPA-Signature: sha256=hex(HMAC-SHA256(Secret, timestamp + "." + body))
+	Secret string
+	//单次请求超时，默认5秒
+	Timeout time.Duration
+	//请求失败（网络错误或5xx）时的重试次数
+	Retries int
+	//重试间隔，默认200毫秒
+	RetryDelay time.Duration
+	//认证结果缓存时间，按设备ID、来源IP及监听缓存，为0时不缓存
+	CacheTTL time.Duration
+	//拒绝结果的缓存时间，为0时使用 CacheTTL 与10秒中较小的值，小于0时不缓存拒绝结果
+	NegativeCacheTTL time.Duration
+	//回调失败时的放行（fail-open），为空时拒绝（fail-closed）
+	FailOpen *Allow
+}
+
+// WebhookRequest 回调请求体
+type WebhookRequest struct {
+	DeviceID       string `json:"device_id"`
+	ClientPublicIP string `json:"client_public_ip,omitempty"`
+	ServerPublicIP string `json:"server_public_ip,omitempty"`
+	SourceIP       string `json:"source_ip,omitempty"`
+	SourcePort     int    `json:"source_port,omitempty"`
+	//请求访问的协议及端口，即接收spa报的监听
+	Protocol  string    `json:"protocol,omitempty"`
+	LocalPort int       `json:"local_port,omitempty"`
+	LocalAddr string    `json:"local_addr,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	KeyID     uint32    `json:"key_id,omitempty"`
+	Renewal   bool      `json:"renewal,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// WebhookResponse 回调响应体
+type WebhookResponse struct {
+	Allow    bool   `json:"allow"`
+	TcpPorts []int  `json:"tcp_ports"`
+	UdpPorts []int  `json:"udp_ports"`
+	User     string `json:"user"`
+	//放行时间（秒），为0时使用 SPATimeout
+	Duration int `json:"duration"`
+	//目标地址，放行转发到该地址的流量
+	Destination string `json:"destination"`
+	//放行来源IP所在网段的前缀长度
+	SourcePrefix int `json:"source_prefix"`
+	//拒绝原因，记录于日志
+	Reason string `json:"reason"`
+}
+
+func (r *WebhookResponse) allow() (*Allow, error) {
+	allow := &Allow{
+		TcpPorts:     r.TcpPorts,
+		UdpPorts:     r.UdpPorts,
+		Duration:     time.Duration(r.Duration) * time.Second,
+		SourcePrefix: r.SourcePrefix,
+		User:         r.User,
+	}
+	if r.Destination != "" {
+		if allow.Destination = net.ParseIP(r.Destination); allow.Destination == nil {
+			return nil, errors.New("invalid webhook destination " + r.Destination)
+		}
+	}
+	return allow, nil
+}
+
+// WebhookHandler 将认证请求POST到外部IAM服务，按响应放行
+type WebhookHandler struct {
+	config WebhookConfig
+	client *http.Client
+
+	locker sync.Mutex
+	cache  map[string]*webhookCacheEntry
+}
+
+type webhookCacheEntry struct {
+	allow   *Allow
+	expires time.Time
+}
+
+// NewWebhookHandler 创建回调 Handler，加载证书失败时返回错误
+func NewWebhookHandler(config WebhookConfig) (*WebhookHandler, error) {
+	if config.URL == "" {
+		return nil, errors.New("webhook url is empty")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = 200 * time.Millisecond
+	}
+	tlsConfig, err := webhookTLSConfig(&config)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &WebhookHandler{
+		config: config,
+		client: &http.Client{Transport: transport, Timeout: config.Timeout},
+		cache:  map[string]*webhookCacheEntry{},
+	}, nil
+}
+
+// 加载 mTLS 证书及CA
+func webhookTLSConfig(config *WebhookConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load webhook client cert error:%v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.CAFile != "" {
+		data, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load webhook ca error:%v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("load webhook ca error:no certificate found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func (h *WebhookHandler) OnConnect(conn *Conn) {}
+
+// OnAuthority 未通过 Server 调用时请求中不包含来源地址
+func (h *WebhookHandler) OnAuthority(body *libspa.Body, err error) (*Allow, error) {
+	if err != nil {
+		return nil, err
+	}
+	return h.authorize(h.request(body, nil))
+}
+
+// OnRequest 通过 Server 调用时请求中包含来源地址、加密方式及密钥ID
+func (h *WebhookHandler) OnRequest(r *Request) (*Allow, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	req := h.request(r.Body, r.Conn)
+	req.Method, _ = encrypt.MethodName(r.Method)
+	req.KeyID, req.Renewal = r.KeyId, r.Renewal
+	return h.authorize(req)
+}
+
+func (h *WebhookHandler) OnClose(conn *Conn, err error) {}
+
+// 生成回调请求
+func (h *WebhookHandler) request(body *libspa.Body, conn *Conn) *WebhookRequest {
+	req := &WebhookRequest{DeviceID: body.ClientDeviceId, Time: time.Now().UTC()}
+	if body.ClientPublicIP != nil {
+		req.ClientPublicIP = body.ClientPublicIP.String()
+	}
+	if body.ServerPublicIP != nil {
+		req.ServerPublicIP = body.ServerPublicIP.String()
+	}
+	if conn != nil {
+		req.Protocol = conn.Protocol()
+		if ip := conn.RemoteIP(); ip != nil {
+			req.SourceIP = ip.String()
+		}
+		if _, port, err := net.SplitHostPort(conn.RemoteAddr()); err == nil {
+			req.SourcePort, _ = strconv.Atoi(port)
+		}
+		req.LocalAddr = conn.LocalAddr()
+		if _, port, err := net.SplitHostPort(req.LocalAddr); err == nil {
+			req.LocalPort, _ = strconv.Atoi(port)
+		}
+	}
+	return req
+}
+
+// 查询缓存或回调，回调失败时按 FailOpen 处理
+func (h *WebhookHandler) authorize(req *WebhookRequest) (*Allow, error) {
+	key := req.DeviceID + "|" + req.SourceIP + "|" + req.Protocol + "|" + strconv.Itoa(req.LocalPort)
+	if allow, ok := h.cached(key, time.Now()); ok {
+		return allow, nil
+	}
+	resp, err := h.call(req)
+	if err != nil {
+		log.Error("webhook err:", err)
+		if h.config.FailOpen != nil {
+			allow := *h.config.FailOpen
+			return &allow, nil
+		}
+		return nil, err
+	}
+	var allow *Allow
+	if resp.Allow {
+		if allow, err = resp.allow(); err != nil {
+			log.Error("webhook err:", err)
+			return nil, err
+		}
+	} else {
+		log.Debug(fmt.Sprintf("webhook denied device %s: %s", req.DeviceID, resp.Reason))
+	}
+	h.store(key, allow, time.Now())
+	return allow, nil
+}
+
+func (h *WebhookHandler) cached(key string, now time.Time) (*Allow, bool) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	entry, ok := h.cache[key]
+	if !ok || !entry.expires.After(now) {
+		return nil, false
+	}
+	if entry.allow == nil {
+		return nil, true
+	}
+	allow := *entry.allow
+	return &allow, true
+}
+
+func (h *WebhookHandler) store(key string, allow *Allow, now time.Time) {
+	ttl := h.config.CacheTTL
+	if allow == nil {
+		ttl = h.negativeTTL()
+	}
+	if ttl <= 0 {
+		return
+	}
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	if len(h.cache) >= webhookCacheSize {
+		for k, entry := range h.cache {
+			if !entry.expires.After(now) {
+				delete(h.cache, k)
+			}
+		}
+	}
+	if len(h.cache) < webhookCacheSize {
+		h.cache[key] = &webhookCacheEntry{allow: allow, expires: now.Add(ttl)}
+	}
+}
+
+// 拒绝结果的缓存时间，较短以便IAM修改后尽快生效
+func (h *WebhookHandler) negativeTTL() time.Duration {
+	if h.config.NegativeCacheTTL != 0 {
+		return h.config.NegativeCacheTTL
+	}
+	if h.config.CacheTTL < webhookNegativeCacheTTL {
+		return h.config.CacheTTL
+	}
+	return webhookNegativeCacheTTL
+}
+
+// 发送回调请求，网络错误及5xx时重试
+func (h *WebhookHandler) call(req *WebhookRequest) (*WebhookResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, retry, err := h.post(data)
+		if err == nil || !retry || attempt >= h.config.Retries {
+			return resp, err
+		}
+		time.Sleep(h.config.RetryDelay)
+	}
+}
+
+// 发送一次回调请求，返回是否可重试
+func (h *WebhookHandler) post(data []byte) (*WebhookResponse, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-SPA-Timestamp", timestamp)
+		req.Header.Set("X-SPA-Signature", "sha256="+WebhookSignature(h.config.Secret, timestamp, data))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		return nil, resp.StatusCode >= 500, fmt.Errorf("%w %s", ErrWebhookStatus, resp.Status)
+	}
+	result := &WebhookResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result); err != nil {
+		return nil, false, fmt.Errorf("decode webhook response error:%v", err)
+	}
+	return result, false, nil
+}
+
+// WebhookSignature 回调请求签名，hex(HMAC-SHA256(secret, timestamp + "." + body))
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
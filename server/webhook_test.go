@@ -0,0 +1,205 @@
+package spaserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/1uLang/libspa"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		data, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-SPA-Signature") != "sha256="+WebhookSignature("secret", r.Header.Get("X-SPA-Timestamp"), data) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req WebhookRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.DeviceID != firstDevice || req.SourceIP != "127.0.0.1" || req.Protocol != "udp" || req.LocalPort == 0 || req.ClientPublicIP != "203.0.113.7" {
+			json.NewEncoder(w).Encode(&WebhookResponse{Reason: "unknown device"})
+			return
+		}
+		json.NewEncoder(w).Encode(&WebhookResponse{Allow: true, TcpPorts: []int{22}, User: "alice"})
+	}))
+	defer srv.Close()
+
+	h, err := NewWebhookHandler(WebhookConfig{URL: srv.URL, Secret: "secret", CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	conn := newUDPConn(packetConn, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000})
+	body := &libspa.Body{ClientDeviceId: firstDevice, ClientPublicIP: net.ParseIP("203.0.113.7")}
+
+	for i := 0; i < 2; i++ {
+		allow, err := h.OnRequest(&Request{Conn: conn, SourceIP: conn.RemoteIP(), Body: body})
+		if err != nil || allow == nil || !reflect.DeepEqual(allow.TcpPorts, []int{22}) || allow.User != "alice" {
+			t.Fatal("unexpected allow", allow, err)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("second request should be cached, calls", atomic.LoadInt32(&calls))
+	}
+	//无来源地址时被拒绝，拒绝结果同样缓存
+	for i := 0; i < 2; i++ {
+		if allow, err := h.OnAuthority(body, nil); err != nil || allow != nil {
+			t.Fatal("expect deny", allow, err)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatal("deny should be cached, calls", atomic.LoadInt32(&calls))
+	}
+	//解析失败时不回调
+	if _, err := h.OnAuthority(nil, libspa.InvalidStartCodePacket); err != libspa.InvalidStartCodePacket {
+		t.Fatal("expect parse error", err)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatal("invalid packet should not call webhook, calls", atomic.LoadInt32(&calls))
+	}
+}
+
+// 拒绝结果的缓存时间短于放行结果
+func TestWebhookHandler_NegativeCache(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		json.NewEncoder(w).Encode(&WebhookResponse{Reason: "denied"})
+	}))
+	defer srv.Close()
+	body := &libspa.Body{ClientDeviceId: firstDevice}
+
+	h, err := NewWebhookHandler(WebhookConfig{URL: srv.URL, CacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := h.negativeTTL(); ttl != 10*time.Second {
+		t.Fatal("unexpected default negative ttl", ttl)
+	}
+	h.config.NegativeCacheTTL = 20 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		if allow, err := h.OnAuthority(body, nil); err != nil || allow != nil {
+			t.Fatal("expect deny", allow, err)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("deny should be cached, calls", atomic.LoadInt32(&calls))
+	}
+	time.Sleep(30 * time.Millisecond)
+	h.OnAuthority(body, nil)
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatal("deny should expire after negative ttl, calls", atomic.LoadInt32(&calls))
+	}
+
+	//小于0时不缓存拒绝结果
+	h.config.NegativeCacheTTL = -1
+	h.cache = map[string]*webhookCacheEntry{}
+	h.OnAuthority(body, nil)
+	h.OnAuthority(body, nil)
+	if atomic.LoadInt32(&calls) != 4 {
+		t.Fatal("deny should not be cached, calls", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestWebhookHandler_Retry(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt32(&calls, 1); n < 3 {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			return
+		}
+		json.NewEncoder(w).Encode(&WebhookResponse{Allow: true, UdpPorts: []int{53}})
+	}))
+	defer srv.Close()
+	body := &libspa.Body{ClientDeviceId: firstDevice}
+
+	h, err := NewWebhookHandler(WebhookConfig{URL: srv.URL, Retries: 2, RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allow, err := h.OnAuthority(body, nil); err != nil || allow == nil || !reflect.DeepEqual(allow.UdpPorts, []int{53}) {
+		t.Fatal("expect allow after retries", allow, err)
+	}
+
+	//4xx 不重试，默认拒绝
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	if allow, err := h.OnAuthority(body, nil); err == nil || allow != nil || atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("expect fail-closed without retry", allow, err, atomic.LoadInt32(&calls))
+	}
+
+	//回调失败时放行
+	h, err = NewWebhookHandler(WebhookConfig{URL: srv.URL, Timeout: time.Second, FailOpen: &Allow{TcpPorts: []int{22}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&calls, 0)
+	if allow, err := h.OnAuthority(body, nil); err != nil || allow == nil || !reflect.DeepEqual(allow.TcpPorts, []int{22}) {
+		t.Fatal("expect fail-open", allow, err)
+	}
+}
+
+func TestWebhookHandler_MutualTLS(t *testing.T) {
+	clientCA, err := ioutil.ReadFile("../certs/client.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(clientCA) {
+		t.Fatal("load client ca failed")
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(&WebhookResponse{Allow: true, TcpPorts: []int{443}, User: r.TLS.PeerCertificates[0].Subject.CommonName})
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	body := &libspa.Body{ClientDeviceId: firstDevice}
+
+	//未提供客户端证书时握手失败
+	h, err := NewWebhookHandler(WebhookConfig{URL: srv.URL, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.OnAuthority(body, nil); err == nil {
+		t.Fatal("expect tls error without client cert")
+	}
+
+	h, err = NewWebhookHandler(WebhookConfig{URL: srv.URL, CAFile: caFile, CertFile: "../certs/client.pem", KeyFile: "../certs/client.key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow, err := h.OnAuthority(body, nil)
+	if err != nil || allow == nil || allow.User != "www.random.com" {
+		t.Fatal("unexpected allow", allow, err)
+	}
+}
@@ -0,0 +1,310 @@
+package libspa
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/1uLang/libspa/encrypt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	sessionVersion = 0x01
+	// magic(4) + version(1) + key id(4) + client salt(16)
+	sessionHelloLength = 25
+	sessionSaltLength  = 16
+	// 记录长度前缀
+	recordPrefixLength = 2
+	// 单条记录最大明文长度
+	MaxRecordLength = 16 * 1024
+)
+
+var (
+	sessionMagic = []byte("SPAS")
+
+	InvalidSessionHello  = errors.New("invalid session (hello is error)")
+	InvalidSessionRecord = errors.New("invalid session (record authentication failed)")
+	InvalidRecordLength  = errors.New("invalid session (record length is error)")
+	SessionSeqExhausted  = errors.New("session sequence number exhausted")
+)
+
+// spa tcp session:
+//
+//	client -> server: "SPAS" | VERSION[0x01] | KEY ID(4) | CLIENT SALT(16)
+//	server -> client: SERVER SALT(16)
+//	both directions : LENGTH(2) | AES-256-GCM(RECORD)
+//
+// 两个方向分别使用 HKDF-SHA256(key+iv, client salt+server salt) 派生的密钥，
+// nonce 为各方向从0开始递增的64位序列号，长度前缀作为附加数据参与认证。
+// 客户端发送的记录为 spa 报，服务端发送的记录为 Reply。
+
+// Session TCP加密会话，支持部分读取及多条记录合并到达的情况
+type Session struct {
+	isClient bool
+	w        io.Writer
+	r        io.Reader
+	keys     *encrypt.KeySet
+	key      *encrypt.Key
+	salt     []byte
+
+	established bool
+	seal        cipher.AEAD
+	open        cipher.AEAD
+	sendSeq     uint64
+	recvSeq     uint64
+	buf         []byte
+	pending     [][]byte
+	//读取出错后会话不可再用
+	err error
+
+	readLocker  sync.Mutex
+	writeLocker sync.Mutex
+}
+
+// IsSessionHello 判断连接首字节是否为会话握手，旧格式spa报以起始码开头
+func IsSessionHello(data []byte) bool {
+	return len(data) > 0 && data[0] == sessionMagic[0]
+}
+
+// NewClientSession 发送握手并等待服务端应答，rw 通常为TCP连接
+func NewClientSession(rw io.ReadWriter, key *encrypt.Key) (*Session, error) {
+	s := &Session{isClient: true, w: rw, r: rw, key: key, salt: make([]byte, sessionSaltLength)}
+	if _, err := rand.Read(s.salt); err != nil {
+		return nil, err
+	}
+	hello := make([]byte, 0, sessionHelloLength)
+	hello = append(hello, sessionMagic...)
+	hello = append(hello, sessionVersion)
+	hello = append(hello, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(hello[len(sessionMagic)+1:], key.ID)
+	hello = append(hello, s.salt...)
+	if _, err := rw.Write(hello); err != nil {
+		return nil, err
+	}
+	serverSalt := make([]byte, sessionSaltLength)
+	if _, err := io.ReadFull(rw, serverSalt); err != nil {
+		return nil, errors.Wrap(err, "read session hello")
+	}
+	if err := s.establish(serverSalt); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewServerSession 创建服务端会话，握手应答及记录写入 w，握手中的密钥ID从 keys 中选择当前有效的密钥
+func NewServerSession(w io.Writer, keys *encrypt.KeySet) *Session {
+	return &Session{w: w, keys: keys}
+}
+
+// KeyId 会话使用的密钥ID
+func (s *Session) KeyId() uint32 {
+	if s.key == nil {
+		return 0
+	}
+	return s.key.ID
+}
+
+// Feed 写入从连接读取的数据，返回其中所有完整的记录，不完整的数据保留至下次写入
+func (s *Session) Feed(data []byte) ([][]byte, error) {
+	s.readLocker.Lock()
+	defer s.readLocker.Unlock()
+	return s.feed(data)
+}
+
+func (s *Session) feed(data []byte) ([][]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	records, err := s.read(data)
+	if err != nil {
+		s.err, s.buf = err, nil
+	}
+	return records, err
+}
+
+func (s *Session) read(data []byte) ([][]byte, error) {
+	s.buf = append(s.buf, data...)
+	if !s.established {
+		if s.isClient || len(s.buf) < sessionHelloLength {
+			return nil, nil
+		}
+		if err := s.accept(s.buf[:sessionHelloLength]); err != nil {
+			return nil, err
+		}
+		s.buf = s.buf[sessionHelloLength:]
+	}
+
+	var records [][]byte
+	for len(s.buf) >= recordPrefixLength {
+		length := int(binary.BigEndian.Uint16(s.buf))
+		if length < s.open.Overhead() || length > MaxRecordLength+s.open.Overhead() {
+			return records, InvalidRecordLength
+		}
+		if len(s.buf) < recordPrefixLength+length {
+			break
+		}
+		record, err := s.open.Open(nil, s.nonce(s.recvSeq), s.buf[recordPrefixLength:recordPrefixLength+length], s.buf[:recordPrefixLength])
+		if err != nil {
+			return records, InvalidSessionRecord
+		}
+		s.recvSeq++
+		s.buf = s.buf[recordPrefixLength+length:]
+		records = append(records, record)
+	}
+	//避免底层数组无限增长
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	return records, nil
+}
+
+// ReadRecord 从连接中读取下一条记录，仅用于客户端会话
+func (s *Session) ReadRecord() ([]byte, error) {
+	s.readLocker.Lock()
+	defer s.readLocker.Unlock()
+	if s.r == nil {
+		return nil, errors.New("session has no reader")
+	}
+	buf := make([]byte, 4096)
+	for len(s.pending) == 0 {
+		n, err := s.r.Read(buf)
+		if n > 0 {
+			records, ferr := s.feed(buf[:n])
+			if ferr != nil {
+				return nil, ferr
+			}
+			s.pending = append(s.pending, records...)
+		}
+		if err != nil && len(s.pending) == 0 {
+			return nil, err
+		}
+	}
+	record := s.pending[0]
+	s.pending = s.pending[1:]
+	return record, nil
+}
+
+// WriteRecord 加密并发送一条记录
+func (s *Session) WriteRecord(data []byte) error {
+	if len(data) > MaxRecordLength {
+		return InvalidRecordLength
+	}
+	s.writeLocker.Lock()
+	defer s.writeLocker.Unlock()
+	if !s.established {
+		return errors.New("session is not established")
+	}
+	if s.sendSeq == ^uint64(0) {
+		return SessionSeqExhausted
+	}
+	frame := make([]byte, recordPrefixLength, recordPrefixLength+len(data)+s.seal.Overhead())
+	binary.BigEndian.PutUint16(frame, uint16(len(data)+s.seal.Overhead()))
+	frame = s.seal.Seal(frame, s.nonce(s.sendSeq), data, frame[:recordPrefixLength])
+	s.sendSeq++
+	_, err := s.w.Write(frame)
+	return err
+}
+
+// 服务端处理客户端握手
+func (s *Session) accept(hello []byte) error {
+	if !bytes.Equal(hello[:len(sessionMagic)], sessionMagic) || hello[len(sessionMagic)] != sessionVersion {
+		return InvalidSessionHello
+	}
+	offset := len(sessionMagic) + 1
+	key, err := s.keys.Get(binary.BigEndian.Uint32(hello[offset:offset+4]), time.Now())
+	if err != nil {
+		return InvalidKeyPacket
+	}
+	offset += 4
+	s.key = key
+	s.salt = append([]byte{}, hello[offset:offset+sessionSaltLength]...)
+
+	serverSalt := make([]byte, sessionSaltLength)
+	if _, err := rand.Read(serverSalt); err != nil {
+		return err
+	}
+	if err := s.establish(serverSalt); err != nil {
+		return err
+	}
+	s.writeLocker.Lock()
+	defer s.writeLocker.Unlock()
+	_, err = s.w.Write(serverSalt)
+	return err
+}
+
+// 派生两个方向的会话密钥
+func (s *Session) establish(serverSalt []byte) error {
+	c2s, err := s.deriveAEAD(serverSalt, "libspa session c2s")
+	if err != nil {
+		return err
+	}
+	s2c, err := s.deriveAEAD(serverSalt, "libspa session s2c")
+	if err != nil {
+		return err
+	}
+	if s.isClient {
+		s.seal, s.open = c2s, s2c
+	} else {
+		s.seal, s.open = s2c, c2s
+	}
+	s.established = true
+	return nil
+}
+
+func (s *Session) deriveAEAD(serverSalt []byte, info string) (cipher.AEAD, error) {
+	secret := append(append([]byte{}, s.key.Key...), s.key.IV...)
+	salt := append(append([]byte{}, s.salt...), serverSalt...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *Session) nonce(seq uint64) []byte {
+	nonce := make([]byte, s.seal.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// Reply 服务端对会话中每个spa报的应答
+type Reply struct {
+	Code    ReplyCode
+	Message string
+}
+
+type ReplyCode uint8
+
+const (
+	ReplyAllowed ReplyCode = iota
+	ReplyBlocked
+	ReplyInvalid
+	// spa报中的 ServerPublicIP 不是该服务器的地址
+	ReplyServerMismatch
+	// 超出服务端限速
+	ReplyRateLimited
+)
+
+// Encode 编码应答
+func (r *Reply) Encode() []byte {
+	return append([]byte{byte(r.Code)}, r.Message...)
+}
+
+// DecodeReply 解码应答
+func DecodeReply(data []byte) (*Reply, error) {
+	if len(data) == 0 {
+		return nil, errors.New("reply is empty")
+	}
+	return &Reply{Code: ReplyCode(data[0]), Message: string(data[1:])}, nil
+}
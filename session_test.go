@@ -0,0 +1,153 @@
+package libspa
+
+import (
+	"bytes"
+	"github.com/1uLang/libspa/encrypt"
+	"io"
+	"net"
+	"testing"
+)
+
+// 通过 net.Pipe 完成握手，之后两端改为读写内存缓冲以便控制数据分段
+func newSessionPair(t *testing.T) (client, server *Session, c2s, s2c *bytes.Buffer) {
+	key := &encrypt.Key{ID: 3, Key: []byte("session-key"), IV: []byte("session-iv")}
+	keys, err := encrypt.NewKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		client, err = NewClientSession(a, key)
+		done <- err
+	}()
+	hello := make([]byte, sessionHelloLength)
+	if _, err := io.ReadFull(b, hello); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSessionHello(hello) {
+		t.Fatal("expect session hello")
+	}
+	server = NewServerSession(b, keys)
+	if records, err := server.Feed(hello); err != nil || len(records) != 0 {
+		t.Fatal("unexpected hello result", records, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if server.KeyId() != 3 {
+		t.Fatal("unexpected key id", server.KeyId())
+	}
+
+	c2s, s2c = &bytes.Buffer{}, &bytes.Buffer{}
+	client.w, client.r, server.w = c2s, s2c, s2c
+	return
+}
+
+func TestSession_PartialAndCoalesced(t *testing.T) {
+	client, server, c2s, s2c := newSessionPair(t)
+	messages := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{'x'}, MaxRecordLength)}
+	for _, m := range messages {
+		if err := client.WriteRecord(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//逐字节写入
+	var records [][]byte
+	for _, b := range c2s.Bytes() {
+		got, err := server.Feed([]byte{b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, got...)
+	}
+	if len(records) != len(messages) {
+		t.Fatalf("expect %d records, got %d", len(messages), len(records))
+	}
+	for i := range messages {
+		if !bytes.Equal(records[i], messages[i]) {
+			t.Fatalf("record %d mismatch", i)
+		}
+	}
+
+	//多条应答合并到达
+	replies := []*Reply{{Code: ReplyAllowed}, {Code: ReplyBlocked}, {Code: ReplyInvalid, Message: "invalid packet"}}
+	for _, r := range replies {
+		if err := server.WriteRecord(r.Encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range replies {
+		record, err := client.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeReply(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != *want {
+			t.Fatalf("unexpected reply %+v, want %+v", got, want)
+		}
+	}
+	if s2c.Len() != 0 {
+		t.Fatal("unread reply data")
+	}
+}
+
+func TestSession_Tampered(t *testing.T) {
+	client, server, c2s, _ := newSessionPair(t)
+	if err := client.WriteRecord([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteRecord([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	data := c2s.Bytes()
+	//交换记录顺序后序列号不匹配
+	first := append([]byte{}, data[:recordPrefixLength+5+16]...)
+	second := append([]byte{}, data[len(first):]...)
+	if _, err := server.Feed(append(second, first...)); err != InvalidSessionRecord {
+		t.Fatal("expect InvalidSessionRecord, got", err)
+	}
+
+	client, server, c2s, _ = newSessionPair(t)
+	if err := client.WriteRecord([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	data = c2s.Bytes()
+	data[len(data)-1] ^= 1
+	if _, err := server.Feed(data); err != InvalidSessionRecord {
+		t.Fatal("expect InvalidSessionRecord, got", err)
+	}
+	//出错后会话不可再用
+	if _, err := server.Feed(nil); err != InvalidSessionRecord {
+		t.Fatal("expect InvalidSessionRecord, got", err)
+	}
+
+	_, server, _, _ = newSessionPair(t)
+	if _, err := server.Feed([]byte{0xff, 0xff}); err != InvalidRecordLength {
+		t.Fatal("expect InvalidRecordLength, got", err)
+	}
+}
+
+func TestSession_UnknownKey(t *testing.T) {
+	keys, err := encrypt.NewKeySet(&encrypt.Key{ID: 1, Key: []byte("k"), IV: []byte("i")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := append(append([]byte{}, sessionMagic...), sessionVersion, 0, 0, 0, 9)
+	hello = append(hello, make([]byte, sessionSaltLength)...)
+	if _, err := NewServerSession(&bytes.Buffer{}, keys).Feed(hello); err != InvalidKeyPacket {
+		t.Fatal("expect InvalidKeyPacket, got", err)
+	}
+	hello[4] = 0x09
+	if _, err := NewServerSession(&bytes.Buffer{}, keys).Feed(hello); err != InvalidSessionHello {
+		t.Fatal("expect InvalidSessionHello, got", err)
+	}
+}
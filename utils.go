@@ -57,6 +57,8 @@ func CheckPort(port int) bool {
 	return port > 0 && port <= 65535
 }
 
+// GetPort 获取一个当前未被占用的tcp端口
+// 端口在返回后即释放，可能被其他进程占用，监听时应直接使用0端口由系统分配
 func GetPort() (int, error) {
 
 	address, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")